@@ -19,3 +19,16 @@ func addChannel(params []string) (err error, ok bool) {
 	ok = true
 	return
 }
+
+func addEphemeralChannel(params []string) (err error, ok bool) {
+	var vhost, name string
+	if vhost, name, ok = channelParams(params); !ok {
+		return
+	}
+	_, err = performRequest("POST", vhost+"/channels/"+name+"?ephemeral=true", "channel")
+	if err != nil {
+		return
+	}
+	ok = true
+	return
+}
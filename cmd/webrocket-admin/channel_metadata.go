@@ -0,0 +1,60 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"sort"
+)
+
+func channelMetadataParams(params []string, withValue bool) (vhost, name, key, value string, ok bool) {
+	if withValue && len(params) == 4 && params[0] != "" && params[1] != "" && params[2] != "" {
+		ok, vhost, name, key, value = true, params[0], params[1], params[2], params[3]
+	} else if !withValue && len(params) == 3 && params[0] != "" && params[1] != "" && params[2] != "" {
+		ok, vhost, name, key = true, params[0], params[1], params[2]
+	}
+	return
+}
+
+func showChannel(params []string) (err error, ok bool) {
+	var vhost, name string
+	var res *Response
+	if vhost, name, ok = channelParams(params); !ok {
+		return
+	}
+	res, err = performRequest("GET", vhost+"/channels/"+name, "channel")
+	if err != nil {
+		return
+	}
+	if channel, ok := maybeChannel(res.Data); ok {
+		fmt.Printf("%s\t(%d subscribers)\n", channel.Name, channel.SubscribersSize)
+		keys := make([]string, 0, len(channel.Metadata))
+		for key := range channel.Metadata {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			fmt.Printf("%s: %s\n", key, channel.Metadata[key])
+		}
+	}
+	return
+}
+
+func setChannelMetadata(params []string) (err error, ok bool) {
+	var vhost, name, key, value string
+	if vhost, name, key, value, ok = channelMetadataParams(params, true); !ok {
+		return
+	}
+	query := url.Values{"key": {key}, "value": {value}}
+	_, err = performRequest("PUT", vhost+"/channels/"+name+"/metadata?"+query.Encode(), "")
+	return
+}
+
+func deleteChannelMetadata(params []string) (err error, ok bool) {
+	var vhost, name, key string
+	if vhost, name, key, _, ok = channelMetadataParams(params, false); !ok {
+		return
+	}
+	query := url.Values{"key": {key}}
+	_, err = performRequest("DELETE", vhost+"/channels/"+name+"/metadata?"+query.Encode(), "")
+	return
+}
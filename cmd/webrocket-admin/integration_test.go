@@ -61,6 +61,51 @@ var expectations = []cmdtest{
 	}, {
 		[]string{"regenerate_vhost_token", "/hello"},
 		regexp.MustCompile(".{40}"),
+	}, {
+		[]string{"set_log_level", "verbose"},
+		regexp.MustCompile("invalid log level"),
+	}, {
+		[]string{"set_log_level", "debug"},
+		regexp.MustCompile("^$"),
+	}, {
+		[]string{"set_vhost_log_level", "/foobar", "debug"},
+		regexp.MustCompile("vhost doesn't exist"),
+	}, {
+		[]string{"set_vhost_log_level", "/hello", "verbose"},
+		regexp.MustCompile("invalid log level"),
+	}, {
+		[]string{"set_vhost_log_level", "/hello", "error"},
+		regexp.MustCompile("^$"),
+	}, {
+		[]string{"reset_vhost_log_level", "/foobar"},
+		regexp.MustCompile("vhost doesn't exist"),
+	}, {
+		[]string{"reset_vhost_log_level", "/hello"},
+		regexp.MustCompile("^$"),
+	}, {
+		[]string{"list_origins", "/foobar"},
+		regexp.MustCompile("vhost doesn't exist"),
+	}, {
+		[]string{"list_origins", "/hello"},
+		regexp.MustCompile("^$"),
+	}, {
+		[]string{"add_origin", "/hello", "https://*.example.com"},
+		regexp.MustCompile("^$"),
+	}, {
+		[]string{"add_origin", "/hello", "https://*.example.com"},
+		regexp.MustCompile("origin already allowed"),
+	}, {
+		[]string{"add_origin", "/hello", "http://"},
+		regexp.MustCompile("invalid origin"),
+	}, {
+		[]string{"list_origins", "/hello"},
+		regexp.MustCompile("^https://\\*\\.example\\.com\n$"),
+	}, {
+		[]string{"delete_origin", "/hello", "https://example.com"},
+		regexp.MustCompile("origin not allowed"),
+	}, {
+		[]string{"delete_origin", "/hello", "https://*.example.com"},
+		regexp.MustCompile("^$"),
 	}, {
 		[]string{"list_channels", "/foobar"},
 		regexp.MustCompile("vhost doesn't exist"),
@@ -94,6 +139,27 @@ var expectations = []cmdtest{
 	}, {
 		[]string{"add_channel", "/hello", "bar"},
 		regexp.MustCompile("^$"),
+	}, {
+		[]string{"add_ephemeral_channel", "/hello", "baz"},
+		regexp.MustCompile("^$"),
+	}, {
+		[]string{"list_channels", "/hello"},
+		regexp.MustCompile("bar\t\\(0 subscribers\\)\nbaz\t\\(0 subscribers, ephemeral\\)\n"),
+	}, {
+		[]string{"set_channel_metadata", "/hello", "foobar", "title", "Foo"},
+		regexp.MustCompile("channel doesn't exist"),
+	}, {
+		[]string{"set_channel_metadata", "/hello", "bar", "title", "Bar room"},
+		regexp.MustCompile("^$"),
+	}, {
+		[]string{"show_channel", "/hello", "bar"},
+		regexp.MustCompile("title: Bar room\n"),
+	}, {
+		[]string{"delete_channel_metadata", "/hello", "bar", "owner"},
+		regexp.MustCompile("metadata key doesn't exist"),
+	}, {
+		[]string{"delete_channel_metadata", "/hello", "bar", "title"},
+		regexp.MustCompile("^$"),
 	}, {
 		[]string{"clear_channels", "/foobar"},
 		regexp.MustCompile("vhost doesn't exist"),
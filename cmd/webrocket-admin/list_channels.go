@@ -21,16 +21,20 @@ func listChannels(params []string) (err error, ok bool) {
 		err = errors.New("couldn't list channels, invalid response")
 		return
 	}
-	names, channels := make([]string, len(entries)), make([]*Channel, len(entries))
+	names, channels := make([]string, len(entries)), make(map[string]*Channel)
 	for i, x := range entries {
 		if channel, ok := maybeChannel(x); ok {
 			names[i] = channel.Name
-			channels[i] = channel
+			channels[channel.Name] = channel
 		}
 	}
 	sort.Strings(names)
-	for i, name := range names {
-		fmt.Printf("%s\t(%d subscribers)\n", name, channels[i].SubscribersSize)
+	for _, name := range names {
+		if channel, ok := channels[name]; ok && channel.Ephemeral {
+			fmt.Printf("%s\t(%d subscribers, ephemeral)\n", name, channel.SubscribersSize)
+		} else if ok {
+			fmt.Printf("%s\t(%d subscribers)\n", name, channel.SubscribersSize)
+		}
 	}
 	return
 }
@@ -46,9 +46,19 @@ var Commands = []*Command{
 	&Command{"regenerate_vhost_token", regenerateVhostToken, "[path]", "Generates new access token for the specified vhost"},
 	&Command{"list_channels", listChannels, "[vhost]", "Shows list of channels opened under given vhost"},
 	&Command{"add_channel", addChannel, "[vhost] [name]", "Opens new channel under given vhost"},
+	&Command{"add_ephemeral_channel", addEphemeralChannel, "[vhost] [name]", "Opens new channel kept in memory only under given vhost"},
 	&Command{"delete_channel", deleteChannel, "[vhost] [name]", "Removes channel from the specified vhost"},
+	&Command{"show_channel", showChannel, "[vhost] [name]", "Shows information about the specified channel and its metadata"},
+	&Command{"set_channel_metadata", setChannelMetadata, "[vhost] [name] [key] [value]", "Sets the channel's metadata entry"},
+	&Command{"delete_channel_metadata", deleteChannelMetadata, "[vhost] [name] [key]", "Removes the channel's metadata entry"},
 	&Command{"clear_channels", clearChannels, "[vhost]", "Removes all channel from the specified vhost"},
 	&Command{"list_workers", listWorkers, "[vhost]", "Shows list of the backend workers connected to the specified vhost"},
+	&Command{"list_origins", listOrigins, "[vhost]", "Shows list of the origins allowed to connect to the specified vhost"},
+	&Command{"add_origin", addOrigin, "[vhost] [origin]", "Allows clients to connect from given origin (eg. https://*.example.com)"},
+	&Command{"delete_origin", deleteOrigin, "[vhost] [origin]", "Removes given origin from the allowed ones"},
+	&Command{"set_log_level", setLogLevel, "[level]", "Changes the global log level (debug, info, warning or error)"},
+	&Command{"set_vhost_log_level", setVhostLogLevel, "[vhost] [level]", "Overrides the log level for the specified vhost"},
+	&Command{"reset_vhost_log_level", resetVhostLogLevel, "[vhost]", "Restores the global log level for the specified vhost"},
 }
 
 // findCommands searches for the command with specified name.
@@ -205,6 +215,10 @@ type Channel struct {
 	Name string
 	// Number of the active subscribers.
 	SubscribersSize int
+	// Whether the channel is kept in memory only.
+	Ephemeral bool
+	// Custom metadata of the channel.
+	Metadata map[string]string
 }
 
 // maybeChannel takes an interface and converts it to the channel information
@@ -224,6 +238,15 @@ func maybeChannel(x interface{}) (ch *Channel, ok bool) {
 	if ch.Name, ok = data["name"].(string); !ok {
 		return nil, false
 	}
+	ch.Ephemeral, _ = data["ephemeral"].(bool)
+	if metadata, ok := data["metadata"].(map[string]interface{}); ok {
+		ch.Metadata = make(map[string]string, len(metadata))
+		for key, x := range metadata {
+			if value, ok := x.(string); ok {
+				ch.Metadata[key] = value
+			}
+		}
+	}
 	if subscribers, ok = data["subscribers"].(map[string]interface{}); !ok {
 		if ssize, ok = subscribers["size"].(float64); !ok {
 			ch.SubscribersSize = int(ssize)
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"sort"
+)
+
+func originParams(params []string) (vhost, origin string, ok bool) {
+	if len(params) == 2 && params[0] != "" && params[1] != "" {
+		ok, vhost, origin = true, params[0], params[1]
+	}
+	return
+}
+
+func listOrigins(params []string) (err error, ok bool) {
+	var vhost string
+	var entries []interface{}
+	var res *Response
+	if vhost, ok = vhostParams(params); !ok {
+		return
+	}
+	res, err = performRequest("GET", vhost+"/origins", "origins")
+	if err != nil {
+		return
+	}
+	if entries, ok = res.Data.([]interface{}); !ok {
+		err = errors.New("couldn't list origins, invalid response")
+		return
+	}
+	origins := make([]string, 0, len(entries))
+	for _, x := range entries {
+		if origin, ok := x.(string); ok {
+			origins = append(origins, origin)
+		}
+	}
+	sort.Strings(origins)
+	for _, origin := range origins {
+		fmt.Printf("%s\n", origin)
+	}
+	return
+}
+
+func addOrigin(params []string) (err error, ok bool) {
+	var vhost, origin string
+	if vhost, origin, ok = originParams(params); !ok {
+		return
+	}
+	_, err = performRequest("POST", vhost+"/origins?origin="+url.QueryEscape(origin), "")
+	return
+}
+
+func deleteOrigin(params []string) (err error, ok bool) {
+	var vhost, origin string
+	if vhost, origin, ok = originParams(params); !ok {
+		return
+	}
+	_, err = performRequest("DELETE", vhost+"/origins?origin="+url.QueryEscape(origin), "")
+	return
+}
@@ -0,0 +1,38 @@
+package main
+
+import "net/url"
+
+func logLevelParams(params []string) (level string, ok bool) {
+	if len(params) == 1 && params[0] != "" {
+		ok, level = true, params[0]
+	}
+	return
+}
+
+func setLogLevel(params []string) (err error, ok bool) {
+	var level string
+	if level, ok = logLevelParams(params); !ok {
+		return
+	}
+	_, err = performRequest("PUT", "/log_level?level="+url.QueryEscape(level), "")
+	return
+}
+
+func setVhostLogLevel(params []string) (err error, ok bool) {
+	var vhost, level string
+	if len(params) != 2 || params[0] == "" || params[1] == "" {
+		return
+	}
+	ok, vhost, level = true, params[0], params[1]
+	_, err = performRequest("PUT", vhost+"/log_level?level="+url.QueryEscape(level), "")
+	return
+}
+
+func resetVhostLogLevel(params []string) (err error, ok bool) {
+	var vhost string
+	if vhost, ok = vhostParams(params); !ok {
+		return
+	}
+	_, err = performRequest("DELETE", vhost+"/log_level", "")
+	return
+}
@@ -0,0 +1,646 @@
+// Copyright (C) 2011 by Krzysztof Kowalik <chris@nu7hat.ch>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	webrocket "github.com/webrocket/webrocket/engine"
+	"os"
+	"time"
+)
+
+// Config represents a declarative configuration file of the server node.
+// All the settings are optional, the ones explicitly set with the command
+// line flags take precedence over the values read from the file.
+//
+// Example:
+//
+//     {
+//         "websocketAddr": ":8080",
+//         "backendAddr": ":8081",
+//         "adminAddr": "127.0.0.1:8082",
+//         "nodeName": "abyss",
+//         "storageDir": "/var/lib/webrocket",
+//         "cert": "/etc/webrocket/cert.pem",
+//         "key": "/etc/webrocket/key.pem",
+//         "logFile": "/var/log/webrocket.log",
+//         "logLevel": "info",
+//         "drainTimeout": "30s",
+//         "reconnectDelay": "5s",
+//         "trustedProxies": ["127.0.0.1", "10.0.0.0/8"],
+//         "prune": false,
+//         "vhosts": [
+//             {
+//                 "path": "/hello",
+//                 "channels": ["chat", "presence-room"],
+//                 "resumeGracePeriod": "30s",
+//                 "keepaliveInterval": "25s",
+//                 "idleTimeout": "10m",
+//                 "rateLimits": {
+//                     "broadcast": {
+//                         "connection": {"rate": 5, "burst": 10},
+//                         "vhost": {"rate": 1000, "burst": 2000}
+//                     }
+//                 },
+//                 "rateLimitViolations": {"rate": 0.1, "burst": 10},
+//                 "connectionLimits": {"total": 10000, "perIp": 20, "perUid": 5},
+//                 "messageLimits": {"maxSize": 65536, "maxDepth": 16, "maxKeys": 256},
+//                 "outboundQueue": {"size": 256, "policy": "disconnect"},
+//                 "autoChannels": {"patterns": ["chat.*"], "emptyTimeout": "5m"},
+//                 "ephemeralTimeout": "1m",
+//                 "presenceByUid": true,
+//                 "publicChannelMetadata": true,
+//                 "broadcastPolicies": {
+//                     "chat.*": {"allow": "authenticated", "eventPrefixes": ["client-"]}
+//                 }
+//             }
+//         ]
+//     }
+//
+type Config struct {
+	// The websocket endpoint bind address.
+	WebsocketAddr string `json:"websocketAddr"`
+	// The backend endpoint bind address.
+	BackendAddr string `json:"backendAddr"`
+	// The admin endpoint bind address.
+	AdminAddr string `json:"adminAddr"`
+	// Custom node name.
+	NodeName string `json:"nodeName"`
+	// A path to the storage directory.
+	StorageDir string `json:"storageDir"`
+	// A path to the websocket endpoint certificate file.
+	CertFile string `json:"cert"`
+	// A path to the websocket endpoint key file.
+	KeyFile string `json:"key"`
+	// A path to the log file.
+	LogFile string `json:"logFile"`
+	// The global log level.
+	LogLevel string `json:"logLevel"`
+	// Maximum time to wait for connections to drain on SIGTERM.
+	DrainTimeout string `json:"drainTimeout"`
+	// Reconnect delay suggested to the clients while draining.
+	ReconnectDelay string `json:"reconnectDelay"`
+	// Proxies trusted to pass the clients' addresses in the X-Forwarded-For
+	// header (IPs or networks in the CIDR notation).
+	TrustedProxies []string `json:"trustedProxies"`
+	// If true, then vhosts and channels not declared in here will be
+	// removed from the storage.
+	Prune bool `json:"prune"`
+	// List of declared vhosts.
+	Vhosts []*VhostConfig `json:"vhosts"`
+}
+
+// VhostConfig represents a single vhost declaration. The settings are
+// applied to the running vhost only, they are not persisted in the storage
+// nor exposed by the admin interface, so they have to be declared in the
+// configuration file to survive restarts.
+type VhostConfig struct {
+	// The path of the vhost.
+	Path string `json:"path"`
+	// List of channels to be opened within the vhost.
+	Channels []string `json:"channels"`
+	// Time within which disconnected clients can resume their sessions,
+	// resumption is disabled when empty.
+	ResumeGracePeriod string `json:"resumeGracePeriod"`
+	// Interval of the keepalive pings, keepalive is disabled when empty.
+	KeepaliveInterval string `json:"keepaliveInterval"`
+	// Time after which idle clients are disconnected, disabled when empty.
+	IdleTimeout string `json:"idleTimeout"`
+	// Rate limits of the frontend events (event name => limits).
+	RateLimits map[string]*RateLimitsConfig `json:"rateLimits"`
+	// Limit of the rate limit violations after which the clients are
+	// disconnected, the engine's default when empty.
+	RateLimitViolations *RateLimitConfig `json:"rateLimitViolations"`
+	// Limits of the frontend connections.
+	ConnectionLimits *ConnectionLimitsConfig `json:"connectionLimits"`
+	// Limits of the received messages.
+	MessageLimits *MessageLimitsConfig `json:"messageLimits"`
+	// Outbound queue of the websocket clients.
+	OutboundQueue *OutboundQueueConfig `json:"outboundQueue"`
+	// Channels created on the first subscribe.
+	AutoChannels *AutoChannelsConfig `json:"autoChannels"`
+	// Time after which the empty ephemeral channels are closed, the
+	// engine's default when empty.
+	EphemeralTimeout string `json:"ephemeralTimeout"`
+	// Whether the presence channels aggregate subscribers by the user ID.
+	PresenceByUid bool `json:"presenceByUid"`
+	// Whether the channels' metadata is sent to the subscribers.
+	PublicChannelMetadata bool `json:"publicChannelMetadata"`
+	// Who can broadcast to the channels from the frontend (channel name
+	// or wildcard pattern => policy).
+	BroadcastPolicies map[string]*BroadcastPolicyConfig `json:"broadcastPolicies"`
+}
+
+// ConnectionLimitsConfig represents limits of the frontend connections,
+// zero means no limit.
+type ConnectionLimitsConfig struct {
+	// Maximum number of all connections.
+	Total int `json:"total"`
+	// Maximum number of connections from the same remote IP.
+	PerIp int `json:"perIp"`
+	// Maximum number of connections of the same user.
+	PerUid int `json:"perUid"`
+}
+
+// RateLimitsConfig represents rate limits of a single frontend event.
+type RateLimitsConfig struct {
+	// Limit applied to each connection.
+	Connection *RateLimitConfig `json:"connection"`
+	// Limit applied to all connections of the same user.
+	Uid *RateLimitConfig `json:"uid"`
+	// Limit applied to all connections within the vhost.
+	Vhost *RateLimitConfig `json:"vhost"`
+}
+
+// RateLimitConfig represents a single token bucket limit.
+type RateLimitConfig struct {
+	// Number of events allowed per second.
+	Rate float64 `json:"rate"`
+	// Maximum number of events allowed at once.
+	Burst int `json:"burst"`
+}
+
+// limit converts the configuration into the engine's rate limit.
+//
+// Returns the rate limit, nil if not configured.
+func (rc *RateLimitConfig) limit() *webrocket.RateLimit {
+	if rc == nil {
+		return nil
+	}
+	return &webrocket.RateLimit{Rate: rc.Rate, Burst: rc.Burst}
+}
+
+// MessageLimitsConfig represents limits of the messages received from
+// the websocket clients and backends, zero means no limit.
+type MessageLimitsConfig struct {
+	// Maximum size of the message in bytes.
+	MaxSize int `json:"maxSize"`
+	// Maximum nesting depth of the message.
+	MaxDepth int `json:"maxDepth"`
+	// Maximum number of keys in the message.
+	MaxKeys int `json:"maxKeys"`
+}
+
+// limits converts the configuration into the engine's message limits.
+//
+// Returns the message limits, nil if not configured.
+func (mc *MessageLimitsConfig) limits() *webrocket.MessageLimits {
+	if mc == nil {
+		return nil
+	}
+	return &webrocket.MessageLimits{
+		MaxSize:  mc.MaxSize,
+		MaxDepth: mc.MaxDepth,
+		MaxKeys:  mc.MaxKeys,
+	}
+}
+
+// OutboundQueueConfig represents the outbound queue of the websocket
+// clients.
+type OutboundQueueConfig struct {
+	// Maximum number of messages queued for a single client, the
+	// engine's default when zero.
+	Size int `json:"size"`
+	// What to do when the queue is full, 'disconnect' (default),
+	// 'drop' or 'coalesce'.
+	Policy string `json:"policy"`
+}
+
+// queue converts the configuration into the engine's outbound queue
+// settings.
+//
+// Returns the outbound queue settings, nil if not configured, or an error
+// if the configuration is invalid.
+func (qc *OutboundQueueConfig) queue() (*webrocket.OutboundQueue, error) {
+	if qc == nil {
+		return nil, nil
+	}
+	if qc.Size < 0 {
+		return nil, errors.New("invalid outboundQueue: negative size")
+	}
+	q := &webrocket.OutboundQueue{Size: qc.Size}
+	if qc.Policy != "" {
+		policy, err := webrocket.ParseSlowConsumerPolicy(qc.Policy)
+		if err != nil {
+			return nil, fmt.Errorf("invalid outboundQueue: %v", err)
+		}
+		q.Policy = policy
+	}
+	return q, nil
+}
+
+// AutoChannelsConfig represents the policy of the channels created when
+// the clients subscribe them for the first time.
+type AutoChannelsConfig struct {
+	// Names or wildcard patterns of the channels, eg. 'chat.*'.
+	Patterns []string `json:"patterns"`
+	// Time after which the empty channel is closed, the engine's default
+	// when empty.
+	EmptyTimeout string `json:"emptyTimeout"`
+}
+
+// policy converts the configuration into the engine's auto-created
+// channels policy.
+//
+// Returns the policy, nil if not configured, or an error if the
+// configuration is invalid.
+func (ac *AutoChannelsConfig) policy() (*webrocket.AutoChannels, error) {
+	if ac == nil {
+		return nil, nil
+	}
+	timeout, err := parseOptionalDuration("autoChannels", ac.EmptyTimeout)
+	if err != nil {
+		return nil, err
+	}
+	return &webrocket.AutoChannels{Patterns: ac.Patterns, EmptyTimeout: timeout}, nil
+}
+
+// BroadcastPolicyConfig represents the policy specifying who can broadcast
+// to the channel from the frontend.
+type BroadcastPolicyConfig struct {
+	// Who can broadcast, 'everyone' (default), 'authenticated', 'uids'
+	// or 'nobody'.
+	Allow string `json:"allow"`
+	// Regexp matching the user IDs allowed to broadcast, used with 'uids'.
+	Uids string `json:"uids"`
+	// Prefixes of the allowed event names, any event when empty.
+	EventPrefixes []string `json:"eventPrefixes"`
+}
+
+// policy converts the configuration into the engine's broadcast policy.
+//
+// Returns the policy or an error if the configuration is invalid.
+func (bc *BroadcastPolicyConfig) policy() (*webrocket.BroadcastPolicy, error) {
+	p := &webrocket.BroadcastPolicy{Uids: bc.Uids, EventPrefixes: bc.EventPrefixes}
+	if bc.Allow != "" {
+		allow, err := webrocket.ParseBroadcastPermission(bc.Allow)
+		if err != nil {
+			return nil, err
+		}
+		p.Allow = allow
+	}
+	return p, nil
+}
+
+// limits converts the configuration into the engine's connection limits.
+//
+// Returns the connection limits, nil if not configured.
+func (cc *ConnectionLimitsConfig) limits() *webrocket.ConnectionLimits {
+	if cc == nil {
+		return nil
+	}
+	return &webrocket.ConnectionLimits{
+		Total:  cc.Total,
+		PerIp:  cc.PerIp,
+		PerUid: cc.PerUid,
+	}
+}
+
+// vhostSettings represents the validated settings of a single vhost,
+// ready to be applied.
+type vhostSettings struct {
+	// Sessions resumption grace period.
+	grace time.Duration
+	// Interval of the keepalive pings.
+	keepalive time.Duration
+	// Time after which idle clients are disconnected.
+	idle time.Duration
+	// Time after which the empty ephemeral channels are closed.
+	ephemeral time.Duration
+	// Rate limits of the frontend events.
+	rateLimits map[string]*webrocket.EventRateLimits
+	// Limit of the rate limit violations.
+	violations *webrocket.RateLimit
+	// Limits of the frontend connections.
+	connectionLimits *webrocket.ConnectionLimits
+	// Limits of the received messages.
+	messageLimits *webrocket.MessageLimits
+	// Outbound queue of the websocket clients.
+	queue *webrocket.OutboundQueue
+	// Channels created on the first subscribe.
+	auto *webrocket.AutoChannels
+	// Broadcast policies of the channels.
+	broadcasts map[string]*webrocket.BroadcastPolicy
+	// Whether the presence channels aggregate subscribers by the user ID.
+	presenceByUid bool
+	// Whether the channels' metadata is sent to the subscribers.
+	publicChannelMetadata bool
+}
+
+// settings validates the declared settings and converts them into
+// the engine's ones. Nothing is applied yet.
+//
+// Returns the vhost settings or an error if any of them is invalid.
+func (vc *VhostConfig) settings() (s *vhostSettings, err error) {
+	s = &vhostSettings{
+		presenceByUid:         vc.PresenceByUid,
+		publicChannelMetadata: vc.PublicChannelMetadata,
+	}
+	if s.grace, err = parseOptionalDuration("resumeGracePeriod", vc.ResumeGracePeriod); err != nil {
+		return nil, err
+	}
+	if s.keepalive, err = parseOptionalDuration("keepaliveInterval", vc.KeepaliveInterval); err != nil {
+		return nil, err
+	}
+	if s.idle, err = parseOptionalDuration("idleTimeout", vc.IdleTimeout); err != nil {
+		return nil, err
+	}
+	if s.ephemeral, err = parseOptionalDuration("ephemeralTimeout", vc.EphemeralTimeout); err != nil {
+		return nil, err
+	}
+	if rv := vc.RateLimitViolations; rv != nil && (rv.Rate < 0 || rv.Burst < 0) {
+		return nil, errors.New("invalid rateLimitViolations: negative limit")
+	}
+	if cl := vc.ConnectionLimits; cl != nil && (cl.Total < 0 || cl.PerIp < 0 || cl.PerUid < 0) {
+		return nil, errors.New("invalid connectionLimits: negative limit")
+	}
+	if ml := vc.MessageLimits; ml != nil && (ml.MaxSize < 0 || ml.MaxDepth < 0 || ml.MaxKeys < 0) {
+		return nil, errors.New("invalid messageLimits: negative limit")
+	}
+	s.violations = vc.RateLimitViolations.limit()
+	s.connectionLimits = vc.ConnectionLimits.limits()
+	s.messageLimits = vc.MessageLimits.limits()
+	if s.queue, err = vc.OutboundQueue.queue(); err != nil {
+		return nil, err
+	}
+	if s.auto, err = vc.AutoChannels.policy(); err != nil {
+		return nil, err
+	}
+	if s.auto != nil {
+		if err = s.auto.Validate(); err != nil {
+			return nil, fmt.Errorf("invalid autoChannels: %v", err)
+		}
+	}
+	s.rateLimits = make(map[string]*webrocket.EventRateLimits)
+	for event, rc := range vc.RateLimits {
+		if rc == nil {
+			continue
+		}
+		s.rateLimits[event] = &webrocket.EventRateLimits{
+			Connection: rc.Connection.limit(),
+			Uid:        rc.Uid.limit(),
+			Vhost:      rc.Vhost.limit(),
+		}
+	}
+	s.broadcasts = make(map[string]*webrocket.BroadcastPolicy)
+	for channel, bc := range vc.BroadcastPolicies {
+		if bc == nil {
+			continue
+		}
+		var p *webrocket.BroadcastPolicy
+		if p, err = bc.policy(); err == nil {
+			err = p.Validate(channel)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid broadcastPolicies: '%s': %v", channel, err)
+		}
+		s.broadcasts[channel] = p
+	}
+	return s, nil
+}
+
+// apply configures given vhost with the validated settings.
+//
+// vhost - The vhost to be configured.
+//
+// Returns an error if something went wrong.
+func (s *vhostSettings) apply(vhost *webrocket.Vhost) (err error) {
+	// Both have been validated already, so they're not expected to fail.
+	if err = vhost.SetAutoChannels(s.auto); err != nil {
+		return fmt.Errorf("invalid autoChannels: %v", err)
+	}
+	if err = vhost.SetBroadcastPolicies(s.broadcasts); err != nil {
+		return fmt.Errorf("invalid broadcastPolicies: %v", err)
+	}
+	vhost.SetResumeGracePeriod(s.grace)
+	vhost.SetKeepaliveInterval(s.keepalive)
+	vhost.SetIdleTimeout(s.idle)
+	vhost.SetEphemeralTimeout(s.ephemeral)
+	vhost.SetPresenceByUid(s.presenceByUid)
+	vhost.SetPublicChannelMetadata(s.publicChannelMetadata)
+	vhost.SetRateLimits(s.rateLimits)
+	vhost.SetRateLimitViolations(s.violations)
+	vhost.SetConnectionLimits(s.connectionLimits)
+	vhost.SetMessageLimits(s.messageLimits)
+	vhost.SetOutboundQueue(s.queue)
+	return
+}
+
+// parseOptionalDuration parses given duration setting, empty value
+// means zero.
+//
+// name  - The name of the setting.
+// value - The value to be parsed.
+//
+// Returns parsed duration or an error if the value is invalid.
+func parseOptionalDuration(name, value string) (time.Duration, error) {
+	if value == "" {
+		return 0, nil
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		return 0, fmt.Errorf("invalid %s: %v", name, err)
+	}
+	return d, nil
+}
+
+// ReadConfig reads and decodes the configuration from the specified file.
+//
+// path - A path to the configuration file.
+//
+// Returns decoded configuration or an error if something went wrong.
+func ReadConfig(path string) (cfg *Config, err error) {
+	var f *os.File
+	if f, err = os.Open(path); err != nil {
+		return
+	}
+	defer f.Close()
+	cfg = &Config{}
+	if err = json.NewDecoder(f).Decode(cfg); err != nil {
+		err = fmt.Errorf("invalid config file: %v", err)
+		return nil, err
+	}
+	for _, vc := range cfg.Vhosts {
+		if vc == nil || vc.Path == "" {
+			return nil, errors.New("invalid config file: vhost path missing")
+		}
+	}
+	return
+}
+
+// Apply assigns the configured settings to the global configuration
+// variables. Settings explicitly set with command line flags are not
+// overwritten.
+//
+// Returns an error if something went wrong.
+func (cfg *Config) Apply() error {
+	return cfg.apply(false)
+}
+
+// ApplyReloadable assigns only the settings which can be changed while
+// the server is running: the certificates, log file, log level and drain
+// timeouts. The endpoint addresses, node name and storage directory are
+// left untouched until restart. Settings explicitly set with command line
+// flags are not overwritten.
+//
+// Returns an error if something went wrong.
+func (cfg *Config) ApplyReloadable() error {
+	return cfg.apply(true)
+}
+
+// apply assigns the configured settings to the global configuration
+// variables. Nothing is assigned when any of the settings is invalid.
+//
+// reloadable - Whether to assign only the settings reloadable at runtime.
+//
+// Returns an error if something went wrong.
+func (cfg *Config) apply(reloadable bool) (err error) {
+	explicit := make(map[string]bool)
+	flag.Visit(func(f *flag.Flag) {
+		explicit[f.Name] = true
+	})
+	drainTimeout, reconnectDelay := DrainTimeout, ReconnectDelay
+	parseDuration := func(name string, dst *time.Duration, value string) error {
+		if value != "" && !explicit[name] {
+			d, err := time.ParseDuration(value)
+			if err != nil {
+				return fmt.Errorf("invalid %s: %v", name, err)
+			}
+			*dst = d
+		}
+		return nil
+	}
+	if err = parseDuration("drain-timeout", &drainTimeout, cfg.DrainTimeout); err != nil {
+		return
+	}
+	if err = parseDuration("reconnect-delay", &reconnectDelay, cfg.ReconnectDelay); err != nil {
+		return
+	}
+	set := func(name string, dst *string, value string) {
+		if value != "" && !explicit[name] {
+			*dst = value
+		}
+	}
+	if !reloadable {
+		set("websocket-addr", &WebsocketAddr, cfg.WebsocketAddr)
+		set("backend-addr", &BackendAddr, cfg.BackendAddr)
+		set("admin-addr", &AdminAddr, cfg.AdminAddr)
+		set("node-name", &NodeName, cfg.NodeName)
+		set("storage-dir", &StorageDir, cfg.StorageDir)
+	}
+	set("cert", &CertFile, cfg.CertFile)
+	set("key", &KeyFile, cfg.KeyFile)
+	set("log-file", &LogFile, cfg.LogFile)
+	set("log-level", &LogLevel, cfg.LogLevel)
+	DrainTimeout, ReconnectDelay = drainTimeout, reconnectDelay
+	return nil
+}
+
+// Reconcile applies trusted proxies, declared vhosts, their settings and
+// channels to the given context. The settings of all the vhosts are
+// validated first, so an invalid configuration leaves the context
+// untouched. Missing vhosts and channels are created, existing ones are
+// left untouched so the connected clients are not affected. When the
+// prune option is enabled, then all vhosts and channels which are not
+// declared are removed.
+//
+// ctx - The context to be reconciled.
+//
+// Returns an error if something went wrong.
+func (cfg *Config) Reconcile(ctx *webrocket.Context) (err error) {
+	settings := make([]*vhostSettings, len(cfg.Vhosts))
+	for i, vc := range cfg.Vhosts {
+		if settings[i], err = vc.settings(); err != nil {
+			return fmt.Errorf("vhost '%s': %v", vc.Path, err)
+		}
+	}
+	// Setting the proxies fails before changing anything when they're
+	// invalid, so it goes first.
+	if err = ctx.SetTrustedProxies(cfg.TrustedProxies); err != nil {
+		return
+	}
+	var vhost *webrocket.Vhost
+	declared := make(map[string]*VhostConfig)
+	for i, vc := range cfg.Vhosts {
+		declared[vc.Path] = vc
+		if vhost, err = ctx.Vhost(vc.Path); err != nil {
+			if vhost, err = ctx.AddVhost(vc.Path); err != nil {
+				return fmt.Errorf("vhost '%s': %v", vc.Path, err)
+			}
+		}
+		if err = settings[i].apply(vhost); err != nil {
+			return fmt.Errorf("vhost '%s': %v", vc.Path, err)
+		}
+		if err = reconcileChannels(vhost, vc.Channels, cfg.Prune); err != nil {
+			return fmt.Errorf("vhost '%s': %v", vc.Path, err)
+		}
+	}
+	if !cfg.Prune {
+		return nil
+	}
+	var obsolete []string
+	for path := range ctx.Vhosts() {
+		if _, ok := declared[path]; !ok {
+			obsolete = append(obsolete, path)
+		}
+	}
+	for _, path := range obsolete {
+		if err = ctx.DeleteVhost(path); err != nil {
+			return fmt.Errorf("vhost '%s': %v", path, err)
+		}
+	}
+	return nil
+}
+
+// reconcileChannels opens all the declared channels missing in the given
+// vhost, and closes the not declared ones if prune is enabled. Ephemeral
+// channels are never pruned.
+//
+// vhost    - The vhost to be reconciled.
+// channels - List of declared channel names.
+// prune    - Whether to close not declared channels or not.
+//
+// Returns an error if something went wrong.
+func reconcileChannels(vhost *webrocket.Vhost, channels []string, prune bool) (err error) {
+	declared := make(map[string]bool)
+	for _, name := range channels {
+		declared[name] = true
+		if _, err = vhost.Channel(name); err == nil {
+			continue
+		}
+		kind := webrocket.ChannelTypeFromName(name)
+		if _, err = vhost.OpenChannel(name, kind); err != nil {
+			return fmt.Errorf("channel '%s': %v", name, err)
+		}
+	}
+	if !prune {
+		return nil
+	}
+	var obsolete []string
+	for name, ch := range vhost.Channels() {
+		if !declared[name] && !ch.IsEphemeral() {
+			obsolete = append(obsolete, name)
+		}
+	}
+	for _, name := range obsolete {
+		if err = vhost.DeleteChannel(name); err != nil {
+			return fmt.Errorf("channel '%s': %v", name, err)
+		}
+	}
+	return nil
+}
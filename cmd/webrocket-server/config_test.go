@@ -0,0 +1,491 @@
+// Copyright (C) 2011 by Krzysztof Kowalik <chris@nu7hat.ch>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+package main
+
+import (
+	"flag"
+	webrocket "github.com/webrocket/webrocket/engine"
+	"io/ioutil"
+	"log"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func writeTestConfig(t *testing.T, data string) string {
+	f, err := ioutil.TempFile("", "webrocket-config")
+	if err != nil {
+		t.Fatalf("Expected to create config file, error encountered: %v", err)
+	}
+	defer f.Close()
+	if _, err = f.WriteString(data); err != nil {
+		t.Fatalf("Expected to write config file, error encountered: %v", err)
+	}
+	return f.Name()
+}
+
+func newTestConfigContext() *webrocket.Context {
+	ctx := webrocket.NewContext()
+	ctx.SetLog(log.New(ioutil.Discard, "", 0))
+	return ctx
+}
+
+func TestReadConfig(t *testing.T) {
+	var tests = []struct {
+		data   string
+		err    string
+		vhosts []string
+	}{
+		{`{}`, "", nil},
+		{`{"vhosts": [{"path": "/foo"}, {"path": "/bar"}]}`, "", []string{"/foo", "/bar"}},
+		{`{"websocketAddr": ":9090", "drainTimeout": "1m"}`, "", nil},
+		{`{"vhosts": [{"channels": ["foo"]}]}`, "invalid config file: vhost path missing", nil},
+		{`{"vhosts": [null]}`, "invalid config file: vhost path missing", nil},
+		{`{"vhosts": {}}`, "invalid config file:", nil},
+		{`{"websocketAddr": `, "invalid config file:", nil},
+		{`not a json`, "invalid config file:", nil},
+	}
+	for _, tt := range tests {
+		path := writeTestConfig(t, tt.data)
+		cfg, err := ReadConfig(path)
+		os.Remove(path)
+		if tt.err != "" {
+			if err == nil || !strings.HasPrefix(err.Error(), tt.err) {
+				t.Errorf("Expected '%s' error for %s, got %v", tt.err, tt.data, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Expected to read %s, error encountered: %v", tt.data, err)
+			continue
+		}
+		if len(cfg.Vhosts) != len(tt.vhosts) {
+			t.Errorf("Expected %d vhosts in %s, got %d", len(tt.vhosts), tt.data, len(cfg.Vhosts))
+			continue
+		}
+		for i, path := range tt.vhosts {
+			if cfg.Vhosts[i].Path != path {
+				t.Errorf("Expected vhost '%s' in %s, got '%s'", path, tt.data, cfg.Vhosts[i].Path)
+			}
+		}
+	}
+}
+
+func TestReadConfigNotExistingFile(t *testing.T) {
+	if _, err := ReadConfig("/not/existing/webrocket.json"); err == nil {
+		t.Errorf("Expected an error when reading not existing config file")
+	}
+}
+
+func TestConfigApply(t *testing.T) {
+	defer func(addr, name string, drain, delay time.Duration) {
+		WebsocketAddr, NodeName, DrainTimeout, ReconnectDelay = addr, name, drain, delay
+	}(WebsocketAddr, NodeName, DrainTimeout, ReconnectDelay)
+	var tests = []struct {
+		cfg   *Config
+		err   string
+		addr  string
+		drain time.Duration
+		delay time.Duration
+	}{
+		{&Config{}, "", ":8080", 30 * time.Second, 5 * time.Second},
+		{&Config{WebsocketAddr: ":9090"}, "", ":9090", 30 * time.Second, 5 * time.Second},
+		{&Config{DrainTimeout: "1m", ReconnectDelay: "2s"}, "", ":8080", time.Minute, 2 * time.Second},
+		{&Config{DrainTimeout: "forever"}, "invalid drain-timeout:", ":8080", 30 * time.Second, 5 * time.Second},
+		{&Config{ReconnectDelay: "1"}, "invalid reconnect-delay:", ":8080", 30 * time.Second, 5 * time.Second},
+	}
+	for i, tt := range tests {
+		WebsocketAddr, DrainTimeout, ReconnectDelay = ":8080", 30*time.Second, 5*time.Second
+		err := tt.cfg.Apply()
+		if tt.err != "" {
+			if err == nil || !strings.HasPrefix(err.Error(), tt.err) {
+				t.Errorf("Expected '%s' error in case %d, got %v", tt.err, i, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Expected to apply config in case %d, error encountered: %v", i, err)
+		}
+		if WebsocketAddr != tt.addr {
+			t.Errorf("Expected websocket address to be '%s' in case %d, got '%s'", tt.addr, i, WebsocketAddr)
+		}
+		if DrainTimeout != tt.drain {
+			t.Errorf("Expected drain timeout to be %v in case %d, got %v", tt.drain, i, DrainTimeout)
+		}
+		if ReconnectDelay != tt.delay {
+			t.Errorf("Expected reconnect delay to be %v in case %d, got %v", tt.delay, i, ReconnectDelay)
+		}
+	}
+}
+
+func TestConfigApplyReloadable(t *testing.T) {
+	defer func(addr, dir, level string, drain time.Duration) {
+		WebsocketAddr, StorageDir, LogLevel, DrainTimeout = addr, dir, level, drain
+	}(WebsocketAddr, StorageDir, LogLevel, DrainTimeout)
+	WebsocketAddr, StorageDir, LogLevel, DrainTimeout = ":8080", "/var/lib/webrocket", "info", 30*time.Second
+	cfg := &Config{WebsocketAddr: ":9090", StorageDir: "/tmp", LogLevel: "debug", DrainTimeout: "1m"}
+	if err := cfg.ApplyReloadable(); err != nil {
+		t.Fatalf("Expected to apply config, error encountered: %v", err)
+	}
+	if WebsocketAddr != ":8080" || StorageDir != "/var/lib/webrocket" {
+		t.Errorf("Expected not to change the settings which can't be reloaded")
+	}
+	if LogLevel != "debug" || DrainTimeout != time.Minute {
+		t.Errorf("Expected to change the reloadable settings")
+	}
+	cfg = &Config{LogLevel: "error", ReconnectDelay: "1"}
+	if err := cfg.ApplyReloadable(); err == nil {
+		t.Errorf("Expected an error while applying invalid config")
+	}
+	if LogLevel != "debug" {
+		t.Errorf("Expected not to change anything when the config is invalid")
+	}
+}
+
+func TestConfigApplyExplicitFlags(t *testing.T) {
+	defer func(name string) { NodeName = name }(NodeName)
+	if err := flag.Set("node-name", "explicit"); err != nil {
+		t.Fatalf("Expected to set the flag, error encountered: %v", err)
+	}
+	cfg := &Config{NodeName: "configured"}
+	if err := cfg.Apply(); err != nil {
+		t.Errorf("Expected to apply config, error encountered: %v", err)
+	}
+	if NodeName != "explicit" {
+		t.Errorf("Expected explicit flag to take precedence, got '%s'", NodeName)
+	}
+}
+
+func TestConfigReconcile(t *testing.T) {
+	var tests = []struct {
+		cfg      *Config
+		err      string
+		vhosts   []string
+		channels map[string][]string
+	}{
+		{
+			&Config{Vhosts: []*VhostConfig{
+				{Path: "/foo", Channels: []string{"chat", "presence-room"}},
+				{Path: "/bar"},
+			}},
+			"",
+			[]string{"/foo", "/bar", "/existing"},
+			map[string][]string{"/foo": {"chat", "presence-room"}, "/existing": {"old"}},
+		},
+		{
+			&Config{Prune: true, Vhosts: []*VhostConfig{
+				{Path: "/foo", Channels: []string{"chat"}},
+			}},
+			"",
+			[]string{"/foo"},
+			map[string][]string{"/foo": {"chat"}},
+		},
+		{
+			&Config{Prune: true, Vhosts: []*VhostConfig{
+				{Path: "/existing", Channels: []string{"new"}},
+			}},
+			"",
+			[]string{"/existing"},
+			map[string][]string{"/existing": {"new"}},
+		},
+		{
+			&Config{TrustedProxies: []string{"10.0.0.0/8", "localhost"}},
+			"invalid trusted proxy: localhost",
+			nil,
+			nil,
+		},
+		{
+			&Config{Vhosts: []*VhostConfig{{Path: "invalid"}}},
+			"vhost 'invalid': invalid path",
+			nil,
+			nil,
+		},
+		{
+			&Config{Vhosts: []*VhostConfig{{Path: "/foo", IdleTimeout: "soon"}}},
+			"vhost '/foo': invalid idleTimeout:",
+			nil,
+			nil,
+		},
+		{
+			&Config{Vhosts: []*VhostConfig{{Path: "/foo", EphemeralTimeout: "soon"}}},
+			"vhost '/foo': invalid ephemeralTimeout:",
+			nil,
+			nil,
+		},
+		{
+			&Config{Vhosts: []*VhostConfig{{Path: "/foo", ConnectionLimits: &ConnectionLimitsConfig{PerIp: -1}}}},
+			"vhost '/foo': invalid connectionLimits: negative limit",
+			nil,
+			nil,
+		},
+		{
+			&Config{Vhosts: []*VhostConfig{{Path: "/foo", RateLimitViolations: &RateLimitConfig{Burst: -1}}}},
+			"vhost '/foo': invalid rateLimitViolations: negative limit",
+			nil,
+			nil,
+		},
+		{
+			&Config{Vhosts: []*VhostConfig{{Path: "/foo", MessageLimits: &MessageLimitsConfig{MaxKeys: -1}}}},
+			"vhost '/foo': invalid messageLimits: negative limit",
+			nil,
+			nil,
+		},
+		{
+			&Config{Vhosts: []*VhostConfig{{Path: "/foo", OutboundQueue: &OutboundQueueConfig{Size: -1}}}},
+			"vhost '/foo': invalid outboundQueue: negative size",
+			nil,
+			nil,
+		},
+		{
+			&Config{Vhosts: []*VhostConfig{{Path: "/foo", OutboundQueue: &OutboundQueueConfig{Policy: "block"}}}},
+			"vhost '/foo': invalid outboundQueue: invalid slow consumer policy",
+			nil,
+			nil,
+		},
+		{
+			&Config{Vhosts: []*VhostConfig{{Path: "/foo", AutoChannels: &AutoChannelsConfig{Patterns: []string{"chat/*"}}}}},
+			"vhost '/foo': invalid autoChannels: invalid channel pattern",
+			nil,
+			nil,
+		},
+		{
+			&Config{Vhosts: []*VhostConfig{{Path: "/foo", AutoChannels: &AutoChannelsConfig{EmptyTimeout: "soon"}}}},
+			"vhost '/foo': invalid autoChannels:",
+			nil,
+			nil,
+		},
+		{
+			&Config{Vhosts: []*VhostConfig{{Path: "/foo", BroadcastPolicies: map[string]*BroadcastPolicyConfig{
+				"chat": {Allow: "somebody"},
+			}}}},
+			"vhost '/foo': invalid broadcastPolicies: 'chat': invalid broadcast permission",
+			nil,
+			nil,
+		},
+		{
+			&Config{Vhosts: []*VhostConfig{{Path: "/foo", BroadcastPolicies: map[string]*BroadcastPolicyConfig{
+				"chat/*": {Allow: "nobody"},
+			}}}},
+			"vhost '/foo': invalid broadcastPolicies: 'chat/*': invalid channel pattern",
+			nil,
+			nil,
+		},
+		{
+			&Config{Vhosts: []*VhostConfig{{Path: "/foo", Channels: []string{"invalid name"}}}},
+			"vhost '/foo': channel 'invalid name':",
+			nil,
+			nil,
+		},
+	}
+	for i, tt := range tests {
+		ctx := newTestConfigContext()
+		v, _ := ctx.AddVhost("/existing")
+		v.OpenChannel("old", webrocket.ChannelNormal)
+		err := tt.cfg.Reconcile(ctx)
+		if tt.err != "" {
+			if err == nil || !strings.HasPrefix(err.Error(), tt.err) {
+				t.Errorf("Expected '%s' error in case %d, got %v", tt.err, i, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Expected to reconcile in case %d, error encountered: %v", i, err)
+			continue
+		}
+		if len(ctx.Vhosts()) != len(tt.vhosts) {
+			t.Errorf("Expected %d vhosts in case %d, got %d", len(tt.vhosts), i, len(ctx.Vhosts()))
+		}
+		for _, path := range tt.vhosts {
+			vhost, err := ctx.Vhost(path)
+			if err != nil {
+				t.Errorf("Expected vhost '%s' to exist in case %d", path, i)
+				continue
+			}
+			channels := tt.channels[path]
+			if len(vhost.Channels()) != len(channels) {
+				t.Errorf("Expected %d channels in '%s' in case %d, got %d", len(channels), path, i, len(vhost.Channels()))
+			}
+			for _, name := range channels {
+				if _, err := vhost.Channel(name); err != nil {
+					t.Errorf("Expected channel '%s' to exist in '%s' in case %d", name, path, i)
+				}
+			}
+		}
+	}
+}
+
+func TestConfigReconcileKeepsEphemeralChannels(t *testing.T) {
+	ctx := newTestConfigContext()
+	v, _ := ctx.AddVhost("/foo")
+	v.OpenChannel("old", webrocket.ChannelNormal)
+	v.OpenEphemeralChannel("conversation", webrocket.ChannelNormal)
+	cfg := &Config{Prune: true, Vhosts: []*VhostConfig{{Path: "/foo"}}}
+	if err := cfg.Reconcile(ctx); err != nil {
+		t.Fatalf("Expected to reconcile, error encountered: %v", err)
+	}
+	if _, err := v.Channel("old"); err == nil {
+		t.Errorf("Expected to prune not declared channel")
+	}
+	if _, err := v.Channel("conversation"); err != nil {
+		t.Errorf("Expected to keep the ephemeral channel")
+	}
+}
+
+func TestConfigReconcileInvalidConfigLeavesContextUntouched(t *testing.T) {
+	ctx := newTestConfigContext()
+	v, _ := ctx.AddVhost("/foo")
+	cfg := &Config{
+		TrustedProxies: []string{"127.0.0.1"},
+		Vhosts: []*VhostConfig{
+			{Path: "/foo", IdleTimeout: "1m", Channels: []string{"chat"}},
+			{
+				Path:         "/bar",
+				AutoChannels: &AutoChannelsConfig{Patterns: []string{"chat.*"}},
+				BroadcastPolicies: map[string]*BroadcastPolicyConfig{
+					"chat.*": {Allow: "uids", Uids: "(admin"},
+				},
+			},
+		},
+	}
+	if err := cfg.Reconcile(ctx); err == nil {
+		t.Fatalf("Expected an error while reconciling invalid config")
+	}
+	if len(ctx.TrustedProxies()) != 0 {
+		t.Errorf("Expected not to change trusted proxies")
+	}
+	if v.IdleTimeout() != 0 || len(v.Channels()) != 0 {
+		t.Errorf("Expected not to change the valid vhost")
+	}
+	if _, err := ctx.Vhost("/bar"); err == nil {
+		t.Errorf("Expected not to create the invalid vhost")
+	}
+}
+
+func TestConfigReconcileChangesSettings(t *testing.T) {
+	ctx := newTestConfigContext()
+	cfg := &Config{Vhosts: []*VhostConfig{{
+		Path:              "/foo",
+		ResumeGracePeriod: "30s",
+		KeepaliveInterval: "25s",
+		IdleTimeout:       "10m",
+		RateLimits: map[string]*RateLimitsConfig{
+			"broadcast": {Connection: &RateLimitConfig{Rate: 5, Burst: 10}},
+		},
+		RateLimitViolations:   &RateLimitConfig{Rate: 1, Burst: 3},
+		ConnectionLimits:      &ConnectionLimitsConfig{Total: 100, PerIp: 2},
+		MessageLimits:         &MessageLimitsConfig{MaxSize: 1024},
+		OutboundQueue:         &OutboundQueueConfig{Size: 16, Policy: "drop"},
+		AutoChannels:          &AutoChannelsConfig{Patterns: []string{"chat.*"}, EmptyTimeout: "5m"},
+		EphemeralTimeout:      "10s",
+		PresenceByUid:         true,
+		PublicChannelMetadata: true,
+		BroadcastPolicies: map[string]*BroadcastPolicyConfig{
+			"chat.*": {Allow: "uids", Uids: "admin.*", EventPrefixes: []string{"client-"}},
+		},
+	}}}
+	if err := cfg.Reconcile(ctx); err != nil {
+		t.Fatalf("Expected to reconcile, error encountered: %v", err)
+	}
+	vhost, _ := ctx.Vhost("/foo")
+	vhost.OpenChannel("chat", webrocket.ChannelNormal)
+	if len(ctx.TrustedProxies()) != 0 {
+		t.Errorf("Expected no trusted proxies by default")
+	}
+	if vhost.ResumeGracePeriod() != 30*time.Second || vhost.KeepaliveInterval() != 25*time.Second || vhost.IdleTimeout() != 10*time.Minute {
+		t.Errorf("Expected to apply vhost timeouts")
+	}
+	if rl := vhost.RateLimits()["broadcast"]; rl == nil || rl.Connection == nil || rl.Connection.Rate != 5 || rl.Connection.Burst != 10 {
+		t.Errorf("Expected to apply vhost rate limits")
+	}
+	if rv := vhost.RateLimitViolations(); rv.Rate != 1 || rv.Burst != 3 {
+		t.Errorf("Expected to apply vhost violations limit, got %v", rv)
+	}
+	if cl := vhost.ConnectionLimits(); cl.Total != 100 || cl.PerIp != 2 || cl.PerUid != 0 {
+		t.Errorf("Expected to apply vhost connection limits, got %v", cl)
+	}
+	if ml := vhost.MessageLimits(); ml.MaxSize != 1024 {
+		t.Errorf("Expected to apply vhost message limits, got %v", ml)
+	}
+	if q := vhost.OutboundQueue(); q.Size != 16 || q.Policy != webrocket.SlowConsumerDrop {
+		t.Errorf("Expected to apply vhost outbound queue, got %v", q)
+	}
+	if ac := vhost.AutoChannels(); len(ac.Patterns) != 1 || ac.Patterns[0] != "chat.*" || ac.EmptyTimeout != 5*time.Minute {
+		t.Errorf("Expected to apply vhost auto-created channels, got %v", ac)
+	}
+	if vhost.EphemeralTimeout() != 10*time.Second {
+		t.Errorf("Expected to apply vhost ephemeral timeout")
+	}
+	if !vhost.PresenceByUid() {
+		t.Errorf("Expected to apply vhost presence aggregation")
+	}
+	if !vhost.PublicChannelMetadata() {
+		t.Errorf("Expected to apply vhost public channel metadata")
+	}
+	bp := vhost.BroadcastPolicies()["chat.*"]
+	if bp.Allow != webrocket.BroadcastUids || bp.Uids != "admin.*" || len(bp.EventPrefixes) != 1 {
+		t.Errorf("Expected to apply vhost broadcast policies, got %v", bp)
+	}
+	// Reloaded configuration with the settings removed.
+	cfg = &Config{
+		TrustedProxies: []string{"127.0.0.1"},
+		Vhosts:         []*VhostConfig{{Path: "/foo", IdleTimeout: "1m"}},
+	}
+	if err := cfg.Reconcile(ctx); err != nil {
+		t.Fatalf("Expected to reconcile, error encountered: %v", err)
+	}
+	if len(ctx.TrustedProxies()) != 1 {
+		t.Errorf("Expected to change trusted proxies")
+	}
+	if same, _ := ctx.Vhost("/foo"); same != vhost {
+		t.Errorf("Expected to keep the existing vhost")
+	}
+	if _, err := vhost.Channel("chat"); err != nil {
+		t.Errorf("Expected to keep the existing channel when not pruning")
+	}
+	if vhost.ResumeGracePeriod() != 0 || vhost.KeepaliveInterval() != 0 || vhost.IdleTimeout() != time.Minute {
+		t.Errorf("Expected to change vhost timeouts")
+	}
+	if len(vhost.RateLimits()) != 0 {
+		t.Errorf("Expected to clear vhost rate limits")
+	}
+	if rv := vhost.RateLimitViolations(); rv.Burst != 10 {
+		t.Errorf("Expected to restore default violations limit, got %v", rv)
+	}
+	if cl := vhost.ConnectionLimits(); cl.Total != 0 || cl.PerIp != 0 {
+		t.Errorf("Expected to clear vhost connection limits, got %v", cl)
+	}
+	if ml := vhost.MessageLimits(); ml.MaxSize != 0 {
+		t.Errorf("Expected to clear vhost message limits, got %v", ml)
+	}
+	if q := vhost.OutboundQueue(); q.Size != 256 || q.Policy != webrocket.SlowConsumerDisconnect {
+		t.Errorf("Expected to restore default outbound queue, got %v", q)
+	}
+	if ac := vhost.AutoChannels(); len(ac.Patterns) != 0 {
+		t.Errorf("Expected to disable vhost auto-created channels, got %v", ac)
+	}
+	if vhost.EphemeralTimeout() != time.Minute {
+		t.Errorf("Expected to restore default ephemeral timeout")
+	}
+	if vhost.PresenceByUid() {
+		t.Errorf("Expected to disable vhost presence aggregation")
+	}
+	if vhost.PublicChannelMetadata() {
+		t.Errorf("Expected to hide vhost channel metadata")
+	}
+	if len(vhost.BroadcastPolicies()) != 0 {
+		t.Errorf("Expected to clear vhost broadcast policies")
+	}
+}
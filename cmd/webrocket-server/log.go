@@ -0,0 +1,68 @@
+// Copyright (C) 2011 by Krzysztof Kowalik <chris@nu7hat.ch>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+package main
+
+import (
+	"os"
+	"sync"
+)
+
+// LogWriter is a log output which can be reopened while the server is
+// running, eg. after the log file has been rotated. When no file is
+// configured, then it writes to the stderr.
+type LogWriter struct {
+	// The currently open log file.
+	f *os.File
+	// Internal semaphore.
+	mtx sync.Mutex
+}
+
+// Write writes given data to the current log file.
+//
+// p - The data to be written.
+//
+// Returns number of bytes written and an error if something went wrong.
+func (w *LogWriter) Write(p []byte) (int, error) {
+	w.mtx.Lock()
+	defer w.mtx.Unlock()
+	if w.f == nil {
+		return os.Stderr.Write(p)
+	}
+	return w.f.Write(p)
+}
+
+// Reopen closes the current log file and opens the specified one for
+// appending. If path is empty, then the output is switched to the stderr.
+//
+// path - A path to the log file.
+//
+// Returns an error if something went wrong, the current file is kept
+// open in such case.
+func (w *LogWriter) Reopen(path string) (err error) {
+	var f *os.File
+	if path != "" {
+		f, err = os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+		if err != nil {
+			return
+		}
+	}
+	w.mtx.Lock()
+	defer w.mtx.Unlock()
+	if w.f != nil {
+		w.f.Close()
+	}
+	w.f = f
+	return
+}
@@ -22,6 +22,7 @@ import (
 	"fmt"
 	stepper "github.com/nu7hatch/gostepper"
 	webrocket "github.com/webrocket/webrocket/engine"
+	"log"
 	"os"
 	"os/signal"
 	"path/filepath"
@@ -45,11 +46,25 @@ var (
 	KeyFile string
 	// A path to the The storage directory.
 	StorageDir string
+	// Maximum time to wait for connections to drain on SIGTERM.
+	DrainTimeout time.Duration
+	// Reconnect delay suggested to the clients while draining.
+	ReconnectDelay time.Duration
+	// A path to the log file.
+	LogFile string
+	// The global log level.
+	LogLevel string
+	// A path to the configuration file.
+	ConfigFile string
 )
 
 var (
 	// The WebRocket main context.
 	ctx *webrocket.Context
+	// The configuration read from the config file.
+	config *Config
+	// The reopenable log output.
+	logOutput = &LogWriter{}
 	// A stepper instance.
 	s stepper.Stepper
 )
@@ -62,16 +77,68 @@ func init() {
 	flag.StringVar(&CertFile, "cert", "", "path to server certificate")
 	flag.StringVar(&KeyFile, "key", "", "private key")
 	flag.StringVar(&StorageDir, "storage-dir", "/var/lib/webrocket", "path to webrocket's internal data-store")
-	flag.Parse()
+	flag.DurationVar(&DrainTimeout, "drain-timeout", 30*time.Second, "maximum time to wait for connections to drain on SIGTERM")
+	flag.DurationVar(&ReconnectDelay, "reconnect-delay", 5*time.Second, "reconnect delay suggested to the clients while draining")
+	flag.StringVar(&LogFile, "log-file", "", "path to the log file (logs to stderr by default)")
+	flag.StringVar(&LogLevel, "log-level", "info", "log level (debug, info, warning or error)")
+	flag.StringVar(&ConfigFile, "config", "", "path to the configuration file")
+}
 
+// LoadConfig reads the configuration file if specified and applies
+// its settings. Values explicitly set with the command line flags take
+// precedence over the configured ones.
+func LoadConfig() {
+	if ConfigFile != "" {
+		var err error
+		s.Start("Reading configuration file")
+		if config, err = ReadConfig(ConfigFile); err != nil {
+			s.Fail(err.Error(), true)
+		}
+		if err = config.Apply(); err != nil {
+			s.Fail(err.Error(), true)
+		}
+		s.Ok()
+	}
 	StorageDir, _ = filepath.Abs(StorageDir)
 }
 
+// OpenLog opens the configured log file for appending.
+//
+// Returns a logger writing to the log file, or to the stderr if no
+// log file has been configured.
+func OpenLog() (*log.Logger, error) {
+	if err := logOutput.Reopen(LogFile); err != nil {
+		return nil, err
+	}
+	return log.New(logOutput, "", 0), nil
+}
+
+// SetupLogLevel parses the configured log level and assigns it to
+// the context.
+//
+// Returns an error if the log level is invalid.
+func SetupLogLevel() error {
+	level, err := webrocket.ParseLogLevel(LogLevel)
+	if err != nil {
+		return err
+	}
+	ctx.SetLogLevel(level)
+	return nil
+}
+
 // SetupContext initializes global WebRocket context, loads configuration
 // and all the vhosts data, and generates thean access cookie if its necessary.
 func SetupContext() {
 	s.Start("Initializing context")
 	ctx = webrocket.NewContext()
+	if logger, err := OpenLog(); err != nil {
+		s.Fail(err.Error(), true)
+	} else {
+		ctx.SetLog(logger)
+	}
+	if err := SetupLogLevel(); err != nil {
+		s.Fail(err.Error(), true)
+	}
 	if err := ctx.SetStorageDir(StorageDir); err != nil {
 		s.Fail(err.Error(), true)
 	}
@@ -91,6 +158,13 @@ func SetupContext() {
 		s.Fail(err.Error(), true)
 	}
 	s.Ok()
+	if config != nil {
+		s.Start("Applying vhosts configuration")
+		if err := config.Reconcile(ctx); err != nil {
+			s.Fail(err.Error(), true)
+		}
+		s.Ok()
+	}
 	s.Start("Generating cookie")
 	if err := ctx.GenerateCookie(false); err != nil {
 		s.Fail(err.Error(), true)
@@ -122,15 +196,77 @@ func SetupEndpoint(kind string, e webrocket.Endpoint) {
 	s.Ok()
 }
 
+// Reload re-reads the configuration file and applies all the reloadable
+// settings: reopens the log file, changes the log level, swaps the TLS
+// certificates for the new handshakes and reconciles declared vhosts and
+// channels. Already connected clients are not affected. Settings which
+// can't be changed at runtime, like the endpoint addresses, are ignored
+// until restart. When the configuration is invalid, then the previous
+// one is kept, but the log file is reopened anyway so the log rotation
+// keeps working. Failures are reported in the log.
+func Reload() {
+	fmt.Printf("\n\033[33mReloading...\033[0m\n")
+	var cfg *Config
+	if ConfigFile != "" {
+		var err error
+		if cfg, err = ReadConfig(ConfigFile); err == nil {
+			err = cfg.ApplyReloadable()
+		}
+		if err != nil {
+			cfg = nil
+			ctx.WriteLog(webrocket.LogError, "server", "reload failed: "+err.Error())
+		}
+	}
+	if err := logOutput.Reopen(LogFile); err != nil {
+		ctx.WriteLog(webrocket.LogError, "server", "log reopen failed: "+err.Error())
+	}
+	if cfg == nil && ConfigFile != "" {
+		return
+	}
+	if err := SetupLogLevel(); err != nil {
+		ctx.WriteLog(webrocket.LogError, "server", "reload failed: "+err.Error())
+	}
+	if CertFile != "" && KeyFile != "" {
+		if err := ctx.ReloadCertificates(CertFile, KeyFile); err != nil {
+			ctx.WriteLog(webrocket.LogError, "server", "reload failed: "+err.Error())
+		}
+	}
+	if cfg != nil {
+		if err := cfg.Reconcile(ctx); err != nil {
+			ctx.WriteLog(webrocket.LogError, "server", "reload failed: "+err.Error())
+			return
+		}
+		config = cfg
+	}
+	ctx.WriteLog(webrocket.LogInfo, "server", "configuration reloaded")
+}
+
 // SignalTrap configures a handlers for various system signals, i.a.
 // it stops the context and cleans everything up when the app is interrupted.
+// On SIGTERM the context is drained gracefully before exiting, and SIGHUP
+// reloads the configuration.
 func SignalTrap() {
-	var interrupted = make(chan os.Signal)
-	signal.Notify(interrupted, syscall.SIGQUIT, syscall.SIGINT)
-	<-interrupted
-	fmt.Printf("\n\033[33mExiting...\033[0m\n")
-	if ctx != nil {
-		ctx.Kill()
+	var interrupted = make(chan os.Signal, 1)
+	signal.Notify(interrupted, syscall.SIGQUIT, syscall.SIGINT, syscall.SIGTERM,
+		syscall.SIGHUP)
+	for sig := range interrupted {
+		if ctx == nil {
+			return
+		}
+		switch sig {
+		case syscall.SIGHUP:
+			Reload()
+			continue
+		case syscall.SIGTERM:
+			fmt.Printf("\n\033[33mDraining...\033[0m\n")
+			if err := ctx.Drain(ReconnectDelay, DrainTimeout); err != nil {
+				fmt.Printf("\033[31m%s\033[0m\n", err.Error())
+			}
+		default:
+			fmt.Printf("\n\033[33mExiting...\033[0m\n")
+			ctx.Kill()
+		}
+		return
 	}
 }
 
@@ -151,6 +287,9 @@ func DisplaySystemSettings() {
 	fmt.Printf("Node               : %s\n", ctx.NodeName())
 	fmt.Printf("Cookie             : %s\n", ctx.Cookie())
 	fmt.Printf("Data store dir     : %s\n", ctx.StorageDir())
+	if ConfigFile != "" {
+		fmt.Printf("Config file        : %s\n", ConfigFile)
+	}
 	fmt.Printf("Websocket endpoint : ws://%s\n", WebsocketAddr)
 	fmt.Printf("Backend endpoint   : wr://%s\n", BackendAddr)
 	fmt.Printf("Admin endpoint     : http://%s\n", AdminAddr)
@@ -159,7 +298,9 @@ func DisplaySystemSettings() {
 }
 
 func main() {
+	flag.Parse()
 	DisplayAsciiArt()
+	LoadConfig()
 	SetupContext()
 	SetupEndpoint("backend endpoint", ctx.NewBackendEndpoint(BackendAddr))
 	SetupEndpoint("websocket endpoint", ctx.NewWebsocketEndpoint(WebsocketAddr))
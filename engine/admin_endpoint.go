@@ -16,9 +16,7 @@
 package engine
 
 import (
-	"crypto/rand"
 	"crypto/tls"
-	"log"
 	"net"
 	"net/http"
 	"sync"
@@ -33,10 +31,10 @@ type AdminEndpoint struct {
 	ctx *Context
 	// Information whether the endpoint is alive or not. 
 	alive bool
+	// The TLS certificate used by the endpoint.
+	certs *certificateStore
 	// Internal semaphore.
 	mtx sync.Mutex
-	// Internal logger.
-	log *log.Logger
 }
 
 // Internal constructors
@@ -55,7 +53,7 @@ func newAdminEndpoint(ctx *Context, addr string) *AdminEndpoint {
 
 	return &AdminEndpoint{
 		ctx:    ctx,
-		log:    ctx.log,
+		certs:  &certificateStore{},
 		Server: server,
 	}
 }
@@ -102,25 +100,29 @@ func (a *AdminEndpoint) ListenAndServeTLS(certFile, certKey string) error {
 	if addr == "" {
 		addr = ":https"
 	}
-	config := &tls.Config{
-		Rand:       rand.Reader,
-		NextProtos: []string{"http/1.1"},
-	}
-	var err error
-	config.Certificates = make([]tls.Certificate, 1)
-	config.Certificates[0], err = tls.LoadX509KeyPair(certFile, certKey)
-	if err != nil {
+	if err := a.certs.load(certFile, certKey); err != nil {
 		return err
 	}
 	conn, err := net.Listen("tcp", addr)
 	if err != nil {
 		return err
 	}
-	tlsListener := tls.NewListener(conn, config)
+	tlsListener := tls.NewListener(conn, a.certs.config())
 	a.alive = true
 	return a.Server.Serve(tlsListener)
 }
 
+// ReloadCertificate loads new TLS certificate and its private key. The new
+// certificate is used for all new handshakes.
+//
+// certFile - Path to the TLS certificate file.
+// certKey  - Path to the certificate's private key.
+//
+// Returns an error if something went wrong or endpoint doesn't serve TLS.
+func (a *AdminEndpoint) ReloadCertificate(certFile, certKey string) error {
+	return a.certs.reload(certFile, certKey)
+}
+
 // Returns true if this endpoint is activated.
 func (a *AdminEndpoint) IsAlive() bool {
 	a.mtx.Lock()
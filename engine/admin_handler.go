@@ -41,13 +41,22 @@ var (
 
 // Admin handler's initializer
 func init() {
+	adminMux.Put("/:vhost/channels/:channel/metadata", http.HandlerFunc(adminSetChannelMetadata))
+	adminMux.Del("/:vhost/channels/:channel/metadata", http.HandlerFunc(adminDeleteChannelMetadata))
 	adminMux.Post("/:vhost/channels/:channel", http.HandlerFunc(adminAddChannel))
 	adminMux.Get("/:vhost/channels/:channel", http.HandlerFunc(adminGetChannel))
 	adminMux.Del("/:vhost/channels/:channel", http.HandlerFunc(adminDeleteChannel))
 	adminMux.Del("/:vhost/channels", http.HandlerFunc(adminClearChannels))
 	adminMux.Get("/:vhost/workers", http.HandlerFunc(adminListWorkers))
+	adminMux.Get("/:vhost/connections", http.HandlerFunc(adminGetConnections))
+	adminMux.Get("/:vhost/origins", http.HandlerFunc(adminListOrigins))
+	adminMux.Post("/:vhost/origins", http.HandlerFunc(adminAddOrigin))
+	adminMux.Del("/:vhost/origins", http.HandlerFunc(adminDeleteOrigin))
 	adminMux.Get("/:vhost/channels", http.HandlerFunc(adminListChannels))
 	adminMux.Put("/:vhost/token", http.HandlerFunc(adminRegenerateVhostToken))
+	adminMux.Put("/:vhost/log_level", http.HandlerFunc(adminSetVhostLogLevel))
+	adminMux.Del("/:vhost/log_level", http.HandlerFunc(adminResetVhostLogLevel))
+	adminMux.Put("/log_level", http.HandlerFunc(adminSetLogLevel))
 	adminMux.Post("/:vhost", http.HandlerFunc(adminAddVhost))
 	adminMux.Get("/:vhost", http.HandlerFunc(adminGetVhost))
 	adminMux.Del("/:vhost", http.HandlerFunc(adminDeleteVhost))
@@ -73,20 +82,45 @@ func newAdminHandler(ctx *Context) *adminHandler {
 // Internal
 // -----------------------------------------------------------------------------
 
-// logStatus writes specified status information to the logs.
+// adminResponseWriter wraps the HTTP response writer to track the status
+// code of the response.
+type adminResponseWriter struct {
+	http.ResponseWriter
+	// The written status code.
+	code int
+}
+
+// WriteHeader saves the status code and passes it forward.
+func (w *adminResponseWriter) WriteHeader(code int) {
+	w.code = code
+	w.ResponseWriter.WriteHeader(code)
+}
+
+// logStatus writes specified status information to the logs. Successful
+// requests are logged with info level, client errors as warnings and
+// internal errors as errors.
 //
 // r    - The request to be logged.
 // code - Status code.
 // err  - Encoundered error.
 //
 func (h *adminHandler) logStatus(r *http.Request, code int, err error) {
-	if err == nil {
-		adminCtx.log.Printf("admin: %s %s; %d %s", r.Method, r.RequestURI,
-			code, http.StatusText(code))
-	} else {
-		adminCtx.log.Printf("admin: %s %s; %d %s: %s", r.Method, r.RequestURI,
-			code, http.StatusText(code), err.Error())
+	e := &logEntry{
+		level:     LogInfo,
+		component: "admin",
+		event:     r.Method + " " + r.URL.Path,
+		status:    &Status{http.StatusText(code), code},
 	}
+	switch {
+	case code >= 500:
+		e.level = LogError
+	case code >= 400:
+		e.level = LogWarning
+	}
+	if err != nil {
+		e.msg = err.Error()
+	}
+	adminCtx.writeLog(nil, e)
 }
 
 // authenticate checks if the request contains valid cookie.
@@ -111,8 +145,9 @@ func (h *adminHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	var code int
 
 	if !h.authenticate(r) {
-		code, _ = http.StatusForbidden, errors.New("access denied")
+		code = http.StatusForbidden
 		w.WriteHeader(code)
+		h.logStatus(r, code, errors.New("access denied"))
 		return
 	}
 
@@ -120,8 +155,9 @@ func (h *adminHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
 	r.ParseForm()
 
-	h.mux.ServeHTTP(w, r)
-	// TODO: log
+	rw := &adminResponseWriter{ResponseWriter: w, code: http.StatusOK}
+	h.mux.ServeHTTP(rw, r)
+	h.logStatus(r, rw.code, nil)
 }
 
 // Admin interface actions
@@ -202,12 +238,23 @@ func adminGetVhost(w http.ResponseWriter, r *http.Request) {
 	channels := map[string]interface{}{
 		"size": len(vhost.Channels()),
 	}
+	connections := map[string]interface{}{
+		"size": vhost.ConnectionStats().Total,
+	}
+	logLevel, ok := vhost.LogLevel()
+	if !ok {
+		logLevel = adminCtx.LogLevel()
+	}
 	data := map[string]interface{}{
 		"path":        path,
 		"accessToken": vhost.accessToken,
+		"logLevel":    logLevel.String(),
 		"channels":    channels,
+		"connections": connections,
 		"links": adminHypermediaLinks(
 			[]string{"channels", path + "/channels"},
+			[]string{"connections", path + "/connections"},
+			[]string{"origins", path + "/origins"},
 			[]string{"self", path},
 		),
 	}
@@ -256,6 +303,59 @@ func adminRegenerateVhostToken(w http.ResponseWriter, r *http.Request) {
 	w.WriteHeader(http.StatusFound)
 }
 
+// adminSetLogLevel changes the global log level.
+//
+// PUT /log_level?level=:level
+//
+func adminSetLogLevel(w http.ResponseWriter, r *http.Request) {
+	level, err := ParseLogLevel(r.FormValue("level"))
+	if err != nil {
+		adminWriteError(w, http.StatusBadRequest, err)
+		return
+	}
+	adminCtx.SetLogLevel(level)
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// adminSetVhostLogLevel overrides the global log level for the specified
+// vhost. Setting the debug level enables debug mode for the vhost.
+//
+// PUT /:vhost/log_level?level=:level
+//
+func adminSetVhostLogLevel(w http.ResponseWriter, r *http.Request) {
+	var vhost *Vhost
+	var level LogLevel
+	var err error
+	path := "/" + r.URL.Query().Get(":vhost")
+	if vhost, err = adminCtx.Vhost(path); err != nil {
+		adminWriteError(w, http.StatusNotFound, err)
+		return
+	}
+	if level, err = ParseLogLevel(r.FormValue("level")); err != nil {
+		adminWriteError(w, http.StatusBadRequest, err)
+		return
+	}
+	vhost.SetLogLevel(level)
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// adminResetVhostLogLevel removes the log level override from the specified
+// vhost, so the global log level is used again.
+//
+// DELETE /:vhost/log_level
+//
+func adminResetVhostLogLevel(w http.ResponseWriter, r *http.Request) {
+	var vhost *Vhost
+	var err error
+	path := "/" + r.URL.Query().Get(":vhost")
+	if vhost, err = adminCtx.Vhost(path); err != nil {
+		adminWriteError(w, http.StatusNotFound, err)
+		return
+	}
+	vhost.ResetLogLevel()
+	w.WriteHeader(http.StatusAccepted)
+}
+
 // adminListChannels shows list of channels from the specified vhost.
 //
 // GET /:vhost/channels
@@ -271,7 +371,9 @@ func adminListChannels(w http.ResponseWriter, r *http.Request) {
 	data, i := make([]map[string]interface{}, len(vhost.Channels())), 0
 	for _, channel := range vhost.Channels() {
 		data[i] = map[string]interface{}{
-			"name": channel.name,
+			"name":        channel.name,
+			"ephemeral":   channel.IsEphemeral(),
+			"autoCreated": channel.IsAutoCreated(),
 			"links": adminHypermediaLinks(
 				[]string{"self", path + "/channels/" + channel.name},
 				[]string{"vhost", path},
@@ -283,9 +385,11 @@ func adminListChannels(w http.ResponseWriter, r *http.Request) {
 	adminWriteData(w, "channels", data)
 }
 
-// adminAddChannel creates new channel under the specified vhost.
+// adminAddChannel creates new channel under the specified vhost. Channel
+// is kept in memory only when the 'ephemeral' parameter is set to true.
 //
 // POST /:vhost/channels/:channel
+// POST /:vhost/channels/:channel?ephemeral=true
 //
 func adminAddChannel(w http.ResponseWriter, r *http.Request) {
 	var vhost *Vhost
@@ -296,8 +400,13 @@ func adminAddChannel(w http.ResponseWriter, r *http.Request) {
 		adminWriteError(w, http.StatusNotFound, err)
 		return
 	}
-	kind := channelTypeFromName(name)
-	if _, err = vhost.OpenChannel(name, kind); err != nil {
+	kind := ChannelTypeFromName(name)
+	if r.URL.Query().Get("ephemeral") == "true" {
+		_, err = vhost.OpenEphemeralChannel(name, kind)
+	} else {
+		_, err = vhost.OpenChannel(name, kind)
+	}
+	if err != nil {
 		adminWriteError(w, http.StatusBadRequest, err)
 		return
 	}
@@ -329,6 +438,9 @@ func adminGetChannel(w http.ResponseWriter, r *http.Request) {
 	}
 	data := map[string]interface{}{
 		"name":        channel.name,
+		"ephemeral":   channel.IsEphemeral(),
+		"autoCreated": channel.IsAutoCreated(),
+		"metadata":    channel.Metadata(),
 		"subscribers": subscribers,
 		"links": adminHypermediaLinks(
 			[]string{"self", path + "/channels/" + name},
@@ -340,6 +452,51 @@ func adminGetChannel(w http.ResponseWriter, r *http.Request) {
 	adminWriteData(w, "channel", data)
 }
 
+// adminSetChannelMetadata sets the channel's metadata entry.
+//
+// PUT /:vhost/channels/:channel/metadata?key=:key&value=:value
+//
+func adminSetChannelMetadata(w http.ResponseWriter, r *http.Request) {
+	var vhost *Vhost
+	var err error
+	path := "/" + r.URL.Query().Get(":vhost")
+	name := r.URL.Query().Get(":channel")
+	if vhost, err = adminCtx.Vhost(path); err != nil {
+		adminWriteError(w, http.StatusNotFound, err)
+		return
+	}
+	if _, err = vhost.Channel(name); err != nil {
+		adminWriteError(w, http.StatusNotFound, err)
+		return
+	}
+	err = vhost.SetChannelMetadata(name, r.FormValue("key"), r.FormValue("value"))
+	if err != nil {
+		adminWriteError(w, http.StatusBadRequest, err)
+		return
+	}
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// adminDeleteChannelMetadata removes the channel's metadata entry.
+//
+// DELETE /:vhost/channels/:channel/metadata?key=:key
+//
+func adminDeleteChannelMetadata(w http.ResponseWriter, r *http.Request) {
+	var vhost *Vhost
+	var err error
+	path := "/" + r.URL.Query().Get(":vhost")
+	name := r.URL.Query().Get(":channel")
+	if vhost, err = adminCtx.Vhost(path); err != nil {
+		adminWriteError(w, http.StatusNotFound, err)
+		return
+	}
+	if err = vhost.DeleteChannelMetadata(name, r.FormValue("key")); err != nil {
+		adminWriteError(w, http.StatusNotFound, err)
+		return
+	}
+	w.WriteHeader(http.StatusAccepted)
+}
+
 // adminDeleteChannels removes the channel.
 //
 // DELETE /:vhost/channels/:channel
@@ -372,7 +529,7 @@ func adminClearChannels(w http.ResponseWriter, r *http.Request) {
 		adminWriteError(w, http.StatusNotFound, err)
 		return
 	}
-	for name := range vhost.channels {
+	for name := range vhost.Channels() {
 		vhost.DeleteChannel(name)
 	}
 	w.WriteHeader(http.StatusAccepted)
@@ -406,6 +563,99 @@ func adminListWorkers(w http.ResponseWriter, r *http.Request) {
 	adminWriteData(w, "workers", data)
 }
 
+// adminGetConnections shows current numbers of the frontend connections
+// for the specified vhost, in total, per remote IP and per user, together
+// with the configured limits.
+//
+// GET /:vhost/connections
+//
+func adminGetConnections(w http.ResponseWriter, r *http.Request) {
+	var vhost *Vhost
+	var err error
+	path := "/" + r.URL.Query().Get(":vhost")
+	if vhost, err = adminCtx.Vhost(path); err != nil {
+		adminWriteError(w, http.StatusNotFound, err)
+		return
+	}
+	stats, limits := vhost.ConnectionStats(), vhost.ConnectionLimits()
+	data := map[string]interface{}{
+		"total":           stats.Total,
+		"perIp":           stats.PerIp,
+		"perUid":          stats.PerUid,
+		"slowConsumers":   stats.SlowConsumers,
+		"droppedMessages": stats.DroppedMessages,
+		"limits": map[string]interface{}{
+			"total":  limits.Total,
+			"perIp":  limits.PerIp,
+			"perUid": limits.PerUid,
+		},
+		"links": adminHypermediaLinks(
+			[]string{"self", path + "/connections"},
+			[]string{"vhost", path},
+		),
+	}
+	w.WriteHeader(http.StatusOK)
+	adminWriteData(w, "connections", data)
+}
+
+// adminListOrigins shows list of the origins from which the frontend
+// clients can connect to the specified vhost. Empty list means that all
+// origins are allowed.
+//
+// GET /:vhost/origins
+//
+func adminListOrigins(w http.ResponseWriter, r *http.Request) {
+	var vhost *Vhost
+	var err error
+	path := "/" + r.URL.Query().Get(":vhost")
+	if vhost, err = adminCtx.Vhost(path); err != nil {
+		adminWriteError(w, http.StatusNotFound, err)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	adminWriteData(w, "origins", vhost.AllowedOrigins())
+}
+
+// adminAddOrigin allows frontend clients to connect to the specified
+// vhost from given origin.
+//
+// POST /:vhost/origins?origin=:origin
+//
+func adminAddOrigin(w http.ResponseWriter, r *http.Request) {
+	var vhost *Vhost
+	var err error
+	path := "/" + r.URL.Query().Get(":vhost")
+	if vhost, err = adminCtx.Vhost(path); err != nil {
+		adminWriteError(w, http.StatusNotFound, err)
+		return
+	}
+	if err = vhost.AddAllowedOrigin(r.FormValue("origin")); err != nil {
+		adminWriteError(w, http.StatusBadRequest, err)
+		return
+	}
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// adminDeleteOrigin removes given origin from the list of allowed origins
+// of the specified vhost.
+//
+// DELETE /:vhost/origins?origin=:origin
+//
+func adminDeleteOrigin(w http.ResponseWriter, r *http.Request) {
+	var vhost *Vhost
+	var err error
+	path := "/" + r.URL.Query().Get(":vhost")
+	if vhost, err = adminCtx.Vhost(path); err != nil {
+		adminWriteError(w, http.StatusNotFound, err)
+		return
+	}
+	if err = vhost.DeleteAllowedOrigin(r.FormValue("origin")); err != nil {
+		adminWriteError(w, http.StatusNotFound, err)
+		return
+	}
+	w.WriteHeader(http.StatusAccepted)
+}
+
 // adminHypermediaLinks generates map of links from the given list.
 //
 // links - list of links to pack
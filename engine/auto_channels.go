@@ -0,0 +1,81 @@
+// Copyright (C) 2011 by Krzysztof Kowalik <chris@nu7hat.ch>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package engine
+
+import (
+	"errors"
+	"regexp"
+	"time"
+)
+
+// AutoChannels specifies the channels which are created when the client
+// subscribes them for the first time, instead of being opened by the backend
+// or admin upfront. Such channels are kept in memory only, and are closed
+// when nobody subscribes them for a while.
+type AutoChannels struct {
+	// Names of the channels, or the wildcard patterns as used in the pattern
+	// subscriptions, eg. 'chat.*'.
+	Patterns []string
+	// Time after which the empty channel is closed, zero means the default.
+	EmptyTimeout time.Duration
+}
+
+// Internal
+// -----------------------------------------------------------------------------
+
+// compile validates and compiles the patterns of the auto-created channels.
+//
+// Returns compiled patterns or an error if any of them is invalid.
+func (a AutoChannels) compile() (patterns []*channelPattern, err error) {
+	for _, pattern := range a.Patterns {
+		var p *channelPattern
+		if isChannelPattern(pattern) {
+			if p, err = newChannelPattern(pattern); err != nil {
+				return nil, err
+			}
+		} else {
+			// Single channel name, matched as is.
+			if !validChannelNamePattern.MatchString(pattern) {
+				return nil, errors.New("invalid channel name")
+			}
+			re := regexp.MustCompile("^" + regexp.QuoteMeta(pattern) + "$")
+			p = &channelPattern{pattern: pattern, re: re}
+		}
+		patterns = append(patterns, p)
+	}
+	return
+}
+
+// emptyTimeout returns the effective time after which the empty channel
+// is closed.
+func (a AutoChannels) emptyTimeout() time.Duration {
+	if a.EmptyTimeout <= 0 {
+		return defaultEmptyChannelTimeout
+	}
+	return a.EmptyTimeout
+}
+
+// Exported
+// -----------------------------------------------------------------------------
+
+// Validate checks whether the patterns of the auto-created channels are
+// valid, without applying them anywhere.
+//
+// Returns an error if any of the patterns is invalid.
+func (a AutoChannels) Validate() error {
+	_, err := a.compile()
+	return err
+}
@@ -0,0 +1,68 @@
+// Copyright (C) 2011 by Krzysztof Kowalik <chris@nu7hat.ch>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+package engine
+
+import (
+	"testing"
+	"time"
+)
+
+func TestAutoChannelsCompile(t *testing.T) {
+	auto := AutoChannels{Patterns: []string{"chat.*", "lobby", "presence-room.*"}}
+	patterns, err := auto.compile()
+	if err != nil || len(patterns) != 3 {
+		t.Errorf("Expected to compile the patterns without errors")
+		return
+	}
+	for _, tt := range []struct {
+		name    string
+		matches bool
+	}{
+		{"chat.1", true},
+		{"lobby", true},
+		{"lobby.1", false},
+		{"presence-room.1", true},
+		{"other", false},
+	} {
+		matches := false
+		for _, p := range patterns {
+			matches = matches || p.matchesName(tt.name)
+		}
+		if matches != tt.matches {
+			t.Errorf("Expected matching '%s' to be %v", tt.name, tt.matches)
+		}
+	}
+}
+
+func TestAutoChannelsCompileWithInvalidPatterns(t *testing.T) {
+	for _, pattern := range []string{"chat/*", "-lobby", ""} {
+		auto := AutoChannels{Patterns: []string{"chat.*", pattern}}
+		if _, err := auto.compile(); err == nil {
+			t.Errorf("Expected to throw an error while compiling the '%s' pattern", pattern)
+		}
+		if err := auto.Validate(); err == nil {
+			t.Errorf("Expected to throw an error while validating the '%s' pattern", pattern)
+		}
+	}
+}
+
+func TestAutoChannelsEmptyTimeout(t *testing.T) {
+	if timeout := (AutoChannels{}).emptyTimeout(); timeout != defaultEmptyChannelTimeout {
+		t.Errorf("Expected the default empty timeout, given %v", timeout)
+	}
+	if timeout := (AutoChannels{EmptyTimeout: time.Second}).emptyTimeout(); timeout != time.Second {
+		t.Errorf("Expected the configured empty timeout, given %v", timeout)
+	}
+}
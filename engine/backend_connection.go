@@ -9,11 +9,19 @@ import (
 	"time"
 )
 
+// Maximum size of the message received before the sender's identity
+// is known, the vhost's limits are applied afterwards.
+const backendMaxUnidentifiedSize = 4096
+
 // backendConnection implements a wrapper for the TCP connection providing
 // some concurrency tricks.
 type backendConnection struct {
 	// The underlaying connection.
 	conn net.Conn
+	// The parent context, used to find the sender's vhost limits.
+	ctx *Context
+	// The last identity received from the sender.
+	identity string
 	// Internal semaphore.
 	mtx sync.Mutex
 }
@@ -25,10 +33,54 @@ type backendConnection struct {
 // object.
 //
 // conn     - The connection to be wrapped.
+// ctx      - The parent context.
 //
 // Returns a new backend connection.
-func newBackendConnection(conn net.Conn) *backendConnection {
-	return &backendConnection{conn: conn}
+func newBackendConnection(conn net.Conn, ctx *Context) *backendConnection {
+	return &backendConnection{conn: conn, ctx: ctx}
+}
+
+// Internal
+// -----------------------------------------------------------------------------
+
+// messageLimits returns the message limits of the vhost to which
+// the specified identity belongs. Identity is not authenticated here,
+// it's done later by the endpoint.
+//
+// identity - The sender's identity.
+//
+// Returns the limits, nil if the vhost is not limited, or an error if
+// the identity is invalid or there's no such vhost.
+func (c *backendConnection) messageLimits(identity string) (*MessageLimits, error) {
+	if c.ctx == nil {
+		return nil, errors.New("no context")
+	}
+	idty, err := parseBackendIdentity(identity)
+	if err != nil {
+		return nil, err
+	}
+	vhost, err := c.ctx.Vhost(idty.Vhost)
+	if err != nil {
+		return nil, err
+	}
+	return vhost.receivedMessageLimits(), nil
+}
+
+// maxMessageSize returns the size limit of the message being received.
+// Senders with invalid identities are limited the same way as the not
+// identified ones, they're going to be rejected anyway.
+//
+// identified - Whether the sender's identity is known or not.
+//
+func (c *backendConnection) maxMessageSize(identified bool) int {
+	if !identified {
+		return backendMaxUnidentifiedSize
+	}
+	limits, err := c.messageLimits(c.identity)
+	if err != nil {
+		return backendMaxUnidentifiedSize
+	}
+	return limits.maxSize()
 }
 
 // Exported
@@ -36,18 +88,33 @@ func newBackendConnection(conn net.Conn) *backendConnection {
 
 // Recv receives data from the underlaying connection and maps it to
 // the backend request structure. If there's no data to read it will block
-// until new data appears.
+// until new data appears. Reading stops as soon as the message exceeds
+// the size limit of the sender's vhost.
 //
 // Returns read request or an error if something went wrong.
 func (c *backendConnection) Recv() (req *backendRequest, err error) {
 	var msg = [][]byte{}
 	var buf = bufio.NewReader(c.conn)
 	var possibleEom = false
+	var line []byte
+	var size, maxSize = 0, c.maxMessageSize(c.identity != "")
 	for {
 		chunk, err := buf.ReadSlice('\n')
+		if size += len(chunk); maxSize > 0 && size > maxSize {
+			// Not reading the rest, it's not going to be handled anyway.
+			return nil, errMessageTooLarge
+		}
+		if err == bufio.ErrBufferFull {
+			// Line is longer than the buffer, reading the rest...
+			line = append(line, chunk...)
+			continue
+		}
 		if err != nil {
 			break
 		}
+		if line != nil {
+			chunk, line = append(line, chunk...), nil
+		}
 		if string(chunk) == "\r\n" {
 			// Seems like it's end of the message...
 			if possibleEom {
@@ -60,6 +127,11 @@ func (c *backendConnection) Recv() (req *backendRequest, err error) {
 			possibleEom = false
 		}
 		msg = append(msg[:], chunk[:len(chunk)-1])
+		if len(msg) == 2 && len(msg[1]) == 0 {
+			// Identity received, the vhost's limits can be applied.
+			c.identity = string(msg[0])
+			maxSize = c.maxMessageSize(true)
+		}
 	}
 	if len(msg) < 1 {
 		err = errors.New("bad request")
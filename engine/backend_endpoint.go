@@ -18,7 +18,6 @@ package engine
 import (
 	"encoding/json"
 	"errors"
-	"log"
 	"net"
 	"strconv"
 	"sync"
@@ -45,10 +44,10 @@ type BackendEndpoint struct {
 	listener *net.TCPListener
 	// The endpoint's status.
 	alive bool
+	// Whether the endpoint is draining or not.
+	draining bool
 	// Internal semaphore.
 	mtx sync.Mutex
-	// Internal logger.
-	log *log.Logger
 }
 
 // Internal constructor
@@ -65,7 +64,6 @@ func newBackendEndpoint(ctx *Context, addr string) *BackendEndpoint {
 		lobbys: NewBackendLobbyMux(),
 		addr:   addr,
 		ctx:    ctx,
-		log:    ctx.log,
 	}
 }
 
@@ -102,8 +100,16 @@ func (b *BackendEndpoint) serve() (err error) {
 		}
 		var conn net.Conn
 		if conn, err = b.listener.Accept(); err != nil {
+			if b.IsDraining() {
+				// Listener has been closed intentionally.
+				return nil
+			}
 			if nerr, ok := err.(net.Error); ok && nerr.Temporary() {
-				log.Printf("accept error: %v\n", err)
+				b.ctx.writeLog(nil, &logEntry{
+					level:     LogError,
+					component: "backend",
+					msg:       "accept error: " + err.Error(),
+				})
 				<-time.After(1 * time.Second)
 				continue
 			}
@@ -152,8 +158,14 @@ func (b *BackendEndpoint) handle(conn net.Conn) {
 	var err error
 	var s *Status
 
-	c := newBackendConnection(conn)
+	c := newBackendConnection(conn, b.ctx)
 	if req, err = c.Recv(); err != nil {
+		if s = messageLimitStatus(err); s != nil {
+			// The rest of the message is still there, can't continue.
+			c.Send("ER", strconv.Itoa(s.Code))
+			c.Kill()
+			goto log
+		}
 		s = &Status{"Bad request", 400}
 		c.Send("ER", "400")
 		goto log
@@ -223,6 +235,8 @@ func (b *BackendEndpoint) dispatchReq(vhost *Vhost, req *backendRequest,
 		s = b.handleReqOpenChannel(vhost, req)
 	case "CC": // Close channel
 		s = b.handleReqCloseChannel(vhost, req)
+	case "CM": // Channel metadata
+		s = b.handleReqChannelMetadata(vhost, req)
 	case "AT": // Generate single access token
 		s = b.handleReqSingleAccessTokenRequest(vhost, req)
 	default:
@@ -231,28 +245,27 @@ func (b *BackendEndpoint) dispatchReq(vhost *Vhost, req *backendRequest,
 	return
 }
 
+// logStatus writes specified status information to the logs and replies
+// with an error in case of 4xx or 5xx statuses. The 3xx statuses are logged
+// only when debug mode is enabled, globally or for the related vhost.
+//
+// vhost - Related vhost, may be nil.
+// s     - The status to be logged.
+// req   - The handled request, may be nil.
+//
 func (b *BackendEndpoint) logStatus(vhost *Vhost, s *Status, req *backendRequest) {
-	switch {
-	case s.Code >= 400:
-		if req != nil {
-			req.Reply("ER", strconv.Itoa(s.Code))
-		}
-	case s.Code >= 300 && s.Code < 400:
-		// Log information statuses only when debug mode is enabled.
-		// TODO: log after adding a debug mode...
-		return
-	case s.Code < 300:
-		// Nothing to do, just go to logging...
+	if s.Code >= 400 && req != nil {
+		req.Reply("ER", strconv.Itoa(s.Code))
 	}
-	vhostPath := "???"
-	if vhost != nil {
-		vhostPath = vhost.Path()
+	e := &logEntry{
+		level:     logLevelForStatus(s),
+		component: "backend",
+		status:    s,
 	}
-	reqString := "[]"
 	if req != nil {
-		reqString = req.String()
+		e.event, e.msg = req.Command, req.String()
 	}
-	b.log.Printf("backend[%s]: %s; %s", vhostPath, s.String(), reqString)
+	b.ctx.writeLog(vhost, e)
 }
 
 // handleReqBroadcast is a handler for the backend's broadcast (BC) request.
@@ -280,6 +293,9 @@ func (b *BackendEndpoint) handleReqBroadcast(vhost *Vhost, req *backendRequest)
 		// No channel or event name specified!
 		return &Status{"Bad request", 400}
 	}
+	if err = vhost.receivedMessageLimits().check(req.Message[2]); err != nil {
+		return messageLimitStatus(err)
+	}
 	if err = json.Unmarshal(req.Message[2], &data); err != nil {
 		// No data specified, making empty one...
 		data = make(map[string]interface{})
@@ -296,6 +312,7 @@ func (b *BackendEndpoint) handleReqBroadcast(vhost *Vhost, req *backendRequest)
 }
 
 // handleReqOpenChannel is a handler for the backend's open channel (OC) request.
+// Channels opened with the 'ephemeral' flag are kept in memory only.
 //
 // vhost - Related vhost.
 // req   - The request to be handled.
@@ -304,9 +321,11 @@ func (b *BackendEndpoint) handleReqBroadcast(vhost *Vhost, req *backendRequest)
 func (b *BackendEndpoint) handleReqOpenChannel(vhost *Vhost, req *backendRequest) *Status {
 	// <<<
 	// channel name\n
+	// ephemeral\n (optional)
 	// >>>
 	var chanName string
 	var chanType ChannelType
+	var ephemeral bool
 	var err error
 
 	if req.Len() < 1 {
@@ -317,13 +336,25 @@ func (b *BackendEndpoint) handleReqOpenChannel(vhost *Vhost, req *backendRequest
 		// No channel name or type specified.
 		return &Status{"Bad request", 400}
 	}
+	if req.Len() > 1 {
+		if string(req.Message[1]) != "ephemeral" {
+			// Unknown channel flag.
+			return &Status{"Bad request", 400}
+		}
+		ephemeral = true
+	}
 	if _, err = vhost.Channel(chanName); err == nil {
 		// Channel with such name already exists, it's ok!
 		req.Reply("OK")
 		return &Status{"Channel exists", 251}
 	}
-	chanType = channelTypeFromName(chanName)
-	if _, err = vhost.OpenChannel(chanName, chanType); err != nil {
+	chanType = ChannelTypeFromName(chanName)
+	if ephemeral {
+		_, err = vhost.OpenEphemeralChannel(chanName, chanType)
+	} else {
+		_, err = vhost.OpenChannel(chanName, chanType)
+	}
+	if err != nil {
 		// Requested channel name is invalid!
 		return &Status{"Invalid channel name", 451}
 	}
@@ -358,6 +389,47 @@ func (b *BackendEndpoint) handleReqCloseChannel(vhost *Vhost, req *backendReques
 	return &Status{"Channel closed", 252}
 }
 
+// handleReqChannelMetadata is a handler for the backend's channel metadata
+// (CM) request. Sets the channel's metadata entry, or removes it when no
+// value is specified.
+//
+// vhost - Related vhost.
+// req   - The request to be handled.
+//
+// Returns textual status and code.
+func (b *BackendEndpoint) handleReqChannelMetadata(vhost *Vhost, req *backendRequest) *Status {
+	// <<<
+	// channel name\n
+	// key\n
+	// value\n (optional)
+	// >>>
+	var chanName, key string
+	var err error
+
+	if req.Len() < 2 {
+		return &Status{"Bad request", 400}
+	}
+	chanName, key = string(req.Message[0]), string(req.Message[1])
+	if chanName == "" || key == "" {
+		// No channel name or key specified.
+		return &Status{"Bad request", 400}
+	}
+	if _, err = vhost.Channel(chanName); err != nil {
+		return &Status{"Channel not found", 454}
+	}
+	if req.Len() > 2 {
+		err = vhost.SetChannelMetadata(chanName, key, string(req.Message[2]))
+	} else {
+		err = vhost.DeleteChannelMetadata(chanName, key)
+	}
+	if err != nil {
+		// Channel has been closed in the meantime, or there's no such key.
+		return &Status{"Bad request", 400}
+	}
+	req.Reply("OK")
+	return &Status{"Channel metadata changed", 253}
+}
+
 // handleReqSingleAccessTokenRequest is a handler for the backend's single
 // access token (AT) request.
 //
@@ -434,6 +506,30 @@ func (b *BackendEndpoint) ListenAndServeTLS(certFile, certKey string) (err error
 	return errors.New("not implemented")
 }
 
+// Drain stops accepting new backend connections. Already connected workers
+// are kept alive, so the lobby queues can be flushed before the endpoint
+// gets killed.
+func (b *BackendEndpoint) Drain() {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	if b.alive && b.listener != nil && !b.draining {
+		b.draining = true
+		b.listener.Close()
+	}
+}
+
+// IsDraining returns whether the endpoint is draining or not.
+func (b *BackendEndpoint) IsDraining() bool {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	return b.draining
+}
+
+// IsDrained returns whether all the lobby queues have been flushed.
+func (b *BackendEndpoint) IsDrained() bool {
+	return b.lobbys.PendingCount() == 0
+}
+
 // IsAlive Returns whether the endpoint is alive or not.
 func (w *BackendEndpoint) IsAlive() bool {
 	w.mtx.Lock()
@@ -40,6 +40,8 @@ type backendLobby struct {
 	maxRetries int
 	// The delay time before the next try to send a message.
 	retryDelay time.Duration
+	// Number of the messages waiting for delivery.
+	pending int
 	// Internal semaphore.
 	mtx sync.Mutex
 }
@@ -69,10 +71,18 @@ func newBackendLobby() (l *backendLobby) {
 // dequeueLoop is an event loop which waits for the messages and load ballances
 // it across all the connected workers.
 func (l *backendLobby) dequeueLoop() {
-	for payload := range l.queue {
+	l.mtx.Lock()
+	queue := l.queue
+	l.mtx.Unlock()
+	for payload := range queue {
 		l.send(payload)
+		l.mtx.Lock()
+		l.pending -= 1
+		l.mtx.Unlock()
 	}
 	// We have to kill all the workers when it terminates... 
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
 	for _, worker := range l.workers {
 		worker.Kill()
 	}
@@ -175,9 +185,20 @@ start:
 // payload - data to be send to the client.
 //
 func (l *backendLobby) Enqueue(payload interface{}) {
+	l.mtx.Lock()
+	l.pending += 1
+	l.mtx.Unlock()
 	l.queue <- payload
 }
 
+// Pending returns number of the enqueued messages which haven't been
+// delivered yet.
+func (l *backendLobby) Pending() int {
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+	return l.pending
+}
+
 // Workers returns list of active workers.
 func (l *backendLobby) Workers() map[string]*BackendWorker {
 	l.mtx.Lock()
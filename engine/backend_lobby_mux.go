@@ -96,3 +96,14 @@ func (mux *BackendLobbyMux) KillAll() {
 		l.Kill()
 	}
 }
+
+// PendingCount returns total number of the messages waiting for delivery
+// in all registered lobbys.
+func (mux *BackendLobbyMux) PendingCount() (n int) {
+	mux.mtx.Lock()
+	defer mux.mtx.Unlock()
+	for _, l := range mux.m {
+		n += l.Pending()
+	}
+	return
+}
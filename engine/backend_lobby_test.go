@@ -18,6 +18,7 @@ package engine
 import (
 	uuid "github.com/nu7hatch/gouuid"
 	"testing"
+	"time"
 )
 
 func newTestBackendWorker() *BackendWorker {
@@ -108,6 +109,20 @@ func TestBackendLobbyLoadBallancer(t *testing.T) {
 	}
 }
 
+func TestBackendLobbyPending(t *testing.T) {
+	bl := newBackendLobby()
+	if bl.Pending() != 0 {
+		t.Errorf("Expected to have no pending messages")
+	}
+	bl.Enqueue("hello")
+	for i := 0; bl.Pending() != 0 && i < 100; i += 1 {
+		<-time.After(10 * time.Millisecond)
+	}
+	if bl.Pending() != 0 {
+		t.Errorf("Expected to flush pending messages")
+	}
+}
+
 func TestBackendLobbyKill(t *testing.T) {
 	bl := newBackendLobby()
 	bl.Kill()
@@ -92,8 +92,9 @@ func (a *BackendWorker) listen() {
 		ddl := time.Now().Add(backendWorkerHeartbeatInterval * 2)
 		a.conn.SetDeadline(ddl)
 		req, err := a.conn.Recv()
-		if err != nil && err == io.EOF {
-			// End of file reached...
+		if err != nil && (err == io.EOF || err == errMessageTooLarge) {
+			// End of file reached or the rest of the message
+			// can't be read...
 			break
 		}
 		if req != nil {
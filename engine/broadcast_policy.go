@@ -0,0 +1,182 @@
+// Copyright (C) 2011 by Krzysztof Kowalik <chris@nu7hat.ch>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package engine
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// BroadcastPermission specifies which websocket clients can broadcast
+// events to the channel.
+type BroadcastPermission int
+
+// Available broadcast permissions.
+const (
+	// Any subscriber can broadcast.
+	BroadcastEveryone BroadcastPermission = iota
+	// Only the authenticated subscribers can broadcast.
+	BroadcastAuthenticated
+	// Only the subscribers with user IDs matching the pattern can broadcast.
+	BroadcastUids
+	// Nobody can broadcast, only the backend can.
+	BroadcastNobody
+)
+
+// Names of the broadcast permissions.
+var broadcastPermissionNames = []string{"everyone", "authenticated", "uids", "nobody"}
+
+// BroadcastPolicy specifies who can broadcast events to the channel from
+// the frontend and which events.
+type BroadcastPolicy struct {
+	// Who can broadcast.
+	Allow BroadcastPermission
+	// Regexp matching the user IDs allowed to broadcast, used only with
+	// the BroadcastUids permission.
+	Uids string
+	// Prefixes of the allowed event names, eg. 'client-', any event is
+	// allowed when empty.
+	EventPrefixes []string
+}
+
+// broadcastRule represents the broadcast policy assigned to the channels
+// matching the name or pattern.
+type broadcastRule struct {
+	// Channels to which the policy applies.
+	channels *channelPattern
+	// The policy.
+	policy BroadcastPolicy
+	// Compiled regexp of the allowed user IDs.
+	uids *regexp.Regexp
+}
+
+// Internal constructor
+// -----------------------------------------------------------------------------
+
+// newBroadcastRule validates and compiles given broadcast policy.
+//
+// channel - The channel name or wildcard pattern, eg. 'chat.*'.
+// policy  - The broadcast policy.
+//
+// Returns new rule or an error if the channel or policy is invalid.
+func newBroadcastRule(channel string, policy BroadcastPolicy) (r *broadcastRule, err error) {
+	if policy.Allow < BroadcastEveryone || policy.Allow > BroadcastNobody {
+		return nil, errors.New("invalid broadcast permission")
+	}
+	auto := AutoChannels{Patterns: []string{channel}}
+	var patterns []*channelPattern
+	if patterns, err = auto.compile(); err != nil {
+		return
+	}
+	r = &broadcastRule{channels: patterns[0], policy: policy}
+	if policy.Allow == BroadcastUids {
+		r.uids, err = regexp.Compile(fmt.Sprintf("^(%s)$", policy.Uids))
+		if err != nil {
+			return nil, errors.New("invalid uids regexp")
+		}
+	}
+	return
+}
+
+// Internal
+// -----------------------------------------------------------------------------
+
+// sortBroadcastRules orders the rules from the most specific one: single
+// channel names go first, then patterns from the longest.
+//
+// rules - The rules to be sorted.
+//
+func sortBroadcastRules(rules []*broadcastRule) {
+	sort.Slice(rules, func(i, j int) bool {
+		a, b := rules[i].channels.pattern, rules[j].channels.pattern
+		if isChannelPattern(a) != isChannelPattern(b) {
+			return !isChannelPattern(a)
+		}
+		if len(a) != len(b) {
+			return len(a) > len(b)
+		}
+		return a < b
+	})
+}
+
+// allows checks whether the client can broadcast given event.
+//
+// c     - The broadcasting client.
+// event - The event name.
+//
+func (r *broadcastRule) allows(c *WebsocketConnection, event string) bool {
+	switch r.policy.Allow {
+	case BroadcastNobody:
+		return false
+	case BroadcastAuthenticated:
+		if !c.IsAuthenticated() {
+			return false
+		}
+	case BroadcastUids:
+		if !c.IsAuthenticated() || !r.uids.MatchString(c.Uid()) {
+			return false
+		}
+	}
+	if len(r.policy.EventPrefixes) == 0 {
+		return true
+	}
+	for _, prefix := range r.policy.EventPrefixes {
+		if strings.HasPrefix(event, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// Exported
+// -----------------------------------------------------------------------------
+
+// ParseBroadcastPermission converts given name into the broadcast permission.
+//
+// name - The name of the permission, one of: everyone, authenticated,
+//        uids or nobody.
+//
+// Returns the permission or an error if the name is invalid.
+func ParseBroadcastPermission(name string) (BroadcastPermission, error) {
+	for i, permissionName := range broadcastPermissionNames {
+		if permissionName == strings.ToLower(name) {
+			return BroadcastPermission(i), nil
+		}
+	}
+	return BroadcastEveryone, errors.New("invalid broadcast permission")
+}
+
+// String returns name of the broadcast permission.
+func (p BroadcastPermission) String() string {
+	if p < BroadcastEveryone || int(p) >= len(broadcastPermissionNames) {
+		return "unknown"
+	}
+	return broadcastPermissionNames[p]
+}
+
+// Validate checks whether the broadcast policy can be assigned to the
+// channel, without applying it anywhere.
+//
+// channel - The channel name or wildcard pattern, eg. 'chat.*'.
+//
+// Returns an error if the channel or policy is invalid.
+func (p BroadcastPolicy) Validate(channel string) error {
+	_, err := newBroadcastRule(channel, p)
+	return err
+}
@@ -0,0 +1,97 @@
+// Copyright (C) 2011 by Krzysztof Kowalik <chris@nu7hat.ch>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+package engine
+
+import (
+	"testing"
+)
+
+func TestParseBroadcastPermission(t *testing.T) {
+	for i, name := range []string{"everyone", "Authenticated", "uids", "nobody"} {
+		p, err := ParseBroadcastPermission(name)
+		if err != nil || p != BroadcastPermission(i) {
+			t.Errorf("Expected to parse the '%s' broadcast permission", name)
+		}
+	}
+	if _, err := ParseBroadcastPermission("somebody"); err == nil {
+		t.Errorf("Expected to throw an error while parsing invalid permission")
+	}
+	if BroadcastUids.String() != "uids" {
+		t.Errorf("Expected to get the broadcast permission name")
+	}
+}
+
+func TestNewBroadcastRuleWithInvalidPolicy(t *testing.T) {
+	for _, tt := range []struct {
+		channel string
+		policy  BroadcastPolicy
+	}{
+		{"chat/*", BroadcastPolicy{}},
+		{"chat", BroadcastPolicy{Allow: BroadcastPermission(10)}},
+		{"chat", BroadcastPolicy{Allow: BroadcastUids, Uids: "(joe"}},
+	} {
+		if _, err := newBroadcastRule(tt.channel, tt.policy); err == nil {
+			t.Errorf("Expected to throw an error while creating rule for %v", tt)
+		}
+		if err := tt.policy.Validate(tt.channel); err == nil {
+			t.Errorf("Expected to throw an error while validating %v", tt)
+		}
+	}
+}
+
+func TestBroadcastRuleAllows(t *testing.T) {
+	anonymous := newFallbackConnection(&recordingTransport{})
+	joe := newFallbackConnection(&recordingTransport{})
+	p, _ := NewPermission("joe", ".*")
+	joe.authenticate(p)
+	for _, tt := range []struct {
+		policy  BroadcastPolicy
+		c       *WebsocketConnection
+		event   string
+		allowed bool
+	}{
+		{BroadcastPolicy{}, anonymous, "hello", true},
+		{BroadcastPolicy{Allow: BroadcastNobody}, joe, "hello", false},
+		{BroadcastPolicy{Allow: BroadcastAuthenticated}, anonymous, "hello", false},
+		{BroadcastPolicy{Allow: BroadcastAuthenticated}, joe, "hello", true},
+		{BroadcastPolicy{Allow: BroadcastUids, Uids: "jo.*"}, joe, "hello", true},
+		{BroadcastPolicy{Allow: BroadcastUids, Uids: "admin"}, joe, "hello", false},
+		{BroadcastPolicy{EventPrefixes: []string{"client-"}}, anonymous, "client-typing", true},
+		{BroadcastPolicy{EventPrefixes: []string{"client-"}}, anonymous, "hello", false},
+	} {
+		r, err := newBroadcastRule("chat", tt.policy)
+		if err != nil {
+			t.Errorf("Expected to create the rule without errors")
+			continue
+		}
+		if r.allows(tt.c, tt.event) != tt.allowed {
+			t.Errorf("Expected allowing '%s' with %v to be %v", tt.event, tt.policy, tt.allowed)
+		}
+	}
+}
+
+func TestSortBroadcastRules(t *testing.T) {
+	var rules []*broadcastRule
+	for _, channel := range []string{"*", "chat.*", "chat.1", "chat.*.typing"} {
+		r, _ := newBroadcastRule(channel, BroadcastPolicy{})
+		rules = append(rules, r)
+	}
+	sortBroadcastRules(rules)
+	for i, channel := range []string{"chat.1", "chat.*.typing", "chat.*", "*"} {
+		if rules[i].channels.pattern != channel {
+			t.Errorf("Expected '%s' rule at %d, given '%s'", channel, i, rules[i].channels.pattern)
+		}
+	}
+}
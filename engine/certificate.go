@@ -0,0 +1,93 @@
+// Copyright (C) 2011 by Krzysztof Kowalik <chris@nu7hat.ch>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package engine
+
+import (
+	"crypto/rand"
+	"crypto/tls"
+	"errors"
+	"sync"
+)
+
+// certificateStore keeps the TLS certificate used by an endpoint and
+// allows to swap it while the endpoint is running. Already established
+// connections are not affected, new handshakes use the most recently
+// loaded certificate.
+type certificateStore struct {
+	// The current certificate.
+	cert *tls.Certificate
+	// Internal semaphore.
+	mtx sync.Mutex
+}
+
+// Internal
+// -----------------------------------------------------------------------------
+
+// load reads the certificate and its private key from given files
+// and replaces the current one.
+//
+// certFile - Path to the TLS certificate file.
+// certKey  - Path to the certificate's private key.
+//
+// Returns an error if something went wrong.
+func (s *certificateStore) load(certFile, certKey string) error {
+	cert, err := tls.LoadX509KeyPair(certFile, certKey)
+	if err != nil {
+		return err
+	}
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	s.cert = &cert
+	return nil
+}
+
+// reload works the same as load, but fails when no certificate has
+// been loaded before, which means that the endpoint is not serving TLS.
+//
+// certFile - Path to the TLS certificate file.
+// certKey  - Path to the certificate's private key.
+//
+// Returns an error if something went wrong.
+func (s *certificateStore) reload(certFile, certKey string) error {
+	if !s.isEnabled() {
+		return errors.New("TLS not enabled")
+	}
+	return s.load(certFile, certKey)
+}
+
+// isEnabled returns whether any certificate has been loaded or not.
+func (s *certificateStore) isEnabled() bool {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	return s.cert != nil
+}
+
+// getCertificate returns the current certificate. Used as a callback
+// of the TLS configuration.
+func (s *certificateStore) getCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	return s.cert, nil
+}
+
+// config returns a TLS configuration using the store's certificate.
+func (s *certificateStore) config() *tls.Config {
+	return &tls.Config{
+		Rand:           rand.Reader,
+		NextProtos:     []string{"http/1.1"},
+		GetCertificate: s.getCertificate,
+	}
+}
@@ -0,0 +1,80 @@
+// Copyright (C) 2011 by Krzysztof Kowalik <chris@nu7hat.ch>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package engine
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path"
+	"testing"
+	"time"
+)
+
+func writeTestCertificate(t *testing.T, dir, name string) (certFile, keyFile string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now(),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDer, _ := x509.MarshalECPrivateKey(key)
+	certFile, keyFile = path.Join(dir, name+".crt"), path.Join(dir, name+".key")
+	ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644)
+	ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600)
+	return
+}
+
+func TestCertificateStoreReload(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "webrocket")
+	defer os.RemoveAll(dir)
+	s := &certificateStore{}
+	certFile, keyFile := writeTestCertificate(t, dir, "foo")
+	if err := s.reload(certFile, keyFile); err == nil {
+		t.Errorf("Expected to not reload certificate when TLS is not enabled")
+	}
+	if err := s.load(certFile, keyFile); err != nil {
+		t.Errorf("Expected to load certificate, given %v", err)
+	}
+	first, _ := s.getCertificate(nil)
+	certFile, keyFile = writeTestCertificate(t, dir, "bar")
+	if err := s.reload(certFile, keyFile); err != nil {
+		t.Errorf("Expected to reload certificate, given %v", err)
+	}
+	if second, _ := s.getCertificate(nil); second == nil || second == first {
+		t.Errorf("Expected to swap the certificate")
+	}
+	if err := s.reload(path.Join(dir, "none.crt"), keyFile); err == nil {
+		t.Errorf("Expected an error while reloading non existent certificate")
+	}
+	if current, _ := s.getCertificate(nil); current == first || current == nil {
+		t.Errorf("Expected to keep the current certificate after failed reload")
+	}
+}
@@ -20,11 +20,15 @@ import (
 	"regexp"
 	"strings"
 	"sync"
+	"time"
 )
 
 // Pattern used to validate a channel name.
 var validChannelNamePattern = regexp.MustCompile("^[\\w\\d\\_][\\w\\d\\-\\_\\.]*$")
 
+// The default time after which the empty ephemeral channel is closed.
+const defaultEmptyChannelTimeout = time.Minute
+
 // ChannelType represents a type of the channel. Can be normal, private
 // or presence.
 type ChannelType int
@@ -49,10 +53,45 @@ type Channel struct {
 	subscribers map[string]*Subscription
 	// Channel's state.
 	alive bool
+	// Whether the channel is kept in memory only.
+	ephemeral bool
+	// Whether the channel has been created on the first subscribe.
+	auto bool
+	// Time after which the empty channel is closed, zero if it's kept
+	// open until deleted.
+	emptyTimeout time.Duration
+	// Fires when the channel stays empty for the timeout.
+	emptyTimer *time.Timer
+	// Closes the channel which stayed empty for the timeout.
+	onEmpty func(*Channel)
+	// Tells whether the presence is aggregated by the user ID, nil
+	// if it's never aggregated.
+	presenceByUid func() bool
+	// Custom metadata of the channel, eg. title or owner.
+	metadata map[string]string
+	// Tells whether the metadata is sent to the subscribers, nil if
+	// it's never sent.
+	publicMetadata func() bool
+	// Messages waiting for delivery, in the broadcasting order.
+	queue []*channelMessage
+	// Wakes up the broadcasting loop when new messages are queued.
+	ready chan bool
+	// Closed when the channel is killed, stops the broadcasting loop.
+	done chan bool
+	// Semaphore of the queue.
+	qmtx sync.Mutex
 	// Internal semaphore.
 	mtx sync.Mutex
 }
 
+// channelMessage represents a single message broadcasted to the channel.
+type channelMessage struct {
+	// The shared frame to be sent to the subscribers.
+	frame *websocketFrame
+	// Whether the message shall be sent to the hidden subscribers as well.
+	includeHidden bool
+}
+
 // Internal constructor
 // -----------------------------------------------------------------------------
 
@@ -75,62 +114,227 @@ func newChannel(name string, kind ChannelType) (ch *Channel, err error) {
 		name:        name,
 		kind:        kind,
 		subscribers: make(map[string]*Subscription),
+		metadata:    make(map[string]string),
 		alive:       true,
+		ready:       make(chan bool, 1),
+		done:        make(chan bool),
 	}
+	go ch.broadcaster()
 	return
 }
 
 // Internal
 // -----------------------------------------------------------------------------
 
-// channelTypeFromName parses given channel name and discover's what is
-// its type.
+// broadcaster implements the channel's broadcasting loop. Messages are
+// delivered one by one, in the order they've been broadcasted, so all
+// the subscribers receive them in the same order. Sending doesn't block,
+// so one slow subscriber doesn't delay the others. Works until the channel
+// is killed.
+func (ch *Channel) broadcaster() {
+	for {
+		select {
+		case <-ch.ready:
+			ch.qmtx.Lock()
+			queue := ch.queue
+			ch.queue = nil
+			ch.qmtx.Unlock()
+			for _, msg := range queue {
+				ch.deliver(msg)
+			}
+		case <-ch.done:
+			return
+		}
+	}
+}
+
+// deliver sends given message to the current subscribers of the channel,
+// skipping the ones which filter it out. Called only from the broadcasting
+// loop.
 //
-// name - The name to be parsed.
+// msg - The message to be delivered.
 //
-// Returns the channel type.
-func channelTypeFromName(name string) (t ChannelType) {
-	if parts := strings.Split(name, "-"); len(parts) > 1 {
-		switch parts[0] {
-		case "presence":
-			return ChannelPresence
-		case "private":
-			return ChannelPrivate
+func (ch *Channel) deliver(msg *channelMessage) {
+	ch.mtx.Lock()
+	clients := make([]*WebsocketConnection, 0, len(ch.subscribers))
+	filters := make([]*subscriptionFilter, 0, len(ch.subscribers))
+	for _, s := range ch.subscribers {
+		if s.IsHidden() && !msg.includeHidden {
+			continue
+		}
+		if client := s.Client(); client != nil {
+			clients = append(clients, client)
+			filters = append(filters, s.filter)
 		}
 	}
-	return ChannelNormal
+	ch.mtx.Unlock()
+	for i, client := range clients {
+		if filters[i].matches(msg.frame.payload) {
+			client.Send(msg.frame)
+		}
+	}
+}
+
+// closeWhenEmpty makes the channel call given function whenever nobody
+// subscribes it for the specified time. Threadsafe.
+//
+// timeout - Time after which the empty channel shall be closed.
+// fn      - The function closing the channel.
+//
+func (ch *Channel) closeWhenEmpty(timeout time.Duration, fn func(*Channel)) {
+	ch.mtx.Lock()
+	defer ch.mtx.Unlock()
+	ch.emptyTimeout, ch.onEmpty = timeout, fn
+	ch.resetEmptyTimer()
+}
+
+// resetEmptyTimer starts counting the empty channel's timeout, or stops
+// it when the channel has some subscribers. Not threadsafe, the channel's
+// semaphore has to be locked by the caller.
+func (ch *Channel) resetEmptyTimer() {
+	if ch.emptyTimer != nil {
+		ch.emptyTimer.Stop()
+		ch.emptyTimer = nil
+	}
+	if ch.alive && ch.emptyTimeout > 0 && len(ch.subscribers) == 0 {
+		fn := ch.onEmpty
+		ch.emptyTimer = time.AfterFunc(ch.emptyTimeout, func() { fn(ch) })
+	}
+}
+
+// isEmpty returns whether nobody subscribes the channel. Threadsafe.
+func (ch *Channel) isEmpty() bool {
+	ch.mtx.Lock()
+	defer ch.mtx.Unlock()
+	return len(ch.subscribers) == 0
+}
+
+// aggregatesByUid returns whether the presence channel's subscribers
+// are aggregated by their user IDs.
+func (ch *Channel) aggregatesByUid() bool {
+	return ch.IsPresence() && ch.presenceByUid != nil && ch.presenceByUid()
+}
+
+// hasVisibleMember returns whether any visible subscriber other than the
+// specified one is identified by given user ID. Not threadsafe, called
+// under the channel's semaphore.
+//
+// uid - The user ID to be checked.
+// sid - ID of the subscriber's connection to be skipped.
+//
+func (ch *Channel) hasVisibleMember(uid, sid string) bool {
+	if uid == "" {
+		return false
+	}
+	for id, s := range ch.subscribers {
+		if id != sid && !s.IsHidden() && s.Uid() == uid {
+			return true
+		}
+	}
+	return false
+}
+
+// updateMetadata sets or removes the channel's metadata entry. Threadsafe.
+//
+// key   - The metadata key.
+// value - The value to be set.
+// set   - Whether to set or remove the entry.
+//
+// Returns whether the metadata has been changed or not.
+func (ch *Channel) updateMetadata(key, value string, set bool) bool {
+	ch.mtx.Lock()
+	defer ch.mtx.Unlock()
+	if set {
+		ch.metadata[key] = value
+		return true
+	}
+	if _, ok := ch.metadata[key]; !ok {
+		return false
+	}
+	delete(ch.metadata, key)
+	return true
+}
+
+// copyMetadata returns a copy of the channel's metadata. Not threadsafe,
+// called under the channel's semaphore.
+func (ch *Channel) copyMetadata() map[string]string {
+	metadata := make(map[string]string, len(ch.metadata))
+	for key, value := range ch.metadata {
+		metadata[key] = value
+	}
+	return metadata
+}
+
+// isPersisted returns whether the channel is kept in the storage.
+// Ephemeral channels live in memory only.
+func (ch *Channel) isPersisted() bool {
+	return !ch.ephemeral
 }
 
 // subscribe appends given client to the list of subscribers. If hidden
 // is true then he will be invisible fot the other subscribers of the
-// presence channel. Threadsafe, May be called from many websocket
-// connection's handlers.
+// presence channel. Channels subscribed via pattern are confirmed with
+// the pattern, and when subscribed explicitly later on, they are not
+// affected by unsubscribing the pattern anymore. Threadsafe, May be called
+// from many websocket connection's handlers and the vhost opening new
+// channels.
 //
-// client - The websocket client to be subscribed.
-// hidden - If true then subscription will be invisible.
-// data   - The user specific data attached to the presence channel identity.
+// client  - The websocket client to be subscribed.
+// hidden  - If true then subscription will be invisible.
+// data    - The user specific data attached to the presence channel identity.
+// pattern - The pattern which matched the channel, empty if subscribed
+//           explicitly.
+// filter  - Filter of the events sent to the client, nil if everything
+//           shall be sent. Explicit subscribe replaces the filter of the
+//           channel subscribed already.
 //
-func (ch *Channel) subscribe(client *WebsocketConnection, hidden bool, data map[string]interface{}) {
+// When the presence is aggregated by the user ID, then the other subscribers
+// are told only about the first connection of the user, and the list of
+// subscribers contains every user once.
+// The confirmation contains the channel's metadata if it's public.
+//
+func (ch *Channel) subscribe(client *WebsocketConnection, hidden bool,
+	data map[string]interface{}, pattern string, filter *subscriptionFilter) {
 	if client != nil && ch.IsAlive() {
+		byUid := ch.aggregatesByUid()
+		public := ch.publicMetadata != nil && ch.publicMetadata()
 		ch.mtx.Lock()
+		if client.isKilled() {
+			ch.mtx.Unlock()
+			return
+		}
 		sid := client.Id()
 		s, ok := ch.subscribers[sid]
 		if ok {
 			// Already subscribing this channel...
+			if pattern == "" {
+				s.pattern, s.filter = "", filter
+			}
 			ch.mtx.Unlock()
 			return
 		} else {
 			s = newSubscription(client, hidden, data)
+			s.pattern, s.filter = pattern, filter
 		}
 		data["channel"] = ch.name
 		var subscribers []interface{}
+		joined := !hidden
 		if ch.IsPresence() {
 			data["uid"] = s.Uid()
-			subscribers = make([]interface{}, len(ch.subscribers))
-			i := 0
+			subscribers = make([]interface{}, 0, len(ch.subscribers))
+			listed := make(map[string]bool)
 			for _, s := range ch.subscribers {
-				subscribers[i] = s.Data()
-				i += 1
+				if byUid && s.Uid() != "" {
+					if listed[s.Uid()] {
+						continue
+					}
+					listed[s.Uid()] = true
+				}
+				subscribers = append(subscribers, s.Data())
+			}
+			if byUid && ch.hasVisibleMember(s.Uid(), sid) {
+				// The user is already there.
+				joined = false
 			}
 		}
 		// Confirm subscription.
@@ -141,11 +345,18 @@ func (ch *Channel) subscribe(client *WebsocketConnection, hidden bool, data map[
 		if ch.IsPrivate() {
 			sdata["uid"] = s.Uid()
 		}
+		if pattern != "" {
+			sdata["pattern"] = pattern
+		}
+		if public {
+			sdata["metadata"] = ch.copyMetadata()
+		}
 		client.Send(map[string]interface{}{":subscribed": sdata})
 		ch.subscribers[sid] = s
-		client.subscriptions[ch.Name()] = ch
+		client.setSubscription(ch, true)
+		ch.resetEmptyTimer()
 		ch.mtx.Unlock()
-		if ch.IsPresence() && !hidden {
+		if ch.IsPresence() && joined {
 			// Tell everyone that someone joined the channel.
 			ch.Broadcast(map[string]interface{}{":memberJoined": data}, true)
 		}
@@ -158,10 +369,14 @@ func (ch *Channel) subscribe(client *WebsocketConnection, hidden bool, data map[
 // client - The websocket client to be subscribed.
 // data   - The user specific data passed to other subscribers.
 //
+// When the presence is aggregated by the user ID, then the other subscribers
+// are told only about the last connection of the user leaving the channel.
+//
 func (ch *Channel) unsubscribe(client *WebsocketConnection, data map[string]interface{}, confirm bool) {
 	if client != nil && ch.IsAlive() {
 		var s *Subscription
 		var ok bool
+		byUid := ch.aggregatesByUid()
 		ch.mtx.Lock()
 		sid := client.Id()
 		if s, ok = ch.subscribers[sid]; !ok {
@@ -177,15 +392,21 @@ func (ch *Channel) unsubscribe(client *WebsocketConnection, data map[string]inte
 			})
 		}
 		delete(ch.subscribers, sid)
-		delete(client.subscriptions, ch.Name())
+		client.setSubscription(ch, false)
+		ch.resetEmptyTimer()
+		// The user is still there if another connection remains.
+		left := !s.IsHidden() && !(byUid && ch.hasVisibleMember(s.Uid(), sid))
 		ch.mtx.Unlock()
 		if ch.IsPrivate() {
 			data["uid"] = s.Uid()
 		}
-		if ch.IsPresence() && !s.IsHidden() {
+		if ch.IsPresence() && left {
 			// Tell the others that this guy is not subscribing the
 			// channel anymore.
-			merged := s.Data()
+			merged := make(map[string]interface{})
+			for k, v := range s.Data() {
+				merged[k] = v
+			}
 			for k, v := range data {
 				merged[k] = v
 			}
@@ -195,9 +416,94 @@ func (ch *Channel) unsubscribe(client *WebsocketConnection, data map[string]inte
 	}
 }
 
+// updateMember merges given data into the client's presence data and tells
+// the other subscribers about the change with the ':memberUpdated' event,
+// unless the client's subscription is hidden. The channel name and user ID
+// can't be changed. Threadsafe, called from the websocket connection's
+// handlers.
+//
+// client - The websocket client which updates its data.
+// data   - The user specific data to be merged.
+//
+// Returns whether the client is subscribing the channel or not.
+func (ch *Channel) updateMember(client *WebsocketConnection, data map[string]interface{}) bool {
+	if client == nil || !ch.IsAlive() {
+		return false
+	}
+	ch.mtx.Lock()
+	s, ok := ch.subscribers[client.Id()]
+	if !ok {
+		ch.mtx.Unlock()
+		return false
+	}
+	// The old data may still be queued for delivery, so it's replaced
+	// rather than modified.
+	merged := make(map[string]interface{}, len(s.data)+len(data))
+	for k, v := range s.data {
+		merged[k] = v
+	}
+	for k, v := range data {
+		merged[k] = v
+	}
+	merged["channel"] = ch.name
+	merged["uid"] = s.Uid()
+	s.data = merged
+	ch.mtx.Unlock()
+	if !s.IsHidden() {
+		ch.Broadcast(map[string]interface{}{":memberUpdated": merged}, true)
+	}
+	return true
+}
+
+// unsubscribePattern removes the client's subscription created via given
+// pattern. If another pattern of the client still matches the channel,
+// then the subscription is kept and assigned to that pattern instead.
+// Threadsafe, called from the websocket connection's handlers.
+//
+// client  - The websocket client to be unsubscribed.
+// pattern - The pattern unsubscribed by the client.
+//
+func (ch *Channel) unsubscribePattern(client *WebsocketConnection, pattern string) {
+	if client != nil && ch.IsAlive() {
+		ch.mtx.Lock()
+		s, ok := ch.subscribers[client.Id()]
+		if !ok || s.pattern == "" || s.pattern != pattern {
+			// Not subscribed via this pattern...
+			ch.mtx.Unlock()
+			return
+		}
+		if other := client.matchingPattern(ch); other != "" {
+			s.pattern = other
+			ch.mtx.Unlock()
+			return
+		}
+		ch.mtx.Unlock()
+		ch.unsubscribe(client, map[string]interface{}{}, true)
+	}
+}
+
 // Exported
 // -----------------------------------------------------------------------------
 
+// ChannelTypeFromName parses given channel name and discovers what is
+// its type. Names prefixed with 'presence-' and 'private-' are mapped to
+// the presence and private channels respectively.
+//
+// name - The name to be parsed.
+//
+// Returns the channel type.
+func ChannelTypeFromName(name string) (t ChannelType) {
+	if parts := strings.Split(name, "-"); len(parts) > 1 {
+		switch parts[0] {
+		case "presence":
+			return ChannelPresence
+		case "private":
+			return ChannelPrivate
+		}
+	}
+	return ChannelNormal
+}
+
 // Name returns name of the channel. 
 func (ch *Channel) Name() string {
 	return ch.name
@@ -218,6 +524,26 @@ func (ch *Channel) IsPresence() bool {
 	return ch.kind&ChannelPresence == ChannelPresence
 }
 
+// IsAutoCreated returns whether the channel has been created on the first
+// subscribe. Such channels are always ephemeral.
+func (ch *Channel) IsAutoCreated() bool {
+	return ch.auto
+}
+
+// IsEphemeral returns whether the channel is kept in memory only. Such
+// channels are not persisted, so they disappear when the server restarts,
+// and are closed when they stay empty for a while.
+func (ch *Channel) IsEphemeral() bool {
+	return ch.ephemeral
+}
+
+// Metadata returns a copy of the channel's metadata. Threadsafe.
+func (ch *Channel) Metadata() map[string]string {
+	ch.mtx.Lock()
+	defer ch.mtx.Unlock()
+	return ch.copyMetadata()
+}
+
 // HasSubscriber checks whether specified client is subscribing to this
 // channel or not. Threadsafe, May be called from many places and depends
 // on the Subscribe and Unsubscribe funcs.
@@ -235,31 +561,48 @@ func (ch *Channel) HasSubscriber(client *WebsocketConnection) bool {
 	return false
 }
 
-// Subscribers returns list of the clients subsribing to the channel.
-// Threadsafe, May be called from many places and depends on the Subscribe
-// and Unsubscribe funcs.
+// Subscribers returns a copy of the list of the clients subsribing to the
+// channel. Threadsafe, May be called from many places and depends on the
+// Subscribe and Unsubscribe funcs.
 func (ch *Channel) Subscribers() map[string]*Subscription {
 	ch.mtx.Lock()
 	defer ch.mtx.Unlock()
-	return ch.subscribers
+	subscribers := make(map[string]*Subscription, len(ch.subscribers))
+	for sid, s := range ch.subscribers {
+		subscribers[sid] = s
+	}
+	return subscribers
 }
 
-// Broadcast sends given payload to all active subscribers of this channel.
-// Threadsafe, May be called from many websocket client's handlers.
+// Broadcast queues given payload to be sent to all active subscribers
+// of this channel. The payload is encoded only once per codec used by the
+// subscribers, not once per subscriber, so it mustn't be modified afterwards.
 //
-// x - The data to be broadcasted to all the subscribers.
+// Messages are delivered in order: all the subscribers receive the
+// channel's messages in the same order, and messages broadcasted one
+// after another by the same publisher are received in that order as well.
+// Messages of the different channels are not ordered. Never blocks, the
+// message is delivered by the channel's broadcasting loop. Threadsafe, May
+// be called from many websocket client's handlers.
+//
+// x             - The data to be broadcasted to all the subscribers.
+// includeHidden - Whether to send it to the hidden subscribers as well.
 //
 func (ch *Channel) Broadcast(x map[string]interface{}, includeHidden bool) {
-	go func(subscribers map[string]*Subscription) {
-		for _, s := range subscribers {
-			if s.IsHidden() && !includeHidden {
-				continue
-			}
-			if client := s.Client(); client != nil {
-				client.Send(x)
-			}
-		}
-	}(ch.Subscribers())
+	select {
+	case <-ch.done:
+		// Channel is dead, nobody would deliver the message.
+		return
+	default:
+	}
+	msg := &channelMessage{newWebsocketFrame(x), includeHidden}
+	ch.qmtx.Lock()
+	ch.queue = append(ch.queue, msg)
+	ch.qmtx.Unlock()
+	select {
+	case ch.ready <- true:
+	default:
+	}
 }
 
 // IsAlive returns whether the channels is alive or not. Threadsafe, May be
@@ -270,16 +613,19 @@ func (ch *Channel) IsAlive() bool {
 	return ch.alive
 }
 
-// Kill closes the channel's broadcaster and marks it as dead. Threadsafe, 
-// May be called from the backend protocol or admin interface and
-// affects the IsAlive func.
+// Kill closes the channel's broadcaster, drops all the subscriptions and
+// marks it as dead. Messages still waiting in the queue are discarded.
+// Threadsafe, May be called from the backend protocol or admin interface
+// and affects the IsAlive func.
 func (ch *Channel) Kill() {
 	ch.mtx.Lock()
 	defer ch.mtx.Unlock()
 	if ch.alive {
 		ch.alive = false
-		for _, s := range ch.subscribers {
-			ch.unsubscribe(s.Client(), map[string]interface{}{}, false)
-		}
+		close(ch.done)
+		// Not using unsubscribe here, it's a no-op for dead channels
+		// and would try to lock the semaphore again.
+		ch.subscribers = make(map[string]*Subscription)
+		ch.resetEmptyTimer()
 	}
 }
@@ -0,0 +1,85 @@
+// Copyright (C) 2011 by Krzysztof Kowalik <chris@nu7hat.ch>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package engine
+
+import (
+	"errors"
+	"regexp"
+	"strings"
+)
+
+// Pattern used to validate a channel pattern, same as the channel name
+// but with wildcards allowed.
+var validChannelPatternPattern = regexp.MustCompile("^[\\w\\d\\_\\*][\\w\\d\\-\\_\\.\\*]*$")
+
+// channelPattern represents a pattern subscription of the websocket client,
+// eg. 'orders.*'. The wildcard matches any part of the channel name
+// between the dots.
+type channelPattern struct {
+	// The pattern as given by the client.
+	pattern string
+	// The compiled pattern.
+	re *regexp.Regexp
+}
+
+// Internal constructor
+// -----------------------------------------------------------------------------
+
+// newChannelPattern validates and compiles given channel pattern.
+//
+// pattern - The pattern to be compiled.
+//
+// Returns new pattern or an error if the pattern is invalid.
+func newChannelPattern(pattern string) (p *channelPattern, err error) {
+	if !isChannelPattern(pattern) || !validChannelPatternPattern.MatchString(pattern) {
+		err = errors.New("invalid channel pattern")
+		return
+	}
+	expr := strings.Replace(regexp.QuoteMeta(pattern), "\\*", "[^.]*", -1)
+	p = &channelPattern{pattern: pattern}
+	p.re, err = regexp.Compile("^" + expr + "$")
+	return
+}
+
+// Internal
+// -----------------------------------------------------------------------------
+
+// isChannelPattern returns whether given name is a channel pattern
+// rather than a name of the single channel.
+//
+// name - The name to be checked.
+//
+func isChannelPattern(name string) bool {
+	return strings.Contains(name, "*")
+}
+
+// matchesName returns whether given channel name matches the pattern.
+//
+// name - The channel name to be checked.
+//
+func (p *channelPattern) matchesName(name string) bool {
+	return p.re.MatchString(name)
+}
+
+// matches returns whether the channel with given name shall be subscribed
+// via this pattern. Presence channels are never matched, since they need
+// explicit subscriptions with the member's data.
+//
+// ch - The channel to be checked.
+//
+func (p *channelPattern) matches(ch *Channel) bool {
+	return !ch.IsPresence() && p.matchesName(ch.Name())
+}
@@ -0,0 +1,62 @@
+// Copyright (C) 2011 by Krzysztof Kowalik <chris@nu7hat.ch>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+package engine
+
+import (
+	"testing"
+)
+
+func TestNewChannelPattern(t *testing.T) {
+	for _, pattern := range []string{"orders.*", "*", "*.eu", "orders.*.new", "or*ers"} {
+		if _, err := newChannelPattern(pattern); err != nil {
+			t.Errorf("Expected to compile the '%s' pattern without errors", pattern)
+		}
+	}
+}
+
+func TestNewChannelPatternWithInvalidPattern(t *testing.T) {
+	for _, pattern := range []string{"orders", "", "#&*^&^&&", "-*", ".*"} {
+		_, err := newChannelPattern(pattern)
+		if err == nil || err.Error() != "invalid channel pattern" {
+			t.Errorf("Expected to throw 'invalid channel pattern' error while compiling the '%s' pattern", pattern)
+		}
+	}
+}
+
+func TestChannelPatternMatches(t *testing.T) {
+	for _, tt := range []struct {
+		pattern string
+		name    string
+		kind    ChannelType
+		matches bool
+	}{
+		{"orders.*", "orders.1", ChannelNormal, true},
+		{"orders.*", "orders.", ChannelNormal, true},
+		{"orders.*", "orders", ChannelNormal, false},
+		{"orders.*", "orders.eu.1", ChannelNormal, false},
+		{"orders.*", "ordersx1", ChannelNormal, false},
+		{"orders.*.new", "orders.eu.new", ChannelNormal, true},
+		{"*.eu", "orders.eu", ChannelNormal, true},
+		{"private-orders.*", "private-orders.1", ChannelPrivate, true},
+		{"presence-*", "presence-room", ChannelPresence, false},
+	} {
+		p, _ := newChannelPattern(tt.pattern)
+		ch, _ := newChannel(tt.name, tt.kind)
+		if p.matches(ch) != tt.matches {
+			t.Errorf("Expected '%s' matching '%s' to be %v", tt.pattern, tt.name, tt.matches)
+		}
+		ch.Kill()
+	}
+}
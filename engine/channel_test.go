@@ -15,7 +15,33 @@
 
 package engine
 
-import "testing"
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+type recordingTransport struct {
+	payloads []interface{}
+	mtx      sync.Mutex
+}
+
+func (t *recordingTransport) send(payload interface{}) error {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+	if frame, ok := payload.(*websocketFrame); ok {
+		t.payloads = append(t.payloads, frame.payload)
+	}
+	return nil
+}
+
+func (t *recordingTransport) close() {}
+
+func (t *recordingTransport) received() []interface{} {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+	return append([]interface{}{}, t.payloads...)
+}
 
 func TestNewChannel(t *testing.T) {
 	ch, err := newChannel("hello", ChannelPresence)
@@ -70,18 +96,144 @@ func TestChannelIsPrivate(t *testing.T) {
 }
 
 func TestChannelTypeFromName(t *testing.T) {
-	ct := channelTypeFromName("presence-foobar")
+	ct := ChannelTypeFromName("presence-foobar")
 	if ct != ChannelPresence {
 		t.Errorf("Expected to have a presence channel type")
 	}
-	ct = channelTypeFromName("private-foobar")
+	ct = ChannelTypeFromName("private-foobar")
 	if ct != ChannelPrivate {
 		t.Errorf("Expected to have a private channel type")
 	}
 	for _, name := range []string{"foobar", "presence", "private"} {
-		ct = channelTypeFromName(name)
+		ct = ChannelTypeFromName(name)
 		if ct != ChannelNormal {
 			t.Errorf("Expected to have a normal channel type")
 		}
 	}
 }
+
+func TestChannelBroadcastOrdering(t *testing.T) {
+	const publishers, messages = 8, 500
+	ch, _ := newChannel("hello", ChannelNormal)
+	transports := make([]*recordingTransport, 10)
+	for i := range transports {
+		transports[i] = &recordingTransport{}
+		ch.subscribe(newFallbackConnection(transports[i]), false, map[string]interface{}{}, "", nil)
+	}
+	var wg sync.WaitGroup
+	for p := 0; p < publishers; p += 1 {
+		wg.Add(1)
+		go func(p int) {
+			defer wg.Done()
+			for n := 0; n < messages; n += 1 {
+				ch.Broadcast(map[string]interface{}{"msg": map[string]interface{}{"p": p, "n": n}}, false)
+			}
+		}(p)
+	}
+	wg.Wait()
+	var first []interface{}
+	for i, tr := range transports {
+		var received []interface{}
+		for j := 0; len(received) < publishers*messages; j += 1 {
+			if j >= 100 {
+				t.Fatalf("Expected to receive all the messages, got %d", len(received))
+			}
+			<-time.After(10 * time.Millisecond)
+			received = tr.received()
+		}
+		last := make(map[int]int)
+		for _, x := range received {
+			data := x.(map[string]interface{})["msg"].(map[string]interface{})
+			p, n := data["p"].(int), data["n"].(int)
+			if prev, ok := last[p]; ok && n != prev+1 {
+				t.Fatalf("Expected messages of the publisher to be ordered, got %d after %d", n, prev)
+			}
+			last[p] = n
+		}
+		if i == 0 {
+			first = received
+			continue
+		}
+		for j := range received {
+			if received[j].(map[string]interface{})["msg"].(map[string]interface{})["p"] !=
+				first[j].(map[string]interface{})["msg"].(map[string]interface{})["p"] {
+				t.Fatalf("Expected all the subscribers to receive messages in the same order")
+			}
+		}
+	}
+	ch.Kill()
+}
+
+func TestChannelCloseWhenEmpty(t *testing.T) {
+	ch, _ := newChannel("hello", ChannelNormal)
+	closed := make(chan bool, 1)
+	ch.closeWhenEmpty(50*time.Millisecond, func(*Channel) { closed <- true })
+	c := newFallbackConnection(&recordingTransport{})
+	ch.subscribe(c, false, map[string]interface{}{}, "", nil)
+	select {
+	case <-closed:
+		t.Errorf("Expected to not close the channel having subscribers")
+	case <-time.After(100 * time.Millisecond):
+	}
+	ch.unsubscribe(c, map[string]interface{}{}, false)
+	select {
+	case <-closed:
+	case <-time.After(time.Second):
+		t.Errorf("Expected to close the channel when empty for the timeout")
+	}
+	ch.Kill()
+}
+
+func TestChannelUpdateMember(t *testing.T) {
+	ch, _ := newChannel("presence-hello", ChannelPresence)
+	c := newFallbackConnection(&recordingTransport{})
+	if ch.updateMember(c, map[string]interface{}{"status": "away"}) {
+		t.Errorf("Expected to not update data of the not subscribing client")
+	}
+	ch.subscribe(c, false, map[string]interface{}{"foo": "bar"}, "", nil)
+	if !ch.updateMember(c, map[string]interface{}{"status": "away", "channel": "other"}) {
+		t.Errorf("Expected to update data of the subscribing client")
+	}
+	data := ch.Subscribers()[c.Id()].Data()
+	if data["foo"] != "bar" || data["status"] != "away" || data["channel"] != "presence-hello" {
+		t.Errorf("Expected to merge the member data, got %v", data)
+	}
+	ch.Kill()
+}
+
+func countChannelEvents(tr *recordingTransport, event string) (n int) {
+	for _, x := range tr.received() {
+		if _, ok := x.(map[string]interface{})[event]; ok {
+			n += 1
+		}
+	}
+	return
+}
+
+func TestChannelPresenceByUid(t *testing.T) {
+	ch, _ := newChannel("presence-hello", ChannelPresence)
+	ch.presenceByUid = func() bool { return true }
+	tr := &recordingTransport{}
+	ch.subscribe(newFallbackConnection(tr), true, map[string]interface{}{}, "", nil)
+	conns := make([]*WebsocketConnection, 2)
+	for i := range conns {
+		conns[i] = newFallbackConnection(&recordingTransport{})
+		p, _ := NewPermission("joe", ".*")
+		conns[i].authenticate(p)
+		ch.subscribe(conns[i], false, map[string]interface{}{}, "", nil)
+	}
+	ch.unsubscribe(conns[0], map[string]interface{}{}, false)
+	<-time.After(100 * time.Millisecond)
+	if n := countChannelEvents(tr, ":memberJoined"); n != 1 {
+		t.Errorf("Expected to join the user once, got %d", n)
+	}
+	if n := countChannelEvents(tr, ":memberLeft"); n != 0 {
+		t.Errorf("Expected to keep the user having other connections, got %d leaves", n)
+	}
+	ch.unsubscribe(conns[1], map[string]interface{}{}, false)
+	<-time.After(100 * time.Millisecond)
+	if n := countChannelEvents(tr, ":memberLeft"); n != 1 {
+		t.Errorf("Expected the user to leave with the last connection, got %d", n)
+	}
+	ch.Kill()
+}
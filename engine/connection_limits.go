@@ -0,0 +1,346 @@
+// Copyright (C) 2011 by Krzysztof Kowalik <chris@nu7hat.ch>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package engine
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// ConnectionLimits specifies maximum numbers of the frontend connections
+// within a vhost. Zero means no limit.
+type ConnectionLimits struct {
+	// Maximum number of all connections.
+	Total int
+	// Maximum number of connections from the same remote IP.
+	PerIp int
+	// Maximum number of connections authenticated as the same user.
+	PerUid int
+}
+
+// ConnectionStats represents current numbers of the frontend connections
+// within a vhost.
+type ConnectionStats struct {
+	// Number of all connections.
+	Total int
+	// Numbers of connections per remote IP.
+	PerIp map[string]int
+	// Numbers of connections per authenticated user.
+	PerUid map[string]int
+	// Number of clients disconnected for not keeping up with the messages
+	// sent to them.
+	SlowConsumers int
+	// Number of messages dropped from the full outbound queues.
+	DroppedMessages int
+}
+
+// trackedConnection keeps information about the connection needed
+// to release its slots.
+type trackedConnection struct {
+	// Remote IP of the client.
+	ip string
+	// User as which the client is authenticated, empty if not.
+	uid string
+}
+
+// connectionTracker counts connections per vhost, remote IP and user,
+// and checks whether new ones fit within the limits.
+type connectionTracker struct {
+	// List of tracked connections (by connection id).
+	conns map[string]*trackedConnection
+	// Numbers of connections per remote IP.
+	ips map[string]int
+	// Numbers of connections per authenticated user.
+	uids map[string]int
+	// Internal semaphore.
+	mtx sync.Mutex
+}
+
+// Internal constructor
+// -----------------------------------------------------------------------------
+
+// newConnectionTracker creates new, empty connection tracker.
+//
+// Returns new tracker.
+func newConnectionTracker() *connectionTracker {
+	return &connectionTracker{
+		conns: make(map[string]*trackedConnection),
+		ips:   make(map[string]int),
+		uids:  make(map[string]int),
+	}
+}
+
+// Internal
+// -----------------------------------------------------------------------------
+
+// remoteIp extracts an IP address of the client from the request. When
+// the request comes from one of the trusted proxies, then the address
+// is taken from the X-Forwarded-For header, which is walked from the
+// right to the left skipping the trusted proxies on the way. The header
+// is ignored when the request doesn't come from a trusted proxy, so
+// the clients can't spoof their addresses.
+//
+// req     - The client's request.
+// proxies - The trusted proxies' networks, may be empty.
+//
+// Returns the IP address, empty if unknown.
+func remoteIp(req *http.Request, proxies []*net.IPNet) string {
+	if req == nil {
+		return ""
+	}
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		host = req.RemoteAddr
+	}
+	if len(proxies) == 0 || !isTrustedProxy(host, proxies) {
+		return host
+	}
+	var hops []string
+	for _, header := range req.Header["X-Forwarded-For"] {
+		hops = append(hops, strings.Split(header, ",")...)
+	}
+	for i := len(hops) - 1; i >= 0; i -= 1 {
+		hop := strings.TrimSpace(hops[i])
+		if net.ParseIP(hop) == nil {
+			// Malformed entry, everything on the left of it is untrusted.
+			break
+		}
+		host = hop
+		if !isTrustedProxy(host, proxies) {
+			break
+		}
+	}
+	return host
+}
+
+// isTrustedProxy returns whether the specified IP belongs to any of
+// the trusted proxies' networks.
+//
+// ip      - The IP to be checked.
+// proxies - The trusted proxies' networks.
+//
+// Returns whether the IP is trusted or not.
+func isTrustedProxy(ip string, proxies []*net.IPNet) bool {
+	addr := net.ParseIP(ip)
+	if addr == nil {
+		return false
+	}
+	for _, network := range proxies {
+		if network.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// parseTrustedProxies parses the list of trusted proxies, specified
+// as single IPs or networks in the CIDR notation.
+//
+// proxies - The list of proxies to be parsed.
+//
+// Returns the proxies' networks or an error if any of them is invalid.
+func parseTrustedProxies(proxies []string) ([]*net.IPNet, error) {
+	var networks []*net.IPNet
+	for _, proxy := range proxies {
+		if !strings.Contains(proxy, "/") {
+			ip := net.ParseIP(proxy)
+			if ip == nil {
+				return nil, errors.New("invalid trusted proxy: " + proxy)
+			}
+			bits := 8 * net.IPv6len
+			if ip4 := ip.To4(); ip4 != nil {
+				ip, bits = ip4, 8*net.IPv4len
+			}
+			networks = append(networks, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, network, err := net.ParseCIDR(proxy)
+		if err != nil {
+			return nil, errors.New("invalid trusted proxy: " + proxy)
+		}
+		networks = append(networks, network)
+	}
+	return networks, nil
+}
+
+// check returns whether a new connection from the specified IP,
+// authenticated as the specified user, fits within the limits. Not
+// threadsafe, the tracker's semaphore has to be locked by the caller.
+//
+// ip     - Remote IP of the client, may be empty.
+// uid    - User as which the client is authenticated, may be empty.
+// limits - The limits to be checked, nil means no limits.
+//
+// Returns zero if the connection is allowed, otherwise a HTTP status code
+// explaining why it is not: 503 when the vhost is full, 429 when the limit
+// of the IP or user has been reached.
+func (t *connectionTracker) check(ip, uid string, limits *ConnectionLimits) int {
+	if limits == nil {
+		return 0
+	}
+	if limits.Total > 0 && len(t.conns) >= limits.Total {
+		return http.StatusServiceUnavailable
+	}
+	if limits.PerIp > 0 && ip != "" && t.ips[ip] >= limits.PerIp {
+		return http.StatusTooManyRequests
+	}
+	return t.checkUid(uid, limits)
+}
+
+// checkUid returns whether one more connection authenticated as the
+// specified user fits within the user's limit. Not threadsafe, the
+// tracker's semaphore has to be locked by the caller.
+//
+// uid    - User as which the client is authenticated, may be empty.
+// limits - The limits to be checked, nil means no limits.
+//
+// Returns zero if the connection is allowed, or 429 when the limit
+// of the user has been reached.
+func (t *connectionTracker) checkUid(uid string, limits *ConnectionLimits) int {
+	if limits == nil {
+		return 0
+	}
+	if limits.PerUid > 0 && uid != "" && t.uids[uid] >= limits.PerUid {
+		return http.StatusTooManyRequests
+	}
+	return 0
+}
+
+// admit checks whether a new connection from the specified IP fits
+// within the limits, without tracking it yet. Threadsafe, used to
+// reject handshakes early.
+//
+// ip     - Remote IP of the client.
+// limits - The limits to be checked, nil means no limits.
+//
+// Returns zero or a HTTP status code, see the check function.
+func (t *connectionTracker) admit(ip string, limits *ConnectionLimits) int {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+	return t.check(ip, "", limits)
+}
+
+// track starts counting the specified connection if it fits within the
+// limits. Tracking the same connection again has no effect. Threadsafe.
+//
+// id     - The connection's id.
+// ip     - Remote IP of the client, may be empty.
+// uid    - User as which the client is authenticated, may be empty.
+// limits - The limits to be checked, nil means no limits.
+//
+// Returns zero or a HTTP status code, see the check function.
+func (t *connectionTracker) track(id, ip, uid string, limits *ConnectionLimits) int {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+	if _, ok := t.conns[id]; ok {
+		return 0
+	}
+	if code := t.check(ip, uid, limits); code != 0 {
+		return code
+	}
+	t.conns[id] = &trackedConnection{ip: ip}
+	if ip != "" {
+		t.ips[ip] += 1
+	}
+	t.setUid(id, uid)
+	return 0
+}
+
+// untrack stops counting the specified connection. Threadsafe.
+//
+// id - The connection's id.
+//
+func (t *connectionTracker) untrack(id string) {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+	tc, ok := t.conns[id]
+	if !ok {
+		return
+	}
+	t.setUid(id, "")
+	if tc.ip != "" {
+		if t.ips[tc.ip] -= 1; t.ips[tc.ip] <= 0 {
+			delete(t.ips, tc.ip)
+		}
+	}
+	delete(t.conns, id)
+}
+
+// authenticate changes the user as which the specified connection
+// is counted. When the new user's limit has been reached, then the
+// connection keeps being counted for its current user. Only the user's
+// limit is checked, the connection is already counted in the other ones.
+// Untracked connections are ignored. Threadsafe.
+//
+// id     - The connection's id.
+// uid    - The new user, empty when the connection is deauthenticated.
+// limits - The limits to be checked, nil means no limits.
+//
+// Returns whether the connection fits within the user's limit or not.
+func (t *connectionTracker) authenticate(id, uid string, limits *ConnectionLimits) bool {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+	tc, ok := t.conns[id]
+	if !ok || tc.uid == uid {
+		return true
+	}
+	if t.checkUid(uid, limits) != 0 {
+		return false
+	}
+	t.setUid(id, uid)
+	return true
+}
+
+// setUid assigns the user to the tracked connection and updates the
+// user counters. Not threadsafe, the tracker's semaphore has to be
+// locked by the caller.
+//
+// id  - The connection's id.
+// uid - The new user, may be empty.
+//
+func (t *connectionTracker) setUid(id, uid string) {
+	tc := t.conns[id]
+	if tc.uid != "" {
+		if t.uids[tc.uid] -= 1; t.uids[tc.uid] <= 0 {
+			delete(t.uids, tc.uid)
+		}
+	}
+	tc.uid = uid
+	if uid != "" {
+		t.uids[uid] += 1
+	}
+}
+
+// stats returns current numbers of the tracked connections. Threadsafe.
+func (t *connectionTracker) stats() *ConnectionStats {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+	s := &ConnectionStats{
+		Total:  len(t.conns),
+		PerIp:  make(map[string]int),
+		PerUid: make(map[string]int),
+	}
+	for ip, n := range t.ips {
+		s.PerIp[ip] = n
+	}
+	for uid, n := range t.uids {
+		s.PerUid[uid] = n
+	}
+	return s
+}
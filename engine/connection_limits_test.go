@@ -0,0 +1,159 @@
+// Copyright (C) 2011 by Krzysztof Kowalik <chris@nu7hat.ch>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+
+package engine
+
+import (
+	"net"
+	"net/http"
+	"testing"
+)
+
+func TestConnectionTrackerTotalLimit(t *testing.T) {
+	tr := newConnectionTracker()
+	limits := &ConnectionLimits{Total: 2}
+	if code := tr.track("a", "1.1.1.1", "", limits); code != 0 {
+		t.Errorf("Expected to track connection within the limit")
+	}
+	tr.track("b", "2.2.2.2", "", limits)
+	if code := tr.admit("3.3.3.3", limits); code != http.StatusServiceUnavailable {
+		t.Errorf("Expected to reject with 503 when full, got %d", code)
+	}
+	if code := tr.track("c", "3.3.3.3", "", limits); code != http.StatusServiceUnavailable {
+		t.Errorf("Expected not to track when full, got %d", code)
+	}
+	if code := tr.track("a", "1.1.1.1", "", limits); code != 0 {
+		t.Errorf("Expected to ignore already tracked connection")
+	}
+	tr.untrack("a")
+	tr.untrack("a")
+	if stats := tr.stats(); stats.Total != 1 || len(stats.PerIp) != 1 {
+		t.Errorf("Expected to release the connection once, got %v", stats)
+	}
+	if code := tr.admit("3.3.3.3", nil); code != 0 {
+		t.Errorf("Expected to admit everything without limits")
+	}
+}
+
+func TestConnectionTrackerPerIpLimit(t *testing.T) {
+	tr := newConnectionTracker()
+	limits := &ConnectionLimits{PerIp: 1}
+	tr.track("a", "1.1.1.1", "", limits)
+	if code := tr.admit("1.1.1.1", limits); code != http.StatusTooManyRequests {
+		t.Errorf("Expected to reject with 429, got %d", code)
+	}
+	if code := tr.admit("2.2.2.2", limits); code != 0 {
+		t.Errorf("Expected to admit connection from another IP")
+	}
+}
+
+func TestConnectionTrackerPerUidLimit(t *testing.T) {
+	tr := newConnectionTracker()
+	limits := &ConnectionLimits{PerUid: 1}
+	tr.track("a", "1.1.1.1", "joe", limits)
+	tr.track("b", "1.1.1.1", "", limits)
+	if tr.authenticate("b", "joe", limits) {
+		t.Errorf("Expected to reject user exceeding the limit")
+	}
+	if !tr.authenticate("a", "bob", limits) {
+		t.Errorf("Expected to change the user")
+	}
+	if !tr.authenticate("b", "joe", limits) {
+		t.Errorf("Expected to allow user released by another connection")
+	}
+	if !tr.authenticate("c", "joe", limits) {
+		t.Errorf("Expected to ignore not tracked connection")
+	}
+	stats := tr.stats()
+	if stats.PerUid["joe"] != 1 || stats.PerUid["bob"] != 1 {
+		t.Errorf("Expected to count connections per user, got %v", stats)
+	}
+}
+
+func TestConnectionTrackerAuthenticateInFullVhost(t *testing.T) {
+	tr := newConnectionTracker()
+	limits := &ConnectionLimits{Total: 2, PerIp: 1, PerUid: 1}
+	tr.track("a", "1.1.1.1", "", limits)
+	tr.track("b", "2.2.2.2", "", limits)
+	if !tr.authenticate("a", "joe", limits) {
+		t.Errorf("Expected to authenticate already tracked connection in full vhost")
+	}
+	if stats := tr.stats(); stats.Total != 2 || stats.PerUid["joe"] != 1 {
+		t.Errorf("Expected to count the authenticated user, got %v", stats)
+	}
+}
+
+func TestConnectionTrackerRejectedUidKeepsCurrentUser(t *testing.T) {
+	tr := newConnectionTracker()
+	limits := &ConnectionLimits{PerUid: 1}
+	tr.track("a", "1.1.1.1", "joe", limits)
+	tr.track("b", "1.1.1.1", "bob", limits)
+	if tr.authenticate("b", "joe", limits) {
+		t.Errorf("Expected to reject user exceeding the limit")
+	}
+	if stats := tr.stats(); stats.PerUid["joe"] != 1 || stats.PerUid["bob"] != 1 {
+		t.Errorf("Expected to keep counting the current user, got %v", stats)
+	}
+}
+
+func TestRemoteIp(t *testing.T) {
+	proxies, _ := parseTrustedProxies([]string{"10.0.0.1", "192.168.0.0/16", "fd00::/8"})
+	var tests = []struct {
+		addr      string
+		forwarded []string
+		proxies   []*net.IPNet
+		ip        string
+	}{
+		{"10.0.0.1:4321", nil, nil, "10.0.0.1"},
+		{"[::1]:4321", nil, nil, "::1"},
+		{"10.0.0.1:4321", []string{"1.1.1.1"}, nil, "10.0.0.1"},
+		{"10.0.0.2:4321", []string{"1.1.1.1"}, proxies, "10.0.0.2"},
+		{"10.0.0.1:4321", nil, proxies, "10.0.0.1"},
+		{"10.0.0.1:4321", []string{"1.1.1.1"}, proxies, "1.1.1.1"},
+		{"10.0.0.1:4321", []string{"6.6.6.6, 1.1.1.1"}, proxies, "1.1.1.1"},
+		{"10.0.0.1:4321", []string{"6.6.6.6, 1.1.1.1, 192.168.1.1"}, proxies, "1.1.1.1"},
+		{"10.0.0.1:4321", []string{"6.6.6.6", "1.1.1.1,192.168.1.1"}, proxies, "1.1.1.1"},
+		{"10.0.0.1:4321", []string{"192.168.1.2, 192.168.1.1"}, proxies, "192.168.1.2"},
+		{"10.0.0.1:4321", []string{"1.1.1.1, garbage"}, proxies, "10.0.0.1"},
+		{"10.0.0.1:4321", []string{"garbage, 192.168.1.1"}, proxies, "192.168.1.1"},
+		{"[fd00::1]:4321", []string{"2001:db8::1"}, proxies, "2001:db8::1"},
+	}
+	for _, tt := range tests {
+		req, _ := http.NewRequest("GET", "/", nil)
+		req.RemoteAddr = tt.addr
+		for _, header := range tt.forwarded {
+			req.Header.Add("X-Forwarded-For", header)
+		}
+		if ip := remoteIp(req, tt.proxies); ip != tt.ip {
+			t.Errorf("Expected %s for %s forwarding %v, got %s", tt.ip, tt.addr, tt.forwarded, ip)
+		}
+	}
+}
+
+func TestParseTrustedProxies(t *testing.T) {
+	networks, err := parseTrustedProxies([]string{"10.0.0.1", "::1", "192.168.0.0/16"})
+	if err != nil || len(networks) != 3 {
+		t.Fatalf("Expected to parse trusted proxies, got %v, %v", networks, err)
+	}
+	if networks[0].String() != "10.0.0.1/32" || networks[1].String() != "::1/128" {
+		t.Errorf("Expected single IPs to be parsed as host networks, got %v", networks)
+	}
+	for _, proxy := range []string{"", "localhost", "10.0.0.0/33", "10.0.0.300"} {
+		if _, err := parseTrustedProxies([]string{proxy}); err == nil {
+			t.Errorf("Expected an error for invalid proxy '%s'", proxy)
+		}
+	}
+}
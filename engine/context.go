@@ -22,16 +22,21 @@ import (
 	"fmt"
 	"io/ioutil"
 	"log"
+	"net"
 	"os"
 	"path"
 	"regexp"
 	"sync"
 	"syscall"
+	"time"
 )
 
 // The length of the cookie string.
 const CookieSize = 40
 
+// How often to check whether the endpoints have been drained.
+const contextDrainCheckInterval = 100 * time.Millisecond
+
 // The pattern used to validate node name.
 var validNodeNamePattern = regexp.MustCompile("^[\\d\\w\\.\\-\\_].+$")
 
@@ -60,6 +65,14 @@ type Context struct {
 	cookie string
 	// Internal logger.
 	log *log.Logger
+	// The global log level.
+	logLevel LogLevel
+	// Log level semaphore.
+	lmtx sync.Mutex
+	// Networks of the proxies trusted to pass the clients' addresses.
+	trustedProxies []*net.IPNet
+	// Trusted proxies semaphore.
+	pmtx sync.Mutex
 	// Internal semaphore.
 	mtx sync.Mutex
 }
@@ -72,7 +85,8 @@ type Context struct {
 // Returns a new context.
 func NewContext() *Context {
 	return &Context{
-		log:      log.New(os.Stderr, "", log.LstdFlags),
+		log:      log.New(os.Stderr, "", 0),
+		logLevel: DefaultLogLevel,
 		vhosts:   make(map[string]*Vhost),
 		nodeName: DefaultNodeName(),
 	}
@@ -88,6 +102,40 @@ func (ctx *Context) isStorageEnabled() bool {
 	return ctx.storage != nil && ctx.storageOn
 }
 
+// isDrained returns whether all the endpoints have been drained.
+func (ctx *Context) isDrained() bool {
+	if ctx.websocket != nil && !ctx.websocket.IsDrained() {
+		return false
+	}
+	if ctx.backend != nil && !ctx.backend.IsDrained() {
+		return false
+	}
+	return true
+}
+
+// writeLog writes given entry to the log if its level is enabled. Log level
+// configured for the related vhost takes precedence over the global one.
+// Threadsafe, called from all the endpoints.
+//
+// vhost - The related vhost, may be nil.
+// e     - The entry to be written.
+//
+func (ctx *Context) writeLog(vhost *Vhost, e *logEntry) {
+	if ctx.log == nil {
+		return
+	}
+	level := ctx.LogLevel()
+	if vhost != nil {
+		if vlevel, ok := vhost.LogLevel(); ok {
+			level = vlevel
+		}
+		e.vhost = vhost.Path()
+	}
+	if e.level >= level {
+		ctx.log.Print(e.String())
+	}
+}
+
 // Exported
 // -----------------------------------------------------------------------------
 
@@ -100,15 +148,78 @@ func (ctx *Context) Log() *log.Logger {
 //
 // newLog - The logger instance to be assigned with the context.
 //
+// Log entries are written in the logfmt format with their own timestamps,
+// so the logger doesn't need any flags.
+//
 // Examples
 //
-//     logger := log.NewLogger(os.Stderr, "My Logger!", log.LstdFlags)
+//     logger := log.New(os.Stderr, "", 0)
 //     ctx.SetLog(logger)
 //
 func (ctx *Context) SetLog(newLog *log.Logger) {
 	ctx.log = newLog
 }
 
+// WriteLog writes a message on behalf of the specified component, eg.
+// the server executable, if the given level is enabled. Threadsafe.
+//
+// level     - Severity of the message.
+// component - Name of the logging component.
+// msg       - The message to be written.
+//
+func (ctx *Context) WriteLog(level LogLevel, component, msg string) {
+	ctx.writeLog(nil, &logEntry{level: level, component: component, msg: msg})
+}
+
+// SetLogLevel changes the global log level. Threadsafe, may be called
+// from the admin endpoint.
+//
+// level - The new log level.
+//
+func (ctx *Context) SetLogLevel(level LogLevel) {
+	ctx.lmtx.Lock()
+	defer ctx.lmtx.Unlock()
+	ctx.logLevel = level
+}
+
+// LogLevel returns the global log level. Threadsafe.
+func (ctx *Context) LogLevel() LogLevel {
+	ctx.lmtx.Lock()
+	defer ctx.lmtx.Unlock()
+	return ctx.logLevel
+}
+
+// SetTrustedProxies configures the proxies which are trusted to pass
+// the clients' addresses in the X-Forwarded-For header. Addresses of the
+// clients connecting through them are used for logging and enforcing
+// the per IP connection limits. Threadsafe, affects new connections only.
+//
+// proxies - List of IPs or networks in the CIDR notation, empty list
+//           means that the header is never trusted.
+//
+// Examples
+//
+//     ctx.SetTrustedProxies([]string{"127.0.0.1", "10.0.0.0/8"})
+//
+// Returns an error if any of the proxies is invalid.
+func (ctx *Context) SetTrustedProxies(proxies []string) error {
+	networks, err := parseTrustedProxies(proxies)
+	if err != nil {
+		return err
+	}
+	ctx.pmtx.Lock()
+	defer ctx.pmtx.Unlock()
+	ctx.trustedProxies = networks
+	return nil
+}
+
+// TrustedProxies returns networks of the trusted proxies. Threadsafe.
+func (ctx *Context) TrustedProxies() []*net.IPNet {
+	ctx.pmtx.Lock()
+	defer ctx.pmtx.Unlock()
+	return ctx.trustedProxies
+}
+
 // Cookie returns the value of the node admin's cookie hash.
 func (ctx *Context) Cookie() string {
 	return ctx.cookie
@@ -347,6 +458,66 @@ func (ctx *Context) Kill() (err error) {
 	return
 }
 
+// Drain gracefully shuts down the context. First it stops accepting new
+// websocket and backend connections and asks the connected websocket
+// clients to reconnect after given delay, then waits until all clients
+// disconnect and backend queues are flushed. When it's done or the deadline
+// is exceeded, then the context is killed. Not threadsafe, same as Kill it
+// shall be called only when exiting from the application.
+//
+// delay    - The reconnect delay to be suggested to the websocket clients.
+// deadline - The maximum time to wait for endpoints to drain.
+//
+// Examples
+//
+//     if err := ctx.Drain(5*time.Second, 30*time.Second); err != nil {
+//         println(err.Error())
+//     }
+//
+// Returns an error if deadline has been exceeded or something went wrong.
+func (ctx *Context) Drain(delay, deadline time.Duration) (err error) {
+	if ctx.websocket != nil {
+		ctx.websocket.Drain(delay)
+	}
+	if ctx.backend != nil {
+		ctx.backend.Drain()
+	}
+	timeout := time.After(deadline)
+wait:
+	for !ctx.isDrained() {
+		select {
+		case <-timeout:
+			err = errors.New("drain deadline exceeded")
+			break wait
+		case <-time.After(contextDrainCheckInterval):
+		}
+	}
+	if kerr := ctx.Kill(); err == nil {
+		err = kerr
+	}
+	return
+}
+
+// ReloadCertificates swaps TLS certificates of the websocket and admin
+// endpoints. Only endpoints serving TLS are reloaded, existing connections
+// are not affected.
+//
+// certFile - Path to the TLS certificate file.
+// certKey  - Path to the certificate's private key.
+//
+// Returns an error if something went wrong.
+func (ctx *Context) ReloadCertificates(certFile, certKey string) (err error) {
+	if ctx.websocket != nil && ctx.websocket.certs.isEnabled() {
+		if err = ctx.websocket.ReloadCertificate(certFile, certKey); err != nil {
+			return
+		}
+	}
+	if ctx.admin != nil && ctx.admin.certs.isEnabled() {
+		err = ctx.admin.ReloadCertificate(certFile, certKey)
+	}
+	return
+}
+
 // NewWebsocketEndpoint creates a new websocket endpoint, registers handlers
 // for all the existing vhosts and registers it within the context.
 //
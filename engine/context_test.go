@@ -16,9 +16,14 @@
 package engine
 
 import (
+	"bytes"
+	"golang.org/x/net/websocket"
 	"io"
+	"log"
+	"net/http"
 	"os"
 	"testing"
+	"time"
 )
 
 func TestNewContext(t *testing.T) {
@@ -36,6 +41,30 @@ func TestContextSetLog(t *testing.T) {
 	}
 }
 
+func TestContextSetTrustedProxies(t *testing.T) {
+	ctx := NewContext()
+	if err := ctx.SetTrustedProxies([]string{"10.0.0.0/8", "::1"}); err != nil {
+		t.Errorf("Expected to set trusted proxies, error encountered: %v", err)
+	}
+	if len(ctx.TrustedProxies()) != 2 {
+		t.Errorf("Expected to have 2 trusted proxies")
+	}
+	if err := ctx.SetTrustedProxies([]string{"10.0.0.0/8", "foo"}); err == nil {
+		t.Errorf("Expected an error for invalid proxy")
+	}
+	if len(ctx.TrustedProxies()) != 2 {
+		t.Errorf("Expected to keep trusted proxies when invalid ones given")
+	}
+	v, _ := ctx.AddVhost("/foo")
+	h := newWebsocketHandler(v, nil)
+	req, _ := http.NewRequest("GET", "/foo", nil)
+	req.RemoteAddr = "10.1.2.3:4321"
+	req.Header.Set("X-Forwarded-For", "1.1.1.1")
+	if ip := h.remoteIp(req); ip != "1.1.1.1" {
+		t.Errorf("Expected handler to use the trusted proxies, got %s", ip)
+	}
+}
+
 func TestContextAddVhost(t *testing.T) {
 	ctx := NewContext()
 	v, err := ctx.AddVhost("/foo")
@@ -172,3 +201,90 @@ func TestContextKill(t *testing.T) {
 		t.Errorf("Expected to close and kill all endpoints")
 	}
 }
+
+func newTestDrainContext(wsAddr, backendAddr string) *Context {
+	ctx := NewContext()
+	ctx.SetLog(log.New(bytes.NewBuffer([]byte{}), "", log.LstdFlags))
+	ctx.NewWebsocketEndpoint(wsAddr)
+	go ctx.websocket.ListenAndServe()
+	ctx.NewBackendEndpoint(backendAddr)
+	go ctx.backend.ListenAndServe()
+	ctx.AddVhost("/foo")
+	for !ctx.websocket.IsAlive() || !ctx.backend.IsAlive() {
+		<-time.After(500 * time.Nanosecond)
+	}
+	return ctx
+}
+
+func TestContextDrain(t *testing.T) {
+	ctx := newTestDrainContext(":9774", ":9775")
+	ws, err := websocket.Dial("ws://127.0.0.1:9774/foo", "ws", "http://127.0.0.1/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var resp map[string]interface{}
+	websocket.JSON.Receive(ws, &resp) // :connected
+	done := make(chan error)
+	go func() {
+		done <- ctx.Drain(2*time.Second, 5*time.Second)
+	}()
+	resp = nil
+	if err = websocket.JSON.Receive(ws, &resp); err != nil {
+		t.Fatal(err)
+	}
+	data, ok := resp[":reconnect"].(map[string]interface{})
+	if !ok || data["delay"] != float64(2000) {
+		t.Errorf("Expected to receive reconnect hint, given %v", resp)
+	}
+	_, err = websocket.Dial("ws://127.0.0.1:9774/foo", "ws", "http://127.0.0.1/")
+	if err == nil {
+		t.Errorf("Expected to reject new connections while draining")
+	}
+	if r, err := http.Get("http://127.0.0.1:9774/foo"); err == nil {
+		r.Body.Close()
+		if r.StatusCode != 503 || r.Header.Get("Retry-After") != "2" {
+			t.Errorf("Expected to suggest retrying after 2s, given %d %v", r.StatusCode, r.Header)
+		}
+	}
+	ws.Close()
+	select {
+	case err = <-done:
+		if err != nil {
+			t.Errorf("Expected to drain without errors, given %v", err)
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatalf("Expected to drain before the deadline")
+	}
+	if ctx.websocket.IsAlive() || ctx.backend.IsAlive() {
+		t.Errorf("Expected to kill all endpoints after draining")
+	}
+}
+
+func TestWebsocketHandlerRetryAfterRoundedUp(t *testing.T) {
+	h := newWebsocketHandler(nil, nil)
+	h.drain(1500 * time.Millisecond)
+	if h.retryAfter() != 2 {
+		t.Errorf("Expected retry after to be rounded up, given %d", h.retryAfter())
+	}
+	h = newWebsocketHandler(nil, nil)
+	h.drain(300 * time.Millisecond)
+	if h.retryAfter() != 1 {
+		t.Errorf("Expected retry after to be at least 1s, given %d", h.retryAfter())
+	}
+}
+
+func TestContextDrainDeadlineExceeded(t *testing.T) {
+	ctx := newTestDrainContext(":9776", ":9777")
+	ws, err := websocket.Dial("ws://127.0.0.1:9776/foo", "ws", "http://127.0.0.1/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ws.Close()
+	err = ctx.Drain(time.Second, 200*time.Millisecond)
+	if err == nil || err.Error() != "drain deadline exceeded" {
+		t.Errorf("Expected to exceed the drain deadline")
+	}
+	if ctx.websocket.IsAlive() {
+		t.Errorf("Expected to kill websocket endpoint after deadline")
+	}
+}
@@ -0,0 +1,141 @@
+// Copyright (C) 2011 by Krzysztof Kowalik <chris@nu7hat.ch>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package engine
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// Maximum number of messages waiting to be written to the event stream.
+const eventStreamQueueSize = 256
+
+// eventStreamTransport implements a server-sent events fallback transport.
+// Messages sent to the client are queued and written to the event stream
+// by the stream's request handler. The client sends its messages with
+// separate HTTP POST requests.
+type eventStreamTransport struct {
+	// Messages waiting to be written to the stream.
+	queue chan interface{}
+	// Closed when the transport is terminated.
+	done chan bool
+	// Whether the transport is closed or not.
+	closed bool
+	// Internal semaphore.
+	mtx sync.Mutex
+}
+
+// Internal constructor
+// -----------------------------------------------------------------------------
+
+// newEventStreamTransport creates new server-sent events transport.
+//
+// Returns new transport.
+func newEventStreamTransport() *eventStreamTransport {
+	return &eventStreamTransport{
+		queue: make(chan interface{}, eventStreamQueueSize),
+		done:  make(chan bool),
+	}
+}
+
+// Internal
+// -----------------------------------------------------------------------------
+
+// isEventStreamRequest returns whether given request asks for an event
+// stream or not.
+//
+// req - The request to be checked.
+//
+func isEventStreamRequest(req *http.Request) bool {
+	return req.Method == "GET" &&
+		strings.Contains(req.Header.Get("Accept"), "text/event-stream")
+}
+
+// send queues given payload to be written to the stream. Threadsafe,
+// called from connection's Send function.
+//
+// payload - The data to be sent.
+//
+// Returns an error if transport is closed or its queue is full.
+func (t *eventStreamTransport) send(payload interface{}) error {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+	if t.closed {
+		return errors.New("transport closed")
+	}
+	select {
+	case t.queue <- payload:
+		return nil
+	default:
+	}
+	return errors.New("queue full")
+}
+
+// close terminates the transport, what makes the stream's handler
+// to finish the response. Threadsafe, called from connection's Kill
+// function.
+func (t *eventStreamTransport) close() {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+	if !t.closed {
+		t.closed = true
+		close(t.done)
+	}
+}
+
+// stream writes queued messages to the client as long as the transport
+// is open and the client is connected. Each message is written as
+// a single event containing the JSON encoded payload, exactly the same
+// as the websocket frames.
+//
+// w - The response writer of the stream request.
+//
+// Returns an error if the stream can't be written.
+func (t *eventStreamTransport) stream(w http.ResponseWriter) error {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		return errors.New("streaming not supported")
+	}
+	var gone <-chan bool
+	if cn, ok := w.(http.CloseNotifier); ok {
+		gone = cn.CloseNotify()
+	}
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+	for {
+		select {
+		case payload := <-t.queue:
+			data, err := json.Marshal(payload)
+			if err != nil {
+				continue
+			}
+			if _, err = fmt.Fprintf(w, "data: %s\n\n", data); err != nil {
+				return err
+			}
+			flusher.Flush()
+		case <-t.done:
+			return nil
+		case <-gone:
+			return nil
+		}
+	}
+}
@@ -0,0 +1,151 @@
+// Copyright (C) 2011 by Krzysztof Kowalik <chris@nu7hat.ch>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package engine
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// LogLevel represents a severity of the log entry.
+type LogLevel int
+
+// Possible log levels.
+const (
+	LogDebug LogLevel = iota
+	LogInfo
+	LogWarning
+	LogError
+)
+
+// The default log level.
+const DefaultLogLevel = LogInfo
+
+// Names of the log levels.
+var logLevelNames = []string{"debug", "info", "warning", "error"}
+
+// logEntry represents a single structured log entry. Entries are written
+// in the logfmt format, eg:
+//
+//     time=2012-02-20T10:00:00Z level=info component=websocket vhost=/foo
+//     sid=4f1c...6e0a uid=joe event=subscribe code=202 status=Subscribed
+//
+type logEntry struct {
+	// Severity of the entry.
+	level LogLevel
+	// Name of the logging component (eg. websocket, backend or admin).
+	component string
+	// Path of the related vhost.
+	vhost string
+	// Related session id.
+	sid string
+	// Related user id.
+	uid string
+	// Handled event or command name.
+	event string
+	// Status of the handled operation.
+	status *Status
+	// Additional message or payload.
+	msg string
+}
+
+// Internal
+// -----------------------------------------------------------------------------
+
+// logLevelForStatus returns log level appropriate for the given status.
+// Information statuses (3xx) are logged only in debug mode, client errors
+// (4xx) as warnings and internal errors (5xx) as errors.
+//
+// s - The status to be checked.
+//
+// Returns matching log level.
+func logLevelForStatus(s *Status) LogLevel {
+	switch {
+	case s == nil:
+		return LogInfo
+	case s.Code >= 500:
+		return LogError
+	case s.Code >= 400:
+		return LogWarning
+	case s.Code >= 300:
+		return LogDebug
+	}
+	return LogInfo
+}
+
+// logfmtValue quotes given value if necessary.
+//
+// value - The value to be quoted.
+//
+// Returns value ready to be put into the logfmt line.
+func logfmtValue(value string) string {
+	if value == "" || strings.ContainsAny(value, " =\"\t\n") {
+		return strconv.Quote(value)
+	}
+	return value
+}
+
+// String returns the log entry encoded in the logfmt format. Empty fields
+// are omitted.
+func (e *logEntry) String() string {
+	fields := []string{
+		"time=" + time.Now().UTC().Format(time.RFC3339),
+		"level=" + e.level.String(),
+	}
+	add := func(key, value string) {
+		if value != "" {
+			fields = append(fields, key+"="+logfmtValue(value))
+		}
+	}
+	add("component", e.component)
+	add("vhost", e.vhost)
+	add("sid", e.sid)
+	add("uid", e.uid)
+	add("event", e.event)
+	if e.status != nil {
+		add("code", strconv.Itoa(e.status.Code))
+		add("status", e.status.Status)
+	}
+	add("msg", e.msg)
+	return strings.Join(fields, " ")
+}
+
+// Exported
+// -----------------------------------------------------------------------------
+
+// ParseLogLevel converts given name into the log level.
+//
+// name - The name of the level, one of: debug, info, warning or error.
+//
+// Returns the log level or an error if the name is invalid.
+func ParseLogLevel(name string) (LogLevel, error) {
+	for i, levelName := range logLevelNames {
+		if levelName == strings.ToLower(name) {
+			return LogLevel(i), nil
+		}
+	}
+	return DefaultLogLevel, errors.New("invalid log level")
+}
+
+// String returns name of the log level.
+func (l LogLevel) String() string {
+	if l < LogDebug || int(l) >= len(logLevelNames) {
+		return "unknown"
+	}
+	return logLevelNames[l]
+}
@@ -0,0 +1,106 @@
+// Copyright (C) 2011 by Krzysztof Kowalik <chris@nu7hat.ch>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package engine
+
+import (
+	"bytes"
+	"log"
+	"strings"
+	"testing"
+)
+
+func TestParseLogLevel(t *testing.T) {
+	for name, expected := range map[string]LogLevel{
+		"debug":   LogDebug,
+		"info":    LogInfo,
+		"WARNING": LogWarning,
+		"error":   LogError,
+	} {
+		level, err := ParseLogLevel(name)
+		if err != nil || level != expected {
+			t.Errorf("Expected to parse '%s' log level", name)
+		}
+	}
+	if _, err := ParseLogLevel("verbose"); err == nil {
+		t.Errorf("Expected an error while parsing invalid log level")
+	}
+}
+
+func TestLogEntryString(t *testing.T) {
+	e := &logEntry{
+		level:     LogWarning,
+		component: "websocket",
+		vhost:     "/foo",
+		sid:       "123",
+		event:     "subscribe",
+		status:    &Status{"Bad request", 451},
+		msg:       `{"subscribe":{}}`,
+	}
+	line := e.String()
+	for _, field := range []string{
+		"level=warning",
+		"component=websocket",
+		"vhost=/foo",
+		"sid=123",
+		"event=subscribe",
+		"code=451",
+		`status="Bad request"`,
+		`msg="{\"subscribe\":{}}"`,
+	} {
+		if !strings.Contains(line, field) {
+			t.Errorf("Expected log entry to contain '%s', given '%s'", field, line)
+		}
+	}
+	if strings.Contains(line, "uid=") {
+		t.Errorf("Expected to omit empty fields, given '%s'", line)
+	}
+}
+
+func TestContextWriteLogWithLevels(t *testing.T) {
+	var buf bytes.Buffer
+	ctx := NewContext()
+	ctx.SetLog(log.New(&buf, "", 0))
+	v, _ := newVhost(ctx, "/foo")
+	ctx.writeLog(v, &logEntry{level: LogDebug, msg: "hidden"})
+	if buf.Len() != 0 {
+		t.Errorf("Expected to skip entries below the global log level")
+	}
+	v.SetLogLevel(LogDebug)
+	ctx.writeLog(v, &logEntry{level: LogDebug, msg: "visible"})
+	if !strings.Contains(buf.String(), "vhost=/foo") {
+		t.Errorf("Expected vhost log level to take precedence over the global one")
+	}
+	buf.Reset()
+	v.ResetLogLevel()
+	ctx.SetLogLevel(LogError)
+	ctx.writeLog(v, &logEntry{level: LogWarning, msg: "hidden"})
+	ctx.writeLog(nil, &logEntry{level: LogError, msg: "visible"})
+	if line := buf.String(); strings.Contains(line, "hidden") || !strings.Contains(line, "visible") {
+		t.Errorf("Expected to log only entries of enabled levels, given '%s'", line)
+	}
+}
+
+func TestContextWriteLog(t *testing.T) {
+	var buf bytes.Buffer
+	ctx := NewContext()
+	ctx.SetLog(log.New(&buf, "", 0))
+	ctx.WriteLog(LogDebug, "server", "hidden")
+	ctx.WriteLog(LogError, "server", "reload failed")
+	line := buf.String()
+	if strings.Contains(line, "hidden") || !strings.Contains(line, `component=server msg="reload failed"`) {
+		t.Errorf("Expected to log the component's message, given '%s'", line)
+	}
+}
@@ -0,0 +1,181 @@
+// Copyright (C) 2011 by Krzysztof Kowalik <chris@nu7hat.ch>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package engine
+
+import (
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	// Maximum number of messages waiting for the next poll.
+	longPollingQueueSize = 256
+	// Maximum time the poll request waits for the messages.
+	longPollingTimeout = 25 * time.Second
+	// Session expires when not polled for that long.
+	longPollingSessionTimeout = 60 * time.Second
+)
+
+// longPollingTransport implements a long-polling fallback transport.
+// Messages sent to the client are queued until the client polls for them.
+// Poll request waits until any message is available or the timeout passes.
+// The client sends its messages with separate HTTP POST requests.
+type longPollingTransport struct {
+	// Messages waiting for the next poll.
+	queue []interface{}
+	// Signaled when a new message has been queued.
+	ready chan bool
+	// Closed when the transport is terminated.
+	done chan bool
+	// Whether the transport is closed or not.
+	closed bool
+	// Expires the session when the client stops polling.
+	expire *time.Timer
+	// Serializes poll requests.
+	pmtx sync.Mutex
+	// Internal semaphore.
+	mtx sync.Mutex
+}
+
+// Internal constructor
+// -----------------------------------------------------------------------------
+
+// newLongPollingTransport creates new long-polling transport.
+//
+// Returns new transport.
+func newLongPollingTransport() *longPollingTransport {
+	return &longPollingTransport{
+		queue: make([]interface{}, 0),
+		ready: make(chan bool, 1),
+		done:  make(chan bool),
+	}
+}
+
+// Internal
+// -----------------------------------------------------------------------------
+
+// isLongPollingRequest returns whether given request asks for the
+// long-polling transport or not.
+//
+// req - The request to be checked.
+//
+func isLongPollingRequest(req *http.Request) bool {
+	return req.Method == "GET" && req.URL.Query().Get("transport") == "polling"
+}
+
+// send queues given payload to be delivered with the next poll. Threadsafe,
+// called from connection's Send function.
+//
+// payload - The data to be sent.
+//
+// Returns an error if transport is closed or its queue is full.
+func (t *longPollingTransport) send(payload interface{}) error {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+	if t.closed {
+		return errors.New("transport closed")
+	}
+	if len(t.queue) >= longPollingQueueSize {
+		return errors.New("queue full")
+	}
+	t.queue = append(t.queue, payload)
+	select {
+	case t.ready <- true:
+	default:
+	}
+	return nil
+}
+
+// close terminates the transport, cancels the session expiration and wakes
+// up the pending poll. Threadsafe, called from connection's Kill function.
+func (t *longPollingTransport) close() {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+	if !t.closed {
+		t.closed = true
+		close(t.done)
+		if t.expire != nil {
+			t.expire.Stop()
+		}
+	}
+}
+
+// expireAfter schedules given callback to be called when the client
+// doesn't poll for the specified time. Nothing is scheduled when the
+// transport has been closed already. Called only once when the session
+// is created, before the client gets to know its id.
+//
+// d  - Maximum time between the polls.
+// fn - The expiration callback.
+//
+func (t *longPollingTransport) expireAfter(d time.Duration, fn func()) {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+	if !t.closed {
+		t.expire = time.AfterFunc(d, fn)
+	}
+}
+
+// poll takes all the queued messages. If there's nothing in the queue,
+// then waits until a message arrives, the timeout passes, the transport
+// gets closed or the client goes away. Threadsafe, polls of the same
+// session are serialized.
+//
+// timeout - Maximum time to wait for the messages.
+// gone    - Signaled when the client goes away, may be nil.
+//
+// Returns list of messages, empty if nothing arrived in time.
+func (t *longPollingTransport) poll(timeout time.Duration, gone <-chan bool) []interface{} {
+	t.pmtx.Lock()
+	defer t.pmtx.Unlock()
+	if t.expire != nil {
+		// Session can't expire while being polled.
+		t.expire.Stop()
+		defer func() {
+			if !t.isClosed() {
+				t.expire.Reset(longPollingSessionTimeout)
+			}
+		}()
+	}
+	deadline := time.After(timeout)
+	for {
+		t.mtx.Lock()
+		if len(t.queue) > 0 || t.closed {
+			queue := t.queue
+			t.queue = make([]interface{}, 0)
+			t.mtx.Unlock()
+			return queue
+		}
+		t.mtx.Unlock()
+		select {
+		case <-t.ready:
+		case <-t.done:
+		case <-gone:
+			return []interface{}{}
+		case <-deadline:
+			return []interface{}{}
+		}
+	}
+}
+
+// isClosed returns whether the transport is closed or not. Threadsafe.
+func (t *longPollingTransport) isClosed() bool {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+	return t.closed
+}
@@ -0,0 +1,85 @@
+// Copyright (C) 2011 by Krzysztof Kowalik <chris@nu7hat.ch>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package engine
+
+import (
+	"testing"
+	"time"
+)
+
+func TestLongPollingTransportPoll(t *testing.T) {
+	tr := newLongPollingTransport()
+	if msgs := tr.poll(10*time.Millisecond, nil); len(msgs) != 0 {
+		t.Errorf("Expected empty poll after timeout, given %v", msgs)
+	}
+	tr.send("foo")
+	tr.send("bar")
+	if msgs := tr.poll(time.Second, nil); len(msgs) != 2 {
+		t.Errorf("Expected to poll all queued messages, given %v", msgs)
+	}
+	go func() {
+		<-time.After(10 * time.Millisecond)
+		tr.send("baz")
+	}()
+	if msgs := tr.poll(time.Second, nil); len(msgs) != 1 || msgs[0] != "baz" {
+		t.Errorf("Expected to wait for the message, given %v", msgs)
+	}
+}
+
+func TestLongPollingTransportQueueLimit(t *testing.T) {
+	tr := newLongPollingTransport()
+	for i := 0; i < longPollingQueueSize; i += 1 {
+		if err := tr.send(i); err != nil {
+			t.Fatalf("Expected to queue the message, given %v", err)
+		}
+	}
+	if err := tr.send("overflow"); err == nil {
+		t.Errorf("Expected an error when the queue is full")
+	}
+}
+
+func TestLongPollingTransportClose(t *testing.T) {
+	tr := newLongPollingTransport()
+	expired := make(chan bool, 1)
+	tr.expireAfter(20*time.Millisecond, func() { expired <- true })
+	go func() {
+		<-time.After(10 * time.Millisecond)
+		tr.close()
+	}()
+	if msgs := tr.poll(time.Second, nil); len(msgs) != 0 {
+		t.Errorf("Expected empty poll after close, given %v", msgs)
+	}
+	if err := tr.send("foo"); err == nil {
+		t.Errorf("Expected to not send via closed transport")
+	}
+	select {
+	case <-expired:
+		t.Errorf("Expected to cancel the expiration of closed transport")
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestLongPollingTransportExpireAfterClose(t *testing.T) {
+	tr := newLongPollingTransport()
+	tr.close()
+	expired := make(chan bool, 1)
+	tr.expireAfter(10*time.Millisecond, func() { expired <- true })
+	select {
+	case <-expired:
+		t.Errorf("Expected not to expire already closed transport")
+	case <-time.After(30 * time.Millisecond):
+	}
+}
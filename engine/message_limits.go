@@ -0,0 +1,115 @@
+// Copyright (C) 2011 by Krzysztof Kowalik <chris@nu7hat.ch>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package engine
+
+import "errors"
+
+// Errors returned when the message exceeds the limits.
+var (
+	errMessageTooLarge = errors.New("message too large")
+	errMessageTooDeep  = errors.New("message too deep")
+	errTooManyKeys     = errors.New("too many keys")
+)
+
+// MessageLimits specifies limits of the messages received from the
+// websocket clients and backend connections. Zero means no limit.
+type MessageLimits struct {
+	// Maximum size of the message in bytes.
+	MaxSize int
+	// Maximum nesting depth of the JSON data, the message itself is
+	// the first level.
+	MaxDepth int
+	// Maximum number of keys in the JSON data, counted at all levels.
+	MaxKeys int
+}
+
+// Internal
+// -----------------------------------------------------------------------------
+
+// maxSize returns the message size limit, zero if not limited. Can be
+// called on nil limits.
+func (l *MessageLimits) maxSize() int {
+	if l == nil {
+		return 0
+	}
+	return l.MaxSize
+}
+
+// check scans given JSON data and verifies that it doesn't exceed
+// the size, depth and keys limits. It doesn't validate the JSON syntax,
+// so it's cheap enough to be run before decoding the data. Can be called
+// on nil limits.
+//
+// data - The raw JSON data to be checked.
+//
+// Returns an error if any limit has been exceeded.
+func (l *MessageLimits) check(data []byte) error {
+	if l == nil {
+		return nil
+	}
+	if l.MaxSize > 0 && len(data) > l.MaxSize {
+		return errMessageTooLarge
+	}
+	if l.MaxDepth <= 0 && l.MaxKeys <= 0 {
+		return nil
+	}
+	depth, keys, inString, escaped := 0, 0, false, false
+	for _, b := range data {
+		if inString {
+			switch {
+			case escaped:
+				escaped = false
+			case b == '\\':
+				escaped = true
+			case b == '"':
+				inString = false
+			}
+			continue
+		}
+		switch b {
+		case '"':
+			inString = true
+		case '{', '[':
+			if depth += 1; l.MaxDepth > 0 && depth > l.MaxDepth {
+				return errMessageTooDeep
+			}
+		case '}', ']':
+			depth -= 1
+		case ':':
+			if keys += 1; l.MaxKeys > 0 && keys > l.MaxKeys {
+				return errTooManyKeys
+			}
+		}
+	}
+	return nil
+}
+
+// messageLimitStatus converts the message limit error into the status.
+//
+// err - The error to be converted.
+//
+// Returns the status or nil if it's not a message limit error.
+func messageLimitStatus(err error) *Status {
+	switch err {
+	case errMessageTooLarge:
+		return &Status{"Message too large", 460}
+	case errMessageTooDeep:
+		return &Status{"Message too deep", 461}
+	case errTooManyKeys:
+		return &Status{"Too many keys", 462}
+	}
+	return nil
+}
@@ -0,0 +1,53 @@
+// Copyright (C) 2011 by Krzysztof Kowalik <chris@nu7hat.ch>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package engine
+
+import "testing"
+
+func TestMessageLimitsCheck(t *testing.T) {
+	l := &MessageLimits{MaxSize: 64, MaxDepth: 3, MaxKeys: 3}
+	for data, expected := range map[string]error{
+		`{"a": {"b": [1, 2]}}`:                      nil,
+		`{"a": {"b": [[1]]}}`:                       errMessageTooDeep,
+		`{"a": 1, "b": 2, "c": 3, "d": 4}`:          errTooManyKeys,
+		`{"a": "{{{{ :::: [[[["}`:                   nil,
+		`{"a": "\"{{{{\" :::"}`:                     nil,
+		`{"a": "` + string(make([]byte, 64)) + `"}`: errMessageTooLarge,
+	} {
+		if err := l.check([]byte(data)); err != expected {
+			t.Errorf("Expected check of %s to return %v, got %v", data, expected, err)
+		}
+	}
+	var nl *MessageLimits
+	if nl.check([]byte(`{"a": {"b": {}}}`)) != nil || nl.maxSize() != 0 {
+		t.Errorf("Expected nil limits to allow everything")
+	}
+}
+
+func TestMessageLimitStatus(t *testing.T) {
+	for err, code := range map[error]int{
+		errMessageTooLarge: 460,
+		errMessageTooDeep:  461,
+		errTooManyKeys:     462,
+	} {
+		if s := messageLimitStatus(err); s == nil || s.Code != code {
+			t.Errorf("Expected %v to be converted to %d status", err, code)
+		}
+	}
+	if messageLimitStatus(nil) != nil {
+		t.Errorf("Expected no status for other errors")
+	}
+}
@@ -0,0 +1,458 @@
+// Copyright (C) 2011 by Krzysztof Kowalik <chris@nu7hat.ch>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package engine
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"math"
+	"reflect"
+)
+
+// Maximum nesting depth of the decoded data when not limited otherwise,
+// protects the recursive decoder from exhausting the stack.
+const msgpackMaxDepth = 64
+
+// Errors returned by the MessagePack decoder.
+var (
+	errMsgpackTruncated   = errors.New("msgpack: unexpected end of data")
+	errMsgpackInvalidType = errors.New("msgpack: unsupported type")
+	errMsgpackInvalidKey  = errors.New("msgpack: map key is not a string")
+)
+
+// msgpackEncoder implements a minimal MessagePack encoder, supporting
+// only the types which can be represented in JSON.
+type msgpackEncoder struct {
+	// The encoded data.
+	buf []byte
+}
+
+// msgpackDecoder implements a minimal MessagePack decoder. Decoded values
+// have the same types as the ones produced by the JSON decoder, so
+// the messages are handled the same way regardless of the encoding.
+type msgpackDecoder struct {
+	// The data to be decoded.
+	data []byte
+	// Current position.
+	pos int
+	// Limits to be checked while decoding, may be nil.
+	limits *MessageLimits
+	// Number of the decoded map keys.
+	keys int
+}
+
+// Internal
+// -----------------------------------------------------------------------------
+
+// msgpackMarshal encodes given value with MessagePack.
+//
+// v - The value to be encoded.
+//
+// Returns encoded data or an error if something went wrong.
+func msgpackMarshal(v interface{}) ([]byte, error) {
+	e := &msgpackEncoder{buf: make([]byte, 0, 128)}
+	if err := e.encode(reflect.ValueOf(v)); err != nil {
+		return nil, err
+	}
+	return e.buf, nil
+}
+
+// msgpackUnmarshal decodes given MessagePack data checking the depth
+// and keys limits on the way.
+//
+// data   - The data to be decoded.
+// limits - The limits to be checked, may be nil.
+//
+// Returns decoded value or an error if something went wrong.
+func msgpackUnmarshal(data []byte, limits *MessageLimits) (interface{}, error) {
+	d := &msgpackDecoder{data: data, limits: limits}
+	v, err := d.decode(1)
+	if err == nil && d.pos != len(d.data) {
+		err = errors.New("msgpack: trailing data")
+	}
+	return v, err
+}
+
+// encode appends given value to the buffer. Values of the types not
+// supported directly are encoded via their JSON representation.
+//
+// v - The value to be encoded.
+//
+// Returns an error if something went wrong.
+func (e *msgpackEncoder) encode(v reflect.Value) error {
+	if !v.IsValid() {
+		e.buf = append(e.buf, 0xc0)
+		return nil
+	}
+	if m, ok := v.Interface().(json.Marshaler); ok {
+		return e.encodeJSON(m)
+	}
+	switch v.Kind() {
+	case reflect.Interface, reflect.Ptr:
+		if v.IsNil() {
+			e.buf = append(e.buf, 0xc0)
+			return nil
+		}
+		return e.encode(v.Elem())
+	case reflect.Bool:
+		if v.Bool() {
+			e.buf = append(e.buf, 0xc3)
+		} else {
+			e.buf = append(e.buf, 0xc2)
+		}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		e.encodeInt(v.Int())
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		e.encodeUint(v.Uint())
+	case reflect.Float32, reflect.Float64:
+		e.encodeFloat(v.Float())
+	case reflect.String:
+		e.encodeString(v.String())
+	case reflect.Slice, reflect.Array:
+		if v.Kind() == reflect.Slice && v.IsNil() {
+			e.buf = append(e.buf, 0xc0)
+			return nil
+		}
+		e.encodeHeader(v.Len(), 0x90, 0xdc, 0xdd, 16)
+		for i := 0; i < v.Len(); i += 1 {
+			if err := e.encode(v.Index(i)); err != nil {
+				return err
+			}
+		}
+	case reflect.Map:
+		if v.Type().Key().Kind() != reflect.String {
+			return e.encodeJSON(v.Interface())
+		}
+		if v.IsNil() {
+			e.buf = append(e.buf, 0xc0)
+			return nil
+		}
+		e.encodeHeader(v.Len(), 0x80, 0xde, 0xdf, 16)
+		for _, key := range v.MapKeys() {
+			e.encodeString(key.String())
+			if err := e.encode(v.MapIndex(key)); err != nil {
+				return err
+			}
+		}
+	default:
+		return e.encodeJSON(v.Interface())
+	}
+	return nil
+}
+
+// encodeJSON encodes given value via its JSON representation, used for
+// structs and values implementing their own JSON marshalling.
+//
+// v - The value to be encoded.
+//
+// Returns an error if something went wrong.
+func (e *msgpackEncoder) encodeJSON(v interface{}) error {
+	var generic interface{}
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	if err = json.Unmarshal(data, &generic); err != nil {
+		return err
+	}
+	return e.encode(reflect.ValueOf(generic))
+}
+
+// encodeHeader appends the header of a string, array or map.
+//
+// n     - Length of the value.
+// fix   - The fix type prefix.
+// pre16 - Prefix of the type with 16-bit length.
+// pre32 - Prefix of the type with 32-bit length.
+// max   - Maximum length which fits in the fix type.
+//
+func (e *msgpackEncoder) encodeHeader(n int, fix, pre16, pre32 byte, max int) {
+	switch {
+	case n < max:
+		e.buf = append(e.buf, fix|byte(n))
+	case n <= math.MaxUint16:
+		e.buf = append(e.buf, pre16, byte(n>>8), byte(n))
+	default:
+		e.buf = append(e.buf, pre32, byte(n>>24), byte(n>>16), byte(n>>8), byte(n))
+	}
+}
+
+// encodeString appends given string.
+func (e *msgpackEncoder) encodeString(s string) {
+	if len(s) < 32 {
+		e.buf = append(e.buf, 0xa0|byte(len(s)))
+	} else if len(s) <= math.MaxUint8 {
+		e.buf = append(e.buf, 0xd9, byte(len(s)))
+	} else {
+		e.encodeHeader(len(s), 0xa0, 0xda, 0xdb, 0)
+	}
+	e.buf = append(e.buf, s...)
+}
+
+// encodeInt appends given signed integer in the shortest form.
+func (e *msgpackEncoder) encodeInt(n int64) {
+	if n >= 0 {
+		e.encodeUint(uint64(n))
+		return
+	}
+	switch {
+	case n >= -32:
+		e.buf = append(e.buf, byte(n))
+	case n >= math.MinInt8:
+		e.buf = append(e.buf, 0xd0, byte(n))
+	case n >= math.MinInt16:
+		e.buf = append(e.buf, 0xd1, byte(n>>8), byte(n))
+	case n >= math.MinInt32:
+		e.buf = append(e.buf, 0xd2, byte(n>>24), byte(n>>16), byte(n>>8), byte(n))
+	default:
+		e.buf = append(e.buf, 0xd3)
+		e.buf = appendUint64(e.buf, uint64(n))
+	}
+}
+
+// encodeUint appends given unsigned integer in the shortest form.
+func (e *msgpackEncoder) encodeUint(n uint64) {
+	switch {
+	case n <= 0x7f:
+		e.buf = append(e.buf, byte(n))
+	case n <= math.MaxUint8:
+		e.buf = append(e.buf, 0xcc, byte(n))
+	case n <= math.MaxUint16:
+		e.buf = append(e.buf, 0xcd, byte(n>>8), byte(n))
+	case n <= math.MaxUint32:
+		e.buf = append(e.buf, 0xce, byte(n>>24), byte(n>>16), byte(n>>8), byte(n))
+	default:
+		e.buf = append(e.buf, 0xcf)
+		e.buf = appendUint64(e.buf, n)
+	}
+}
+
+// encodeFloat appends given float, integral values are encoded
+// as integers since JSON doesn't distinguish them either.
+func (e *msgpackEncoder) encodeFloat(f float64) {
+	if f == math.Trunc(f) && f >= math.MinInt64 && f <= math.MaxInt64 {
+		e.encodeInt(int64(f))
+		return
+	}
+	e.buf = append(e.buf, 0xcb)
+	e.buf = appendUint64(e.buf, math.Float64bits(f))
+}
+
+// appendUint64 appends given number in the big endian order.
+func appendUint64(buf []byte, n uint64) []byte {
+	var b [8]byte
+	binary.BigEndian.PutUint64(b[:], n)
+	return append(buf, b[:]...)
+}
+
+// next takes n bytes from the data.
+//
+// n - Number of bytes to take.
+//
+// Returns taken bytes or an error if there's not enough data.
+func (d *msgpackDecoder) next(n int) ([]byte, error) {
+	if n < 0 || len(d.data)-d.pos < n {
+		return nil, errMsgpackTruncated
+	}
+	b := d.data[d.pos : d.pos+n]
+	d.pos += n
+	return b, nil
+}
+
+// uint reads a big endian unsigned integer of the specified size.
+//
+// n - Size of the integer in bytes.
+//
+func (d *msgpackDecoder) uint(n int) (uint64, error) {
+	b, err := d.next(n)
+	if err != nil {
+		return 0, err
+	}
+	var x uint64
+	for _, c := range b {
+		x = x<<8 | uint64(c)
+	}
+	return x, nil
+}
+
+// decode reads a single value at the specified nesting depth.
+//
+// depth - Depth of the value, top level value has depth of one.
+//
+// Returns decoded value or an error if something went wrong.
+func (d *msgpackDecoder) decode(depth int) (interface{}, error) {
+	b, err := d.next(1)
+	if err != nil {
+		return nil, err
+	}
+	c := b[0]
+	switch {
+	case c <= 0x7f:
+		return float64(c), nil
+	case c >= 0xe0:
+		return float64(int8(c)), nil
+	case c&0xf0 == 0x80:
+		return d.decodeMap(int(c&0x0f), depth)
+	case c&0xf0 == 0x90:
+		return d.decodeArray(int(c&0x0f), depth)
+	case c&0xe0 == 0xa0:
+		return d.decodeString(int(c & 0x1f))
+	}
+	switch c {
+	case 0xc0:
+		return nil, nil
+	case 0xc2:
+		return false, nil
+	case 0xc3:
+		return true, nil
+	case 0xc4, 0xd9:
+		n, err := d.uint(1)
+		if err != nil {
+			return nil, err
+		}
+		return d.decodeString(int(n))
+	case 0xc5, 0xda:
+		n, err := d.uint(2)
+		if err != nil {
+			return nil, err
+		}
+		return d.decodeString(int(n))
+	case 0xc6, 0xdb:
+		n, err := d.uint(4)
+		if err != nil {
+			return nil, err
+		}
+		return d.decodeString(int(n))
+	case 0xca:
+		n, err := d.uint(4)
+		return float64(math.Float32frombits(uint32(n))), err
+	case 0xcb:
+		n, err := d.uint(8)
+		return math.Float64frombits(n), err
+	case 0xcc, 0xcd, 0xce, 0xcf:
+		n, err := d.uint(1 << (c - 0xcc))
+		return float64(n), err
+	case 0xd0:
+		n, err := d.uint(1)
+		return float64(int8(n)), err
+	case 0xd1:
+		n, err := d.uint(2)
+		return float64(int16(n)), err
+	case 0xd2:
+		n, err := d.uint(4)
+		return float64(int32(n)), err
+	case 0xd3:
+		n, err := d.uint(8)
+		return float64(int64(n)), err
+	case 0xdc, 0xde:
+		n, err := d.uint(2)
+		if err != nil {
+			return nil, err
+		}
+		if c == 0xdc {
+			return d.decodeArray(int(n), depth)
+		}
+		return d.decodeMap(int(n), depth)
+	case 0xdd, 0xdf:
+		n, err := d.uint(4)
+		if err != nil {
+			return nil, err
+		}
+		if c == 0xdd {
+			return d.decodeArray(int(n), depth)
+		}
+		return d.decodeMap(int(n), depth)
+	}
+	return nil, errMsgpackInvalidType
+}
+
+// maxDepth returns the nesting depth allowed by the limits, never more
+// than the hard maximum.
+func (d *msgpackDecoder) maxDepth() int {
+	if d.limits != nil && d.limits.MaxDepth > 0 && d.limits.MaxDepth < msgpackMaxDepth {
+		return d.limits.MaxDepth
+	}
+	return msgpackMaxDepth
+}
+
+// decodeString reads a string (or binary) of the specified length.
+func (d *msgpackDecoder) decodeString(n int) (interface{}, error) {
+	b, err := d.next(n)
+	if err != nil {
+		return nil, err
+	}
+	return string(b), nil
+}
+
+// decodeArray reads an array of the specified length.
+//
+// n     - Number of the elements.
+// depth - Depth of the array.
+//
+// Returns decoded array or an error if something went wrong.
+func (d *msgpackDecoder) decodeArray(n int, depth int) (interface{}, error) {
+	if depth > d.maxDepth() {
+		return nil, errMessageTooDeep
+	}
+	if n > len(d.data)-d.pos {
+		// Each element takes at least one byte.
+		return nil, errMsgpackTruncated
+	}
+	a := make([]interface{}, n)
+	for i := range a {
+		var err error
+		if a[i], err = d.decode(depth + 1); err != nil {
+			return nil, err
+		}
+	}
+	return a, nil
+}
+
+// decodeMap reads a map of the specified size. Only string keys are
+// supported.
+//
+// n     - Number of the entries.
+// depth - Depth of the map.
+//
+// Returns decoded map or an error if something went wrong.
+func (d *msgpackDecoder) decodeMap(n int, depth int) (interface{}, error) {
+	if depth > d.maxDepth() {
+		return nil, errMessageTooDeep
+	}
+	if d.keys += n; d.limits != nil && d.limits.MaxKeys > 0 && d.keys > d.limits.MaxKeys {
+		return nil, errTooManyKeys
+	}
+	if n > (len(d.data)-d.pos)/2 {
+		// Each entry takes at least two bytes.
+		return nil, errMsgpackTruncated
+	}
+	m := make(map[string]interface{}, n)
+	for i := 0; i < n; i += 1 {
+		key, err := d.decode(depth + 1)
+		if err != nil {
+			return nil, err
+		}
+		skey, ok := key.(string)
+		if !ok {
+			return nil, errMsgpackInvalidKey
+		}
+		if m[skey], err = d.decode(depth + 1); err != nil {
+			return nil, err
+		}
+	}
+	return m, nil
+}
@@ -0,0 +1,107 @@
+// Copyright (C) 2011 by Krzysztof Kowalik <chris@nu7hat.ch>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package engine
+
+import (
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestMsgpackRoundTrip(t *testing.T) {
+	long := strings.Repeat("x", 300)
+	payload := map[string]interface{}{
+		"nil":    nil,
+		"bool":   true,
+		"small":  7,
+		"neg":    -100,
+		"big":    uint64(1) << 40,
+		"float":  1.5,
+		"string": "hello",
+		"long":   long,
+		"list":   []string{"a", "b"},
+		"map":    map[string]int{"x": 1},
+		"status": &Status{"OK", 200},
+	}
+	data, err := msgpackMarshal(payload)
+	if err != nil {
+		t.Fatalf("Expected to encode the payload, got %v", err)
+	}
+	decoded, err := msgpackUnmarshal(data, nil)
+	if err != nil {
+		t.Fatalf("Expected to decode the payload, got %v", err)
+	}
+	expected := map[string]interface{}{
+		"nil":    nil,
+		"bool":   true,
+		"small":  float64(7),
+		"neg":    float64(-100),
+		"big":    float64(uint64(1) << 40),
+		"float":  1.5,
+		"string": "hello",
+		"long":   long,
+		"list":   []interface{}{"a", "b"},
+		"map":    map[string]interface{}{"x": float64(1)},
+		"status": map[string]interface{}{"Status": "OK", "Code": float64(200)},
+	}
+	if !reflect.DeepEqual(decoded, expected) {
+		t.Errorf("Expected to decode %v, got %v", expected, decoded)
+	}
+}
+
+func TestMsgpackUnmarshalLimits(t *testing.T) {
+	l := &MessageLimits{MaxDepth: 3, MaxKeys: 3}
+	for _, x := range []struct {
+		payload  interface{}
+		expected error
+	}{
+		{map[string]interface{}{"a": map[string]interface{}{"b": []int{1}}}, nil},
+		{map[string]interface{}{"a": map[string]interface{}{"b": [][]int{{1}}}}, errMessageTooDeep},
+		{map[string]int{"a": 1, "b": 2, "c": 3, "d": 4}, errTooManyKeys},
+	} {
+		data, _ := msgpackMarshal(x.payload)
+		if _, err := msgpackUnmarshal(data, l); err != x.expected {
+			t.Errorf("Expected decoding of %v to return %v, got %v", x.payload, x.expected, err)
+		}
+	}
+}
+
+func TestMsgpackUnmarshalInvalidData(t *testing.T) {
+	for _, data := range [][]byte{
+		{},
+		{0x82, 0xa1, 'a'},
+		{0xdd, 0xff, 0xff, 0xff, 0xff},
+		{0x81, 0x01, 0x02},
+		{0xc1},
+		{0x01, 0x02},
+	} {
+		if _, err := msgpackUnmarshal(data, nil); err == nil {
+			t.Errorf("Expected error when decoding %v", data)
+		}
+	}
+}
+
+func TestMsgpackUnmarshalDeeplyNested(t *testing.T) {
+	data := append(bytes.Repeat([]byte{0x91}, 1<<20), 0xc0)
+	if _, err := msgpackUnmarshal(data, nil); err != errMessageTooDeep {
+		t.Errorf("Expected deeply nested data to be rejected, got %v", err)
+	}
+	data = append(bytes.Repeat([]byte{0x91}, msgpackMaxDepth-1), 0xc0)
+	if _, err := msgpackUnmarshal(data, &MessageLimits{}); err != nil {
+		t.Errorf("Expected data within the hard limit to be decoded, got %v", err)
+	}
+}
@@ -0,0 +1,75 @@
+// Copyright (C) 2011 by Krzysztof Kowalik <chris@nu7hat.ch>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package engine
+
+import (
+	"errors"
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+// Pattern used to validate the allowed origins.
+var validOriginPattern = regexp.MustCompile("^([a-z][a-z0-9\\+\\.\\-]*://)?(\\*\\.)?[a-z0-9\\-]+(\\.[a-z0-9\\-]+)*(:\\d+)?$")
+
+// normalizeOrigin validates given allowed origin and converts it to the
+// canonical form. Allowed origin consists of an optional scheme, the host
+// and an optional port, eg. 'https://example.com' or 'example.com:8080'.
+// Host starting with '*.' matches all the subdomains of the specified
+// domain.
+//
+// origin - The allowed origin to be normalized.
+//
+// Returns normalized origin or an error if it's invalid.
+func normalizeOrigin(origin string) (string, error) {
+	origin = strings.TrimRight(strings.ToLower(strings.TrimSpace(origin)), "/")
+	if !validOriginPattern.MatchString(origin) {
+		return "", errors.New("invalid origin")
+	}
+	return origin, nil
+}
+
+// matchOrigin checks whether the origin sent by the client matches given
+// allowed origin. When the allowed origin has no scheme specified, then
+// any scheme is accepted. Ports have to match exactly.
+//
+// allowed - The normalized allowed origin.
+// origin  - The origin sent by the client.
+//
+// Examples:
+//
+//     matchOrigin("*.example.com", "https://chat.example.com") // => true
+//     matchOrigin("https://example.com", "http://example.com") // => false
+//
+// Returns whether the origin matches or not.
+func matchOrigin(allowed, origin string) bool {
+	u, err := url.Parse(strings.ToLower(origin))
+	if err != nil || u.Scheme == "" || u.Host == "" {
+		return false
+	}
+	host := allowed
+	if i := strings.Index(allowed, "://"); i >= 0 {
+		if allowed[:i] != u.Scheme {
+			return false
+		}
+		host = allowed[i+3:]
+	}
+	if strings.HasPrefix(host, "*.") {
+		suffix := host[1:]
+		return len(u.Host) > len(suffix) && strings.HasSuffix(u.Host, suffix)
+	}
+	return u.Host == host
+}
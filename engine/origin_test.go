@@ -0,0 +1,82 @@
+// Copyright (C) 2011 by Krzysztof Kowalik <chris@nu7hat.ch>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+
+package engine
+
+import "testing"
+
+func TestNormalizeOrigin(t *testing.T) {
+	for origin, expected := range map[string]string{
+		"https://Example.com/":  "https://example.com",
+		"*.example.com":         "*.example.com",
+		"http://localhost:3000": "http://localhost:3000",
+	} {
+		if normalized, err := normalizeOrigin(origin); err != nil || normalized != expected {
+			t.Errorf("Expected to normalize '%s' to '%s', got '%s'", origin, expected, normalized)
+		}
+	}
+	for _, origin := range []string{"", "http://", "*", "https://*", "example.com/path", "foo.*.com"} {
+		if _, err := normalizeOrigin(origin); err == nil {
+			t.Errorf("Expected '%s' to be invalid", origin)
+		}
+	}
+}
+
+func TestMatchOrigin(t *testing.T) {
+	for _, x := range []struct {
+		allowed, origin string
+		match           bool
+	}{
+		{"https://example.com", "https://example.com", true},
+		{"https://example.com", "http://example.com", false},
+		{"https://example.com", "https://www.example.com", false},
+		{"example.com", "http://example.com", true},
+		{"*.example.com", "https://chat.example.com", true},
+		{"*.example.com", "https://a.b.example.com", true},
+		{"*.example.com", "https://example.com", false},
+		{"*.example.com", "https://evilexample.com", false},
+		{"*.example.com", "https://chat.example.com:8080", false},
+		{"localhost:3000", "http://localhost:3000", true},
+		{"localhost:3000", "http://localhost", false},
+		{"example.com", "null", false},
+	} {
+		if matchOrigin(x.allowed, x.origin) != x.match {
+			t.Errorf("Expected match of '%s' against '%s' to be %v", x.origin, x.allowed, x.match)
+		}
+	}
+}
+
+func TestVhostAllowedOrigins(t *testing.T) {
+	v, _ := newTestVhost()
+	if !v.isOriginAllowed("https://evil.com") {
+		t.Errorf("Expected to allow all origins by default")
+	}
+	if err := v.AddAllowedOrigin("*.example.com"); err != nil {
+		t.Errorf("Expected to add allowed origin, error: %v", err)
+	}
+	if err := v.AddAllowedOrigin("*.Example.com"); err == nil {
+		t.Errorf("Expected error while adding the same origin twice")
+	}
+	if v.isOriginAllowed("https://evil.com") || !v.isOriginAllowed("https://chat.example.com") {
+		t.Errorf("Expected to allow only listed origins")
+	}
+	if err := v.DeleteAllowedOrigin("example.com"); err == nil {
+		t.Errorf("Expected error while removing not allowed origin")
+	}
+	if err := v.DeleteAllowedOrigin("*.example.com"); err != nil || len(v.AllowedOrigins()) != 0 {
+		t.Errorf("Expected to remove allowed origin, error: %v", err)
+	}
+}
@@ -0,0 +1,249 @@
+// Copyright (C) 2011 by Krzysztof Kowalik <chris@nu7hat.ch>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package engine
+
+import (
+	"errors"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// SlowConsumerPolicy specifies what happens with the websocket clients
+// which don't keep up with the messages sent to them.
+type SlowConsumerPolicy int
+
+// Available slow consumer policies.
+const (
+	// Disconnect the client once its outbound queue is full.
+	SlowConsumerDisconnect SlowConsumerPolicy = iota
+	// Drop the messages which don't fit in the outbound queue.
+	SlowConsumerDrop
+	// Replace the queued message of the same event and channel with
+	// the new one, drop the new one if there's no such message.
+	SlowConsumerCoalesce
+)
+
+// Names of the slow consumer policies.
+var slowConsumerPolicyNames = []string{"disconnect", "drop", "coalesce"}
+
+// The default size of the outbound queue.
+const defaultOutboundQueueSize = 256
+
+// OutboundQueue specifies the outbound queue of the websocket clients.
+type OutboundQueue struct {
+	// Maximum number of messages queued for a single client (the high-water
+	// mark) after which the policy is applied, zero means the default size.
+	Size int
+	// What to do when the queue is full.
+	Policy SlowConsumerPolicy
+}
+
+// outboundStats counts the clients and messages lost because of not
+// keeping up with the traffic. Threadsafe.
+type outboundStats struct {
+	// Number of the clients disconnected as slow consumers.
+	disconnected int64
+	// Number of the messages dropped.
+	dropped int64
+}
+
+// websocketOutbox implements the outbound queue of a single websocket
+// client, flushed by the connection's writer goroutine. Threadsafe.
+type websocketOutbox struct {
+	// Queued payloads, from the oldest.
+	items []interface{}
+	// Maximum number of the queued payloads.
+	size int
+	// Whether the queue is closed or not.
+	closed bool
+	// Signalled when payload is queued or the queue is closed.
+	cond *sync.Cond
+	// Internal semaphore.
+	mtx sync.Mutex
+}
+
+// Internal constructor
+// -----------------------------------------------------------------------------
+
+// newWebsocketOutbox creates new, empty outbound queue.
+//
+// size - Maximum number of the queued payloads.
+//
+// Returns new queue.
+func newWebsocketOutbox(size int) *websocketOutbox {
+	o := &websocketOutbox{size: size}
+	o.cond = sync.NewCond(&o.mtx)
+	return o
+}
+
+// Internal
+// -----------------------------------------------------------------------------
+
+// coalesceKey returns the key identifying messages which can replace one
+// another, the event name and channel of the broadcasted message. Other
+// messages can't be coalesced.
+//
+// payload - The queued payload.
+//
+// Returns the key or an empty string if the payload can't be coalesced.
+func coalesceKey(payload interface{}) string {
+	if frame, ok := payload.(*websocketFrame); ok {
+		payload = frame.payload
+	}
+	msg, ok := payload.(map[string]interface{})
+	if !ok || len(msg) != 1 {
+		return ""
+	}
+	for event, data := range msg {
+		if strings.HasPrefix(event, ":") {
+			// Internal events are never coalesced.
+			return ""
+		}
+		if d, ok := data.(map[string]interface{}); ok {
+			if channel, ok := d["channel"].(string); ok && channel != "" {
+				return event + "\x00" + channel
+			}
+		}
+	}
+	return ""
+}
+
+// push appends given payload to the queue unless it's full or closed.
+// Threadsafe.
+//
+// payload - The payload to be queued.
+//
+// Returns whether the payload has been queued or not.
+func (o *websocketOutbox) push(payload interface{}) bool {
+	o.mtx.Lock()
+	defer o.mtx.Unlock()
+	if o.closed || len(o.items) >= o.size {
+		return false
+	}
+	o.items = append(o.items, payload)
+	o.cond.Signal()
+	return true
+}
+
+// coalesce replaces the most recently queued payload of the same event and
+// channel with given one, keeping its position in the queue. Threadsafe.
+//
+// payload - The new payload.
+//
+// Returns whether the payload has been queued or not.
+func (o *websocketOutbox) coalesce(payload interface{}) bool {
+	key := coalesceKey(payload)
+	if key == "" {
+		return false
+	}
+	o.mtx.Lock()
+	defer o.mtx.Unlock()
+	if o.closed {
+		return false
+	}
+	for i := len(o.items) - 1; i >= 0; i -= 1 {
+		if coalesceKey(o.items[i]) == key {
+			o.items[i] = payload
+			return true
+		}
+	}
+	return false
+}
+
+// pop removes the oldest payload from the queue, waiting for it if the
+// queue is empty. Threadsafe, called from the writer goroutine.
+//
+// Returns the payload, or false when the queue is closed and empty.
+func (o *websocketOutbox) pop() (interface{}, bool) {
+	o.mtx.Lock()
+	defer o.mtx.Unlock()
+	for len(o.items) == 0 {
+		if o.closed {
+			return nil, false
+		}
+		o.cond.Wait()
+	}
+	payload := o.items[0]
+	o.items[0] = nil
+	o.items = o.items[1:]
+	return payload, true
+}
+
+// close stops accepting new payloads, the queued ones can still be popped.
+// Threadsafe.
+func (o *websocketOutbox) close() {
+	o.mtx.Lock()
+	defer o.mtx.Unlock()
+	o.closed = true
+	o.cond.Broadcast()
+}
+
+// size returns the effective size of the queue.
+func (q OutboundQueue) size() int {
+	if q.Size <= 0 {
+		return defaultOutboundQueueSize
+	}
+	return q.Size
+}
+
+// countDisconnected increments the number of the disconnected slow
+// consumers. Threadsafe.
+func (s *outboundStats) countDisconnected() {
+	if s != nil {
+		atomic.AddInt64(&s.disconnected, 1)
+	}
+}
+
+// countDropped increments the number of the dropped messages. Threadsafe.
+func (s *outboundStats) countDropped() {
+	if s != nil {
+		atomic.AddInt64(&s.dropped, 1)
+	}
+}
+
+// load returns numbers of the disconnected slow consumers and dropped
+// messages. Threadsafe.
+func (s *outboundStats) load() (disconnected, dropped int) {
+	disconnected = int(atomic.LoadInt64(&s.disconnected))
+	dropped = int(atomic.LoadInt64(&s.dropped))
+	return
+}
+
+// Exported
+// -----------------------------------------------------------------------------
+
+// ParseSlowConsumerPolicy converts given name into the slow consumer policy.
+//
+// name - The name of the policy, one of: disconnect, drop or coalesce.
+//
+// Returns the policy or an error if the name is invalid.
+func ParseSlowConsumerPolicy(name string) (SlowConsumerPolicy, error) {
+	for i, policyName := range slowConsumerPolicyNames {
+		if policyName == strings.ToLower(name) {
+			return SlowConsumerPolicy(i), nil
+		}
+	}
+	return SlowConsumerDisconnect, errors.New("invalid slow consumer policy")
+}
+
+// String returns name of the slow consumer policy.
+func (p SlowConsumerPolicy) String() string {
+	if p < SlowConsumerDisconnect || int(p) >= len(slowConsumerPolicyNames) {
+		return "unknown"
+	}
+	return slowConsumerPolicyNames[p]
+}
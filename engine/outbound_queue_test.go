@@ -0,0 +1,141 @@
+// Copyright (C) 2011 by Krzysztof Kowalik <chris@nu7hat.ch>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package engine
+
+import "testing"
+
+func TestParseSlowConsumerPolicy(t *testing.T) {
+	for i, name := range []string{"disconnect", "DROP", "coalesce"} {
+		if p, err := ParseSlowConsumerPolicy(name); err != nil || p != SlowConsumerPolicy(i) {
+			t.Errorf("Expected to parse '%s' policy, got %v, %v", name, p, err)
+		}
+	}
+	if _, err := ParseSlowConsumerPolicy("block"); err == nil {
+		t.Errorf("Expected an error for invalid policy")
+	}
+	if SlowConsumerDrop.String() != "drop" || SlowConsumerPolicy(5).String() != "unknown" {
+		t.Errorf("Expected to get name of the policy")
+	}
+}
+
+func TestVhostSetOutboundQueue(t *testing.T) {
+	v, _ := newTestVhost()
+	if q := v.OutboundQueue(); q.Size != defaultOutboundQueueSize || q.Policy != SlowConsumerDisconnect {
+		t.Errorf("Expected the default outbound queue, got %v", q)
+	}
+	v.SetOutboundQueue(&OutboundQueue{Size: 16, Policy: SlowConsumerDrop})
+	if q := v.OutboundQueue(); q.Size != 16 || q.Policy != SlowConsumerDrop {
+		t.Errorf("Expected to change the outbound queue, got %v", q)
+	}
+	v.SetOutboundQueue(nil)
+	if q := v.OutboundQueue(); q.Size != defaultOutboundQueueSize || q.Policy != SlowConsumerDisconnect {
+		t.Errorf("Expected to restore the default outbound queue, got %v", q)
+	}
+}
+
+func TestOutboundStats(t *testing.T) {
+	var none *outboundStats
+	none.countDropped()
+	none.countDisconnected()
+	s := &outboundStats{}
+	s.countDropped()
+	s.countDropped()
+	s.countDisconnected()
+	if disconnected, dropped := s.load(); disconnected != 1 || dropped != 2 {
+		t.Errorf("Expected to count lost clients and messages, got %d, %d", disconnected, dropped)
+	}
+}
+
+func TestWebsocketOutbox(t *testing.T) {
+	o := newWebsocketOutbox(2)
+	if !o.push("a") || !o.push("b") {
+		t.Errorf("Expected to queue payloads up to the size")
+	}
+	if o.push("c") {
+		t.Errorf("Expected not to queue payload when full")
+	}
+	if p, ok := o.pop(); !ok || p != "a" {
+		t.Errorf("Expected to pop the oldest payload, got %v", p)
+	}
+	o.close()
+	if o.push("d") {
+		t.Errorf("Expected not to queue payload when closed")
+	}
+	if p, ok := o.pop(); !ok || p != "b" {
+		t.Errorf("Expected to pop payloads queued before closing, got %v", p)
+	}
+	if _, ok := o.pop(); ok {
+		t.Errorf("Expected closed empty queue not to block")
+	}
+}
+
+func TestWebsocketOutboxPopWaits(t *testing.T) {
+	o := newWebsocketOutbox(1)
+	popped := make(chan interface{})
+	go func() {
+		p, _ := o.pop()
+		popped <- p
+	}()
+	o.push("a")
+	if p := <-popped; p != "a" {
+		t.Errorf("Expected to wait for the payload, got %v", p)
+	}
+}
+
+func TestWebsocketOutboxCoalesce(t *testing.T) {
+	msg := func(event, channel, value string) map[string]interface{} {
+		return map[string]interface{}{
+			event: map[string]interface{}{"channel": channel, "value": value},
+		}
+	}
+	o := newWebsocketOutbox(3)
+	o.push(msg("status", "foo", "1"))
+	o.push(newWebsocketFrame(msg("status", "bar", "1")))
+	o.push(msg("other", "foo", "1"))
+	if !o.coalesce(newWebsocketFrame(msg("status", "bar", "2"))) {
+		t.Errorf("Expected to coalesce message of the same event and channel")
+	}
+	if o.coalesce(msg("status", "baz", "1")) {
+		t.Errorf("Expected not to coalesce message of other channel")
+	}
+	if o.coalesce(map[string]interface{}{":ping": map[string]interface{}{}}) {
+		t.Errorf("Expected not to coalesce internal events")
+	}
+	o.pop()
+	p, _ := o.pop()
+	if f, ok := p.(*websocketFrame); !ok || f.payload.(map[string]interface{})["status"].(map[string]interface{})["value"] != "2" {
+		t.Errorf("Expected to replace the message in place, got %v", p)
+	}
+}
+
+func TestCoalesceKey(t *testing.T) {
+	var tests = []struct {
+		payload interface{}
+		key     string
+	}{
+		{map[string]interface{}{"foo": map[string]interface{}{"channel": "bar"}}, "foo\x00bar"},
+		{newWebsocketFrame(map[string]interface{}{"foo": map[string]interface{}{"channel": "bar"}}), "foo\x00bar"},
+		{map[string]interface{}{"foo": map[string]interface{}{}}, ""},
+		{map[string]interface{}{":memberJoined": map[string]interface{}{"channel": "bar"}}, ""},
+		{map[string]interface{}{"foo": map[string]interface{}{"channel": "bar"}, "bar": nil}, ""},
+		{websocketPingFrame{}, ""},
+	}
+	for _, tt := range tests {
+		if key := coalesceKey(tt.payload); key != tt.key {
+			t.Errorf("Expected key %q for %v, got %q", tt.key, tt.payload, key)
+		}
+	}
+}
@@ -0,0 +1,205 @@
+// Copyright (C) 2011 by Krzysztof Kowalik <chris@nu7hat.ch>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package engine
+
+import (
+	"container/list"
+	"sync"
+	"time"
+)
+
+// Maximum number of buckets kept by the limiter, the least recently used
+// ones are evicted above it.
+const rateLimiterMaxBuckets = 10000
+
+// Maximum number of the least recently used buckets checked for being full
+// with each limited operation.
+const rateLimiterPurgeBatch = 2
+
+// Default limit of the rate limit violations, clients exceeding it are
+// disconnected.
+var defaultRateLimitViolations = RateLimit{Rate: 10.0 / 60, Burst: 10}
+
+// RateLimit specifies a token bucket limit. The bucket holds up to Burst
+// tokens and is refilled with Rate tokens per second, each limited
+// operation takes one token.
+type RateLimit struct {
+	// Number of tokens refilled per second.
+	Rate float64
+	// Maximum number of tokens in the bucket.
+	Burst int
+}
+
+// EventRateLimits specifies limits of a single frontend event type,
+// separately for each connection, each user and the whole vhost.
+// Nil limit means no limit in given scope.
+type EventRateLimits struct {
+	// Limit applied to each connection.
+	Connection *RateLimit
+	// Limit applied to all connections of the same user.
+	Uid *RateLimit
+	// Limit applied to all connections within the vhost.
+	Vhost *RateLimit
+}
+
+// tokenBucket implements the token bucket algorithm. Not threadsafe,
+// used only by the rate limiter.
+type tokenBucket struct {
+	// The bucket's key.
+	key string
+	// The limit from which the bucket has been created.
+	limit RateLimit
+	// Number of tokens available.
+	tokens float64
+	// Time of the last refill.
+	last time.Time
+	// Position of the bucket on the limiter's usage list.
+	elem *list.Element
+}
+
+// rateLimiter keeps a set of token buckets identified by keys.
+type rateLimiter struct {
+	// List of buckets.
+	buckets map[string]*tokenBucket
+	// Buckets ordered from the most to the least recently used.
+	usage *list.List
+	// Maximum number of buckets kept.
+	max int
+	// Internal semaphore.
+	mtx sync.Mutex
+}
+
+// Internal constructors
+// -----------------------------------------------------------------------------
+
+// newTokenBucket creates a full bucket for the given limit.
+//
+// key   - The bucket's key.
+// limit - The limit to be applied.
+//
+// Returns new bucket.
+func newTokenBucket(key string, limit *RateLimit) *tokenBucket {
+	return &tokenBucket{
+		key:    key,
+		limit:  *limit,
+		tokens: float64(limit.Burst),
+		last:   time.Now(),
+	}
+}
+
+// newRateLimiter creates new rate limiter.
+//
+// Returns new limiter.
+func newRateLimiter() *rateLimiter {
+	return &rateLimiter{
+		buckets: make(map[string]*tokenBucket),
+		usage:   list.New(),
+		max:     rateLimiterMaxBuckets,
+	}
+}
+
+// Internal
+// -----------------------------------------------------------------------------
+
+// refill adds tokens earned since the last refill.
+//
+// now - The current time.
+//
+func (b *tokenBucket) refill(now time.Time) {
+	b.tokens += now.Sub(b.last).Seconds() * b.limit.Rate
+	if max := float64(b.limit.Burst); b.tokens > max {
+		b.tokens = max
+	}
+	b.last = now
+}
+
+// take removes a token from the bucket if available.
+//
+// Returns whether the token has been taken or not.
+func (b *tokenBucket) take() bool {
+	b.refill(time.Now())
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens -= 1
+	return true
+}
+
+// isFull returns whether the bucket has all its tokens, which means it
+// has not been used for a while.
+func (b *tokenBucket) isFull() bool {
+	b.refill(time.Now())
+	return b.tokens >= float64(b.limit.Burst)
+}
+
+// allow takes a token from the bucket identified by given key. The bucket
+// is created when used for the first time or when the limit's values have
+// changed, so reloading the same limits doesn't reset the buckets.
+// Threadsafe.
+//
+// key   - The bucket's key.
+// limit - The limit to be applied, nil means no limit.
+//
+// Returns whether the operation is allowed or not.
+func (l *rateLimiter) allow(key string, limit *RateLimit) bool {
+	if limit == nil {
+		return true
+	}
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+	b, ok := l.buckets[key]
+	if ok && b.limit == *limit {
+		l.usage.MoveToFront(b.elem)
+	} else {
+		if ok {
+			l.remove(b)
+		}
+		b = newTokenBucket(key, limit)
+		b.elem = l.usage.PushFront(b)
+		l.buckets[key] = b
+	}
+	allowed := b.take()
+	l.purge()
+	return allowed
+}
+
+// purge removes a few least recently used buckets if they are full, as
+// they are equal to the new ones, and evicts the least recently used ones
+// when there is more buckets than allowed. Each call takes a constant
+// time, so the buckets are purged gradually. Not threadsafe, called only
+// from the allow function.
+func (l *rateLimiter) purge() {
+	for l.usage.Len() > l.max {
+		l.remove(l.usage.Back().Value.(*tokenBucket))
+	}
+	for i := 0; i < rateLimiterPurgeBatch; i += 1 {
+		e := l.usage.Back()
+		if e == nil || !e.Value.(*tokenBucket).isFull() {
+			return
+		}
+		l.remove(e.Value.(*tokenBucket))
+	}
+}
+
+// remove deletes the specified bucket. Not threadsafe, called only from
+// the allow and purge functions.
+//
+// b - The bucket to be removed.
+//
+func (l *rateLimiter) remove(b *tokenBucket) {
+	l.usage.Remove(b.elem)
+	delete(l.buckets, b.key)
+}
@@ -0,0 +1,109 @@
+// Copyright (C) 2011 by Krzysztof Kowalik <chris@nu7hat.ch>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package engine
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRateLimiterAllow(t *testing.T) {
+	l := newRateLimiter()
+	limit := &RateLimit{Rate: 100, Burst: 2}
+	if !l.allow("foo", nil) {
+		t.Errorf("Expected to allow not limited operation")
+	}
+	for i := 0; i < 2; i += 1 {
+		if !l.allow("foo", limit) {
+			t.Errorf("Expected to allow operations within the burst")
+		}
+	}
+	if l.allow("foo", limit) {
+		t.Errorf("Expected to reject operation exceeding the burst")
+	}
+	if !l.allow("bar", limit) {
+		t.Errorf("Expected buckets to be independent")
+	}
+	<-time.After(20 * time.Millisecond)
+	if !l.allow("foo", limit) {
+		t.Errorf("Expected the bucket to be refilled")
+	}
+}
+
+func TestRateLimiterLimitChange(t *testing.T) {
+	l := newRateLimiter()
+	l.allow("foo", &RateLimit{Rate: 0, Burst: 1})
+	if l.allow("foo", &RateLimit{Rate: 0, Burst: 1}) {
+		t.Errorf("Expected to keep the bucket when the same limit is reloaded")
+	}
+	if !l.allow("foo", &RateLimit{Rate: 0, Burst: 2}) {
+		t.Errorf("Expected to recreate the bucket when limit changes")
+	}
+}
+
+func TestRateLimiterPurge(t *testing.T) {
+	l := newRateLimiter()
+	l.allow("foo", &RateLimit{Rate: 1000, Burst: 1})
+	l.allow("bar", &RateLimit{Rate: 0, Burst: 1})
+	<-time.After(10 * time.Millisecond)
+	l.allow("baz", &RateLimit{Rate: 0, Burst: 1})
+	if _, ok := l.buckets["foo"]; ok {
+		t.Errorf("Expected to purge the full bucket")
+	}
+	for _, key := range []string{"bar", "baz"} {
+		if _, ok := l.buckets[key]; !ok {
+			t.Errorf("Expected to keep the used bucket '%s'", key)
+		}
+	}
+	if l.usage.Len() != len(l.buckets) {
+		t.Errorf("Expected the usage list to match the buckets")
+	}
+}
+
+func TestRateLimiterMaxBuckets(t *testing.T) {
+	l := newRateLimiter()
+	l.max = 3
+	limit := &RateLimit{Rate: 0, Burst: 1}
+	for _, key := range []string{"a", "b", "c"} {
+		l.allow(key, limit)
+	}
+	l.allow("a", limit)
+	l.allow("d", limit)
+	if len(l.buckets) != 3 || l.usage.Len() != 3 {
+		t.Errorf("Expected to keep at most 3 buckets, got %d", len(l.buckets))
+	}
+	if _, ok := l.buckets["b"]; ok {
+		t.Errorf("Expected to evict the least recently used bucket")
+	}
+	if l.allow("a", limit) {
+		t.Errorf("Expected to keep the recently used bucket")
+	}
+}
+
+func TestVhostRateLimitViolations(t *testing.T) {
+	v, _ := newTestVhost()
+	if v.RateLimitViolations() != defaultRateLimitViolations {
+		t.Errorf("Expected the default violations limit")
+	}
+	v.SetRateLimitViolations(&RateLimit{Rate: 1, Burst: 3})
+	if l := v.RateLimitViolations(); l.Rate != 1 || l.Burst != 3 {
+		t.Errorf("Expected to change the violations limit, got %v", l)
+	}
+	v.SetRateLimitViolations(nil)
+	if v.RateLimitViolations() != defaultRateLimitViolations {
+		t.Errorf("Expected to restore the default violations limit")
+	}
+}
@@ -25,9 +25,12 @@ package engine
 // * 204: Broadcasted
 // * 205: Triggered
 // * 207: Closed
+// * 208: Options set
+// * 209: Member updated
 // * 250: Channel opened
 // * 251: Channel exists // TODO: rename to 350
 // * 252: Channel closed
+// * 253: Channel metadata changed
 // * 270: Single access token generated
 //
 // = Error codes
@@ -38,6 +41,15 @@ package engine
 // * 451: Invalid channel name
 // * 453: Not subscribed
 // * 454: Channel not found
+// * 455: Idle timeout
+// * 456: Keepalive timeout
+// * 457: Rate limit exceeded
+// * 458: Too many rate limit violations
+// * 459: Too many connections
+// * 460: Message too large
+// * 461: Message too deep
+// * 462: Too many keys
+// * 463: Slow consumer
 // * 597: Internal error
 // * 598: End of file
 //
@@ -45,6 +57,9 @@ package engine
 //
 // * 300: Ready
 // * 301: Heartbeat
+// * 302: Pong
 // * 305: Connected
+// * 306: Resumed
+// * 307: Suspended
 // * 408: Expired
 //
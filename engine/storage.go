@@ -29,6 +29,8 @@ type _vhost struct {
 	Path string
 	// The vhost's access token.
 	AccessToken string
+	// Origins from which the frontend clients can connect.
+	Origins []string
 }
 
 // _channel is an internal struct to represent stored information about
@@ -40,6 +42,8 @@ type _channel struct {
 	Name string
 	// The channel's type.
 	Kind ChannelType
+	// The channel's metadata.
+	Metadata map[string]string
 }
 
 // _permission is an internal struct to represent stored information about
@@ -121,6 +125,7 @@ func (s *storage) Load(ctx *Context) {
 		if v, ok := val.(*_vhost); ok {
 			if x, err := ctx.AddVhost(v.Path); err == nil {
 				x.accessToken = v.AccessToken
+				x.origins = v.Origins
 				x._id = k
 				vhosts[k] = x
 			}
@@ -131,6 +136,10 @@ func (s *storage) Load(ctx *Context) {
 			if v, ok := vhosts[ch.Vhost]; ok {
 				x, _ := newChannel(ch.Name, ChannelType(ch.Kind))
 				x._id = k
+				for key, value := range ch.Metadata {
+					x.metadata[key] = value
+				}
+				v.configureChannel(x)
 				v.channels[ch.Name] = x
 			} else {
 				s.channels.Delete(k)
@@ -153,7 +162,7 @@ func (s *storage) Load(ctx *Context) {
 //
 // Returns an error if something went wrong.
 func (s *storage) AddVhost(vhost *Vhost) (err error) {
-	vhost._id, err = s.vhosts.Set(&_vhost{vhost.path, vhost.accessToken})
+	vhost._id, err = s.vhosts.Set(&_vhost{vhost.path, vhost.accessToken, vhost.origins})
 	return
 }
 
@@ -163,7 +172,7 @@ func (s *storage) AddVhost(vhost *Vhost) (err error) {
 //
 // Returns an error if something went wrong.
 func (s *storage) UpdateVhost(vhost *Vhost) (err error) {
-	err = s.vhosts.Update(vhost._id, &_vhost{vhost.path, vhost.accessToken})
+	err = s.vhosts.Update(vhost._id, &_vhost{vhost.path, vhost.accessToken, vhost.origins})
 	return
 }
 
@@ -175,7 +184,9 @@ func (s *storage) UpdateVhost(vhost *Vhost) (err error) {
 // Returns an error if something went wrong.
 func (s *storage) DeleteVhost(vhost *Vhost) (err error) {
 	for _, channel := range vhost.Channels() {
-		s.channels.Delete(channel._id)
+		if channel.isPersisted() {
+			s.channels.Delete(channel._id)
+		}
 	}
 	for _, permission := range vhost.Permissions() {
 		s.permissions.Delete(permission._id)
@@ -191,7 +202,20 @@ func (s *storage) DeleteVhost(vhost *Vhost) (err error) {
 //
 // Returns an error if something went wrong.
 func (s *storage) AddChannel(vhost *Vhost, channel *Channel) (err error) {
-	channel._id, err = s.channels.Set(&_channel{vhost._id, channel.name, channel.kind})
+	channel._id, err = s.channels.Set(&_channel{vhost._id, channel.name, channel.kind,
+		channel.Metadata()})
+	return
+}
+
+// UpdateChannel changes information about the specified channel.
+//
+// vhost   - The channel's parent vhost.
+// channel - The channel to be changed.
+//
+// Returns an error if something went wrong.
+func (s *storage) UpdateChannel(vhost *Vhost, channel *Channel) (err error) {
+	err = s.channels.Update(channel._id, &_channel{vhost._id, channel.name, channel.kind,
+		channel.Metadata()})
 	return
 }
 
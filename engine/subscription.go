@@ -23,8 +23,15 @@ type Subscription struct {
 	uid string
 	// Whether this subscriber is hidden or not.
 	hidden bool
-	// Data attached to this subscription (used only by the presence channels).
+	// Data attached to this subscription (used only by the presence channels),
+	// guarded by the channel's semaphore.
 	data map[string]interface{}
+	// Pattern via which the channel has been subscribed, empty if it's
+	// been subscribed explicitly.
+	pattern string
+	// Filter of the events sent to the subscriber, nil if everything is
+	// sent, guarded by the channel's semaphore.
+	filter *subscriptionFilter
 }
 
 // Internal constructor
@@ -34,7 +41,7 @@ type Subscription struct {
 // If hidden option is true, then this subscription will be invisible for
 // the other subscribers of the presence channel.
 func newSubscription(c *WebsocketConnection, hidden bool, data map[string]interface{}) *Subscription {
-	return &Subscription{c, c.Uid(), hidden, data}
+	return &Subscription{client: c, uid: c.Uid(), hidden: hidden, data: data}
 }
 
 // Exported
@@ -67,3 +74,9 @@ func (s *Subscription) Id() (id string) {
 func (s *Subscription) Uid() string {
 	return s.uid
 }
+
+// Pattern returns the pattern via which the channel has been subscribed,
+// or an empty string if it's been subscribed explicitly.
+func (s *Subscription) Pattern() string {
+	return s.pattern
+}
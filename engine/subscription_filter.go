@@ -0,0 +1,171 @@
+// Copyright (C) 2011 by Krzysztof Kowalik <chris@nu7hat.ch>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package engine
+
+import (
+	"errors"
+	"strings"
+)
+
+// subscriptionFilter represents the filter of the events sent to the
+// subscriber, evaluated by the channel before delivery. Internal events,
+// eg. ':memberJoined', are never filtered out.
+type subscriptionFilter struct {
+	// Names of the events to be sent, any event if empty.
+	events map[string]bool
+	// Values which the top-level fields of the event's data must equal.
+	where map[string]interface{}
+}
+
+// Internal constructor
+// -----------------------------------------------------------------------------
+
+// newSubscriptionFilter validates and creates the filter from the payload
+// sent by the client:
+//
+//     {
+//         "events": ["event name...", ...],
+//         "where": {"field": "value", ...}
+//     }
+//
+// x - The filter's payload.
+//
+// Returns new filter, nil if it doesn't filter anything, or an error
+// if the payload is invalid.
+func newSubscriptionFilter(x interface{}) (f *subscriptionFilter, err error) {
+	payload, ok := x.(map[string]interface{})
+	if !ok {
+		return nil, errors.New("invalid filter")
+	}
+	f = &subscriptionFilter{
+		events: make(map[string]bool),
+		where:  make(map[string]interface{}),
+	}
+	for key, value := range payload {
+		switch key {
+		case "events":
+			events, ok := value.([]interface{})
+			if !ok {
+				return nil, errors.New("invalid filter events")
+			}
+			for _, event := range events {
+				name, ok := event.(string)
+				if !ok || name == "" {
+					return nil, errors.New("invalid filter events")
+				}
+				f.events[name] = true
+			}
+		case "where":
+			where, ok := value.(map[string]interface{})
+			if !ok {
+				return nil, errors.New("invalid filter predicates")
+			}
+			for field, v := range where {
+				if f.where[field], ok = filterValue(v); !ok {
+					return nil, errors.New("invalid filter predicates")
+				}
+			}
+		default:
+			return nil, errors.New("invalid filter")
+		}
+	}
+	if len(f.events) == 0 && len(f.where) == 0 {
+		return nil, nil
+	}
+	return
+}
+
+// Internal
+// -----------------------------------------------------------------------------
+
+// filterValue converts given value into the comparable form, numbers
+// are compared as floats no matter how they've been decoded.
+//
+// v - The value to be converted.
+//
+// Returns the value and whether it can be compared or not.
+func filterValue(v interface{}) (interface{}, bool) {
+	switch n := v.(type) {
+	case nil, string, bool:
+		return v, true
+	case float64:
+		return n, true
+	case float32:
+		return float64(n), true
+	case int:
+		return float64(n), true
+	case int8:
+		return float64(n), true
+	case int16:
+		return float64(n), true
+	case int32:
+		return float64(n), true
+	case int64:
+		return float64(n), true
+	case uint:
+		return float64(n), true
+	case uint8:
+		return float64(n), true
+	case uint16:
+		return float64(n), true
+	case uint32:
+		return float64(n), true
+	case uint64:
+		return float64(n), true
+	}
+	return nil, false
+}
+
+// matches checks whether given broadcasted payload passes the filter.
+// Nil filter passes everything.
+//
+// payload - The payload to be checked, {"event name": {data...}}.
+//
+func (f *subscriptionFilter) matches(payload interface{}) bool {
+	if f == nil {
+		return true
+	}
+	msg, ok := payload.(map[string]interface{})
+	if !ok || len(msg) != 1 {
+		return true
+	}
+	for event, x := range msg {
+		if strings.HasPrefix(event, ":") {
+			// Internal events are never filtered out.
+			return true
+		}
+		if len(f.events) > 0 && !f.events[event] {
+			return false
+		}
+		if len(f.where) == 0 {
+			return true
+		}
+		data, ok := x.(map[string]interface{})
+		if !ok {
+			return false
+		}
+		for field, expected := range f.where {
+			value, ok := data[field]
+			if !ok {
+				return false
+			}
+			if value, ok = filterValue(value); !ok || value != expected {
+				return false
+			}
+		}
+	}
+	return true
+}
@@ -0,0 +1,79 @@
+// Copyright (C) 2011 by Krzysztof Kowalik <chris@nu7hat.ch>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+package engine
+
+import (
+	"testing"
+)
+
+func TestNewSubscriptionFilter(t *testing.T) {
+	f, err := newSubscriptionFilter(map[string]interface{}{
+		"events": []interface{}{"created", "updated"},
+		"where":  map[string]interface{}{"kind": "order", "priority": float64(1)},
+	})
+	if err != nil || f == nil {
+		t.Errorf("Expected to create the filter without errors")
+		return
+	}
+	if len(f.events) != 2 || len(f.where) != 2 {
+		t.Errorf("Expected to get valid filter, given %v", f)
+	}
+	if f, err = newSubscriptionFilter(map[string]interface{}{}); err != nil || f != nil {
+		t.Errorf("Expected to get no filter from the empty payload")
+	}
+}
+
+func TestNewSubscriptionFilterWithInvalidPayload(t *testing.T) {
+	for _, x := range []interface{}{
+		"created",
+		map[string]interface{}{"events": "created"},
+		map[string]interface{}{"events": []interface{}{""}},
+		map[string]interface{}{"events": []interface{}{1}},
+		map[string]interface{}{"where": []interface{}{"kind"}},
+		map[string]interface{}{"where": map[string]interface{}{"kind": []interface{}{"order"}}},
+		map[string]interface{}{"where": map[string]interface{}{"kind": map[string]interface{}{}}},
+		map[string]interface{}{"sort": "asc"},
+	} {
+		if _, err := newSubscriptionFilter(x); err == nil {
+			t.Errorf("Expected to throw an error while creating filter from %v", x)
+		}
+	}
+}
+
+func TestSubscriptionFilterMatches(t *testing.T) {
+	f, _ := newSubscriptionFilter(map[string]interface{}{
+		"events": []interface{}{"created"},
+		"where":  map[string]interface{}{"kind": "order", "priority": float64(1)},
+	})
+	for _, tt := range []struct {
+		payload map[string]interface{}
+		matches bool
+	}{
+		{map[string]interface{}{"created": map[string]interface{}{"kind": "order", "priority": float64(1)}}, true},
+		{map[string]interface{}{"created": map[string]interface{}{"kind": "order", "priority": int64(1)}}, true},
+		{map[string]interface{}{"created": map[string]interface{}{"kind": "order", "priority": 2}}, false},
+		{map[string]interface{}{"created": map[string]interface{}{"kind": "order"}}, false},
+		{map[string]interface{}{"updated": map[string]interface{}{"kind": "order", "priority": 1}}, false},
+		{map[string]interface{}{":memberJoined": map[string]interface{}{}}, true},
+	} {
+		if f.matches(tt.payload) != tt.matches {
+			t.Errorf("Expected matching %v to be %v", tt.payload, tt.matches)
+		}
+	}
+	var nothing *subscriptionFilter
+	if !nothing.matches(map[string]interface{}{"updated": map[string]interface{}{}}) {
+		t.Errorf("Expected the nil filter to match everything")
+	}
+}
@@ -22,6 +22,7 @@ import (
 	"fmt"
 	"regexp"
 	"sync"
+	"time"
 )
 
 // Pattern used to validate the vhost name.
@@ -39,10 +40,51 @@ type Vhost struct {
 	accessToken string
 	// List of channels opened within the vhost. 
 	channels map[string]*Channel
+	// Clients having the pattern subscriptions, by connection id, guarded
+	// by the channel management semaphore.
+	patternClients map[string]*WebsocketConnection
 	// Related backend lobby
 	lobby *backendLobby
 	// List of permissions generated for the vhost.
 	permissions map[string]*Permission
+	// Log level overriding the global one.
+	logLevel LogLevel
+	// Whether the log level is overridden or not.
+	hasLogLevel bool
+	// Time within which disconnected clients can resume their sessions.
+	resumeGracePeriod time.Duration
+	// Interval of the keepalive pings sent to the websocket clients.
+	keepaliveInterval time.Duration
+	// Time after which idle websocket clients are disconnected.
+	idleTimeout time.Duration
+	// Rate limits of the frontend events.
+	rateLimits map[string]*EventRateLimits
+	// Limit of the rate limit violations, default if nil.
+	violationsLimit *RateLimit
+	// Buckets of the per user rate limits.
+	uidLimiter *rateLimiter
+	// Buckets of the per vhost rate limits.
+	vhostLimiter *rateLimiter
+	// Limits of the frontend connections.
+	connectionLimits *ConnectionLimits
+	// Limits of the messages received from the clients and backends.
+	messageLimits *MessageLimits
+	// Outbound queue of the websocket clients.
+	outboundQueue OutboundQueue
+	// Origins from which the frontend clients can connect, any if empty.
+	origins []string
+	// Time after which the empty ephemeral channels are closed.
+	ephemeralTimeout time.Duration
+	// Whether the presence channels aggregate subscribers by the user ID.
+	presenceByUid bool
+	// Whether the channels' metadata is sent to the subscribers.
+	publicChannelMetadata bool
+	// Policy of the channels created on the first subscribe.
+	autoChannels AutoChannels
+	// Compiled patterns of the auto-created channels.
+	autoPatterns []*channelPattern
+	// Broadcast policies of the channels, from the most specific one.
+	broadcastRules []*broadcastRule
 	// Parent context.
 	ctx *Context
 	// Channel management semaphore
@@ -76,15 +118,283 @@ func newVhost(ctx *Context, path string) (v *Vhost, err error) {
 		return
 	}
 	v = &Vhost{
-		path:        path,
-		ctx:         ctx,
-		channels:    make(map[string]*Channel),
-		permissions: make(map[string]*Permission),
-		lobby:       newBackendLobby(),
+		path:           path,
+		ctx:            ctx,
+		channels:       make(map[string]*Channel),
+		patternClients: make(map[string]*WebsocketConnection),
+		permissions:    make(map[string]*Permission),
+		lobby:          newBackendLobby(),
+		rateLimits:     make(map[string]*EventRateLimits),
+		uidLimiter:     newRateLimiter(),
+		vhostLimiter:   newRateLimiter(),
 	}
 	return
 }
 
+// Internal
+// -----------------------------------------------------------------------------
+
+// eventRateLimits returns the rate limits of the specified frontend event,
+// nil if the event is not limited. Threadsafe.
+//
+// event - The event name.
+//
+func (v *Vhost) eventRateLimits(event string) *EventRateLimits {
+	v.imtx.Lock()
+	defer v.imtx.Unlock()
+	return v.rateLimits[event]
+}
+
+// rateLimitViolations returns the limit of the rate limit violations
+// after which the clients are disconnected. Threadsafe.
+func (v *Vhost) rateLimitViolations() *RateLimit {
+	v.imtx.Lock()
+	defer v.imtx.Unlock()
+	if v.violationsLimit == nil {
+		return &defaultRateLimitViolations
+	}
+	return v.violationsLimit
+}
+
+// openChannel creates new channel, persists it if the storage is enabled
+// and subscribes it for the clients subscribing the matching patterns.
+// Ephemeral channels are not persisted and are closed when they stay
+// empty for the timeout. Threadsafe.
+//
+// name    - The name of the new channel.
+// kind    - The type of the new channel.
+// timeout - Time after which the empty channel is closed, zero if the
+//           channel is persisted and kept open until deleted.
+// auto    - Whether the channel is created on the first subscribe.
+//
+// Returns new channel or error if something went wrong.
+func (v *Vhost) openChannel(name string, kind ChannelType, timeout time.Duration,
+	auto bool) (ch *Channel, err error) {
+	v.cmtx.Lock()
+	if _, ok := v.channels[name]; ok {
+		v.cmtx.Unlock()
+		return nil, errors.New("channel already exists")
+	}
+	if ch, err = newChannel(name, kind); err != nil {
+		v.cmtx.Unlock()
+		return
+	}
+	ch.ephemeral, ch.auto = timeout > 0, auto
+	v.configureChannel(ch)
+	if ch.isPersisted() && v.ctx != nil && v.ctx.isStorageEnabled() {
+		if err = v.ctx.storage.AddChannel(v, ch); err != nil {
+			v.cmtx.Unlock()
+			// The broadcaster has been started already.
+			ch.Kill()
+			return nil, err
+		}
+	}
+	v.channels[name] = ch
+	clients := v.patternSubscribers()
+	v.cmtx.Unlock()
+	if ch.IsEphemeral() {
+		ch.closeWhenEmpty(timeout, v.closeEmptyChannel)
+	}
+	// Subscribing outside of the semaphore, the clients are not
+	// affected by the other channels.
+	for _, c := range clients {
+		v.subscribeMatching(c, ch)
+	}
+	return
+}
+
+// configureChannel makes the channel follow the vhost's settings.
+//
+// ch - The channel to be configured.
+//
+func (v *Vhost) configureChannel(ch *Channel) {
+	ch.presenceByUid = v.PresenceByUid
+	ch.publicMetadata = v.PublicChannelMetadata
+}
+
+// autoChannelTimeout checks whether the channel with given name can be
+// created on the first subscribe. Threadsafe.
+//
+// name - The name of the channel.
+//
+// Returns time after which the empty channel shall be closed, and whether
+// the channel can be created or not.
+func (v *Vhost) autoChannelTimeout(name string) (time.Duration, bool) {
+	v.imtx.Lock()
+	defer v.imtx.Unlock()
+	for _, p := range v.autoPatterns {
+		if p.matchesName(name) {
+			return v.autoChannels.emptyTimeout(), true
+		}
+	}
+	return 0, false
+}
+
+// openAutoChannel creates the channel subscribed for the first time if it
+// matches the vhost's auto-created channels policy. The channel is closed
+// once nobody subscribes it for a while. Threadsafe, called from the
+// websocket connection's handlers.
+//
+// name - The name of the channel.
+//
+// Returns the channel or an error if it can't be created.
+func (v *Vhost) openAutoChannel(name string) (ch *Channel, err error) {
+	timeout, ok := v.autoChannelTimeout(name)
+	if !ok {
+		return nil, errors.New("channel doesn't exist")
+	}
+	if ch, err = v.openChannel(name, ChannelTypeFromName(name), timeout, true); err != nil {
+		// Might have been opened by someone else in the meantime.
+		return v.Channel(name)
+	}
+	return
+}
+
+// closeEmptyChannel deletes given ephemeral channel, unless someone
+// subscribed it in the meantime. Threadsafe, called from the channel's
+// empty timer.
+//
+// ch - The channel to be closed.
+//
+func (v *Vhost) closeEmptyChannel(ch *Channel) {
+	v.cmtx.Lock()
+	defer v.cmtx.Unlock()
+	if v.channels[ch.Name()] == ch && ch.isEmpty() {
+		delete(v.channels, ch.Name())
+		ch.Kill()
+	}
+}
+
+// patternSubscribers returns the clients having the pattern subscriptions.
+// The clients which unsubscribed all their patterns, or have been killed
+// in the meantime, are forgotten. Not threadsafe, the channel management
+// semaphore has to be locked by the caller.
+func (v *Vhost) patternSubscribers() []*WebsocketConnection {
+	clients := make([]*WebsocketConnection, 0, len(v.patternClients))
+	for id, c := range v.patternClients {
+		if !c.hasPatterns() {
+			delete(v.patternClients, id)
+			continue
+		}
+		clients = append(clients, c)
+	}
+	return clients
+}
+
+// subscribeMatching subscribes given channel for the client if one
+// of its patterns matches it. Threadsafe.
+//
+// c  - The websocket client.
+// ch - The channel to be subscribed.
+//
+func (v *Vhost) subscribeMatching(c *WebsocketConnection, ch *Channel) {
+	if pattern := c.matchingPattern(ch); pattern != "" {
+		ch.subscribe(c, false, map[string]interface{}{}, pattern, nil)
+	}
+}
+
+// subscribePattern registers the client's pattern subscription and
+// subscribes all the matching channels opened already. Channels opened
+// later on are subscribed when opened. Threadsafe, called from the websocket
+// connection's handlers.
+//
+// c - The websocket client.
+// p - The pattern to be subscribed.
+//
+func (v *Vhost) subscribePattern(c *WebsocketConnection, p *channelPattern) {
+	c.addPattern(p)
+	v.cmtx.Lock()
+	v.patternClients[c.Id()] = c
+	channels := make([]*Channel, 0)
+	for _, ch := range v.channels {
+		if p.matches(ch) {
+			channels = append(channels, ch)
+		}
+	}
+	v.cmtx.Unlock()
+	for _, ch := range channels {
+		v.subscribeMatching(c, ch)
+	}
+}
+
+// unsubscribePattern removes the client's pattern subscription and
+// unsubscribes the channels subscribed via that pattern, unless they
+// are matched by the other client's patterns. Threadsafe, called from
+// the websocket connection's handlers.
+//
+// c       - The websocket client.
+// pattern - The pattern to be unsubscribed.
+//
+// Returns whether the client has been subscribing the pattern or not.
+func (v *Vhost) unsubscribePattern(c *WebsocketConnection, pattern string) bool {
+	if !c.deletePattern(pattern) {
+		return false
+	}
+	for _, ch := range c.channels() {
+		ch.unsubscribePattern(c, pattern)
+	}
+	return true
+}
+
+// isBroadcastAllowed checks whether the client can broadcast given event
+// to the channel, according to the most specific broadcast policy matching
+// the channel. Anyone can broadcast any event when no policy matches.
+// Threadsafe.
+//
+// c       - The broadcasting client.
+// channel - The channel name.
+// event   - The event name.
+//
+func (v *Vhost) isBroadcastAllowed(c *WebsocketConnection, channel, event string) bool {
+	v.imtx.Lock()
+	var rule *broadcastRule
+	for _, r := range v.broadcastRules {
+		if r.channels.matchesName(channel) {
+			rule = r
+			break
+		}
+	}
+	v.imtx.Unlock()
+	return rule == nil || rule.allows(c, event)
+}
+
+// isOriginAllowed checks whether the frontend clients can connect from
+// the specified origin. All origins are allowed when the list of allowed
+// origins is empty. Threadsafe.
+//
+// origin - The origin sent by the client.
+//
+func (v *Vhost) isOriginAllowed(origin string) bool {
+	v.imtx.Lock()
+	defer v.imtx.Unlock()
+	if len(v.origins) == 0 {
+		return true
+	}
+	for _, allowed := range v.origins {
+		if matchOrigin(allowed, origin) {
+			return true
+		}
+	}
+	return false
+}
+
+// frontendConnectionLimits returns the limits of the frontend connections,
+// nil if not limited. Threadsafe.
+func (v *Vhost) frontendConnectionLimits() *ConnectionLimits {
+	v.imtx.Lock()
+	defer v.imtx.Unlock()
+	return v.connectionLimits
+}
+
+// receivedMessageLimits returns the limits of the messages received from
+// the websocket clients and backend connections, nil if not limited.
+// Threadsafe.
+func (v *Vhost) receivedMessageLimits() *MessageLimits {
+	v.imtx.Lock()
+	defer v.imtx.Unlock()
+	return v.messageLimits
+}
+
 // Exported
 // -----------------------------------------------------------------------------
 
@@ -174,8 +484,9 @@ func (v *Vhost) Path() string {
 }
 
 // OpenChannel creates new channel and registers it within the vhost.
-// Threadsafe, may be called from the admin interface and affects other
-// functions.
+// Clients subscribing the patterns matching the channel's name get
+// subscribed to it. Threadsafe, may be called from the admin interface
+// and affects other functions.
 //
 // name - The name of the new channel.
 // kind - The type of the new channel.
@@ -188,22 +499,21 @@ func (v *Vhost) Path() string {
 //
 // Returns new channel or error if something went wrong.
 func (v *Vhost) OpenChannel(name string, kind ChannelType) (ch *Channel, err error) {
-	v.cmtx.Lock()
-	defer v.cmtx.Unlock()
-	if _, ok := v.channels[name]; ok {
-		err = errors.New("channel already exists")
-		return
-	}
-	if ch, err = newChannel(name, kind); err != nil {
-		return
-	}
-	if v.ctx != nil && v.ctx.isStorageEnabled() {
-		if err = v.ctx.storage.AddChannel(v, ch); err != nil {
-			return
-		}
-	}
-	v.channels[name] = ch
-	return
+	return v.openChannel(name, kind, 0, false)
+}
+
+// OpenEphemeralChannel creates new channel which is kept in memory only.
+// It's not persisted, so it disappears when the server restarts, and it's
+// closed when nobody subscribes it for the vhost's ephemeral timeout.
+// Threadsafe, may be called from the admin interface and affects other
+// functions.
+//
+// name - The name of the new channel.
+// kind - The type of the new channel.
+//
+// Returns new channel or error if something went wrong.
+func (v *Vhost) OpenEphemeralChannel(name string, kind ChannelType) (ch *Channel, err error) {
+	return v.openChannel(name, kind, v.EphemeralTimeout(), false)
 }
 
 // DeleteChannel removes channel with the specified name from the vhost.
@@ -221,7 +531,7 @@ func (v *Vhost) DeleteChannel(name string) (err error) {
 		err = errors.New("channel doesn't exist")
 		return
 	}
-	if v.ctx != nil && v.ctx.isStorageEnabled() {
+	if ch.isPersisted() && v.ctx != nil && v.ctx.isStorageEnabled() {
 		if err = v.ctx.storage.DeleteChannel(ch); err != nil {
 			return
 		}
@@ -231,6 +541,58 @@ func (v *Vhost) DeleteChannel(name string) (err error) {
 	return
 }
 
+// updateChannelMetadata sets or removes the metadata entry of the
+// specified channel and persists it. Threadsafe.
+//
+// name  - The name of the channel.
+// key   - The metadata key.
+// value - The value to be set.
+// set   - Whether to set or remove the entry.
+//
+// Returns an error if something went wrong.
+func (v *Vhost) updateChannelMetadata(name, key, value string, set bool) (err error) {
+	if key == "" {
+		return errors.New("invalid metadata key")
+	}
+	v.cmtx.Lock()
+	defer v.cmtx.Unlock()
+	ch, ok := v.channels[name]
+	if !ok {
+		return errors.New("channel doesn't exist")
+	}
+	if !ch.updateMetadata(key, value, set) {
+		return errors.New("metadata key doesn't exist")
+	}
+	if ch.isPersisted() && v.ctx != nil && v.ctx.isStorageEnabled() {
+		err = v.ctx.storage.UpdateChannel(v, ch)
+	}
+	return
+}
+
+// SetChannelMetadata sets the metadata entry of the specified channel,
+// eg. its title or owner. Metadata of the persisted channels is persisted
+// as well. Threadsafe, called from the backend protocol or admin interface.
+//
+// name  - The name of the channel.
+// key   - The metadata key.
+// value - The value to be set.
+//
+// Returns an error if something went wrong.
+func (v *Vhost) SetChannelMetadata(name, key, value string) error {
+	return v.updateChannelMetadata(name, key, value, true)
+}
+
+// DeleteChannelMetadata removes the metadata entry of the specified
+// channel. Threadsafe, called from the backend protocol or admin interface.
+//
+// name - The name of the channel.
+// key  - The metadata key to be removed.
+//
+// Returns an error if something went wrong.
+func (v *Vhost) DeleteChannelMetadata(name, key string) error {
+	return v.updateChannelMetadata(name, key, "", false)
+}
+
 // Channel returns specified channel if exists. Threadsafe, may be called
 // from many places and being affected by other functions.
 //
@@ -247,11 +609,457 @@ func (v *Vhost) Channel(name string) (ch *Channel, err error) {
 	return
 }
 
-// Channels returns list of the channels registered within the vhost.
+// Channels returns a copy of the list of the channels registered within
+// the vhost. Threadsafe, the auto-created channels may be closed at any
+// time.
 func (v *Vhost) Channels() map[string]*Channel {
 	v.cmtx.Lock()
 	defer v.cmtx.Unlock()
-	return v.channels
+	channels := make(map[string]*Channel, len(v.channels))
+	for name, ch := range v.channels {
+		channels[name] = ch
+	}
+	return channels
+}
+
+// SetLogLevel overrides the global log level for this vhost. Threadsafe,
+// may be called from the admin endpoint.
+//
+// level - The log level to be used.
+//
+func (v *Vhost) SetLogLevel(level LogLevel) {
+	v.imtx.Lock()
+	defer v.imtx.Unlock()
+	v.logLevel, v.hasLogLevel = level, true
+}
+
+// ResetLogLevel removes the log level override, so the global one is
+// used again. Threadsafe, may be called from the admin endpoint.
+func (v *Vhost) ResetLogLevel() {
+	v.imtx.Lock()
+	defer v.imtx.Unlock()
+	v.hasLogLevel = false
+}
+
+// LogLevel returns the log level configured for this vhost and
+// whether it overrides the global one or not. Threadsafe.
+func (v *Vhost) LogLevel() (LogLevel, bool) {
+	v.imtx.Lock()
+	defer v.imtx.Unlock()
+	return v.logLevel, v.hasLogLevel
+}
+
+// SetResumeGracePeriod configures how long the sessions of disconnected
+// websocket clients are kept, so they can be resumed after reconnect.
+// Zero disables the session resumption. Threadsafe, affects only
+// the clients connected afterwards.
+//
+// d - The grace period.
+//
+func (v *Vhost) SetResumeGracePeriod(d time.Duration) {
+	v.imtx.Lock()
+	defer v.imtx.Unlock()
+	v.resumeGracePeriod = d
+}
+
+// ResumeGracePeriod returns the session resumption grace period, zero
+// if resumption is disabled. Threadsafe.
+func (v *Vhost) ResumeGracePeriod() time.Duration {
+	v.imtx.Lock()
+	defer v.imtx.Unlock()
+	return v.resumeGracePeriod
+}
+
+// SetKeepaliveInterval configures how often the websocket clients are
+// pinged. Clients which don't respond to the pings are disconnected.
+// Zero disables the keepalive. Threadsafe, affects only the clients
+// connected afterwards.
+//
+// d - The keepalive interval.
+//
+func (v *Vhost) SetKeepaliveInterval(d time.Duration) {
+	v.imtx.Lock()
+	defer v.imtx.Unlock()
+	v.keepaliveInterval = d
+}
+
+// KeepaliveInterval returns the keepalive interval, zero if keepalive
+// is disabled. Threadsafe.
+func (v *Vhost) KeepaliveInterval() time.Duration {
+	v.imtx.Lock()
+	defer v.imtx.Unlock()
+	return v.keepaliveInterval
+}
+
+// SetIdleTimeout configures after what time of inactivity the websocket
+// clients are disconnected. Pongs are not considered an activity. Zero
+// disables the idle timeout. Threadsafe, affects only the clients
+// connected afterwards.
+//
+// d - The idle timeout.
+//
+func (v *Vhost) SetIdleTimeout(d time.Duration) {
+	v.imtx.Lock()
+	defer v.imtx.Unlock()
+	v.idleTimeout = d
+}
+
+// IdleTimeout returns the idle timeout, zero if disabled. Threadsafe.
+func (v *Vhost) IdleTimeout() time.Duration {
+	v.imtx.Lock()
+	defer v.imtx.Unlock()
+	return v.idleTimeout
+}
+
+// SetRateLimits replaces the rate limits of the frontend events. Limits
+// are specified per event name, events not listed in here are not limited.
+// Threadsafe, affects all the connected clients.
+//
+// limits - The limits map (event name => limits).
+//
+func (v *Vhost) SetRateLimits(limits map[string]*EventRateLimits) {
+	v.imtx.Lock()
+	defer v.imtx.Unlock()
+	v.rateLimits = make(map[string]*EventRateLimits)
+	for event, l := range limits {
+		if l != nil {
+			v.rateLimits[event] = l
+		}
+	}
+}
+
+// RateLimits returns the rate limits of the frontend events. Threadsafe.
+func (v *Vhost) RateLimits() map[string]*EventRateLimits {
+	v.imtx.Lock()
+	defer v.imtx.Unlock()
+	limits := make(map[string]*EventRateLimits)
+	for event, l := range v.rateLimits {
+		limits[event] = l
+	}
+	return limits
+}
+
+// SetRateLimitViolations configures how many rate limit violations are
+// tolerated before the client is disconnected. By default clients can
+// exceed the limits 10 times at once, and once per 6 seconds afterwards.
+// Threadsafe, affects all the connected clients.
+//
+// limit - The violations limit, nil restores the default one.
+//
+func (v *Vhost) SetRateLimitViolations(limit *RateLimit) {
+	v.imtx.Lock()
+	defer v.imtx.Unlock()
+	v.violationsLimit = limit
+}
+
+// RateLimitViolations returns the limit of the rate limit violations.
+// Threadsafe.
+func (v *Vhost) RateLimitViolations() RateLimit {
+	return *v.rateLimitViolations()
+}
+
+// AddAllowedOrigin appends the specified origin to the list of origins
+// from which the frontend clients can connect. Once the list is not empty,
+// clients connecting from other origins are rejected. Threadsafe, called
+// from the admin interface.
+//
+// origin - The origin to be allowed, see normalizeOrigin for the format.
+//
+// Examples
+//
+//     v.AddAllowedOrigin("https://example.com")
+//     v.AddAllowedOrigin("*.example.com")
+//
+// Returns an error if something went wrong.
+func (v *Vhost) AddAllowedOrigin(origin string) (err error) {
+	if origin, err = normalizeOrigin(origin); err != nil {
+		return
+	}
+	v.imtx.Lock()
+	defer v.imtx.Unlock()
+	for _, allowed := range v.origins {
+		if allowed == origin {
+			return errors.New("origin already allowed")
+		}
+	}
+	v.origins = append(v.origins, origin)
+	if v.ctx != nil && v.ctx.isStorageEnabled() {
+		v.ctx.storage.UpdateVhost(v)
+	}
+	return
+}
+
+// DeleteAllowedOrigin removes the specified origin from the list of
+// allowed origins. Threadsafe, called from the admin interface.
+//
+// origin - The origin to be removed.
+//
+// Returns an error if something went wrong.
+func (v *Vhost) DeleteAllowedOrigin(origin string) (err error) {
+	if origin, err = normalizeOrigin(origin); err != nil {
+		return
+	}
+	v.imtx.Lock()
+	defer v.imtx.Unlock()
+	origins := make([]string, 0, len(v.origins))
+	for _, allowed := range v.origins {
+		if allowed != origin {
+			origins = append(origins, allowed)
+		}
+	}
+	if len(origins) == len(v.origins) {
+		return errors.New("origin not allowed")
+	}
+	v.origins = origins
+	if v.ctx != nil && v.ctx.isStorageEnabled() {
+		v.ctx.storage.UpdateVhost(v)
+	}
+	return
+}
+
+// AllowedOrigins returns list of the origins from which the frontend
+// clients can connect, empty if all are allowed. Threadsafe.
+func (v *Vhost) AllowedOrigins() []string {
+	v.imtx.Lock()
+	defer v.imtx.Unlock()
+	origins := make([]string, len(v.origins))
+	copy(origins, v.origins)
+	return origins
+}
+
+// SetConnectionLimits configures maximum numbers of the frontend
+// connections, in total and per remote IP or user. Nil or zero limits
+// mean no limits. Threadsafe, connections exceeding new limits are not
+// closed, only the new ones are rejected.
+//
+// limits - The connection limits.
+//
+func (v *Vhost) SetConnectionLimits(limits *ConnectionLimits) {
+	v.imtx.Lock()
+	defer v.imtx.Unlock()
+	if limits != nil && *limits == (ConnectionLimits{}) {
+		limits = nil
+	}
+	v.connectionLimits = limits
+}
+
+// ConnectionLimits returns the limits of the frontend connections.
+// Threadsafe.
+func (v *Vhost) ConnectionLimits() ConnectionLimits {
+	if limits := v.frontendConnectionLimits(); limits != nil {
+		return *limits
+	}
+	return ConnectionLimits{}
+}
+
+// SetMessageLimits configures maximum size, nesting depth and number
+// of keys of the messages received from the websocket clients and backend
+// connections. Nil or zero limits mean no limits. Threadsafe, affects all
+// the connected clients.
+//
+// limits - The message limits.
+//
+func (v *Vhost) SetMessageLimits(limits *MessageLimits) {
+	v.imtx.Lock()
+	defer v.imtx.Unlock()
+	if limits != nil && *limits == (MessageLimits{}) {
+		limits = nil
+	}
+	v.messageLimits = limits
+}
+
+// MessageLimits returns the limits of the received messages. Threadsafe.
+func (v *Vhost) MessageLimits() MessageLimits {
+	if limits := v.receivedMessageLimits(); limits != nil {
+		return *limits
+	}
+	return MessageLimits{}
+}
+
+// SetOutboundQueue configures size of the outbound queue of the websocket
+// clients and what happens when the client doesn't keep up with the
+// messages sent to it and its queue gets full. By default the queue holds
+// 256 messages and slow clients are disconnected. Threadsafe, affects
+// new connections only.
+//
+// queue - The outbound queue settings, nil restores the default ones.
+//
+func (v *Vhost) SetOutboundQueue(queue *OutboundQueue) {
+	v.imtx.Lock()
+	defer v.imtx.Unlock()
+	if queue == nil {
+		queue = &OutboundQueue{}
+	}
+	v.outboundQueue = *queue
+}
+
+// OutboundQueue returns the outbound queue settings of the websocket
+// clients. Threadsafe.
+func (v *Vhost) OutboundQueue() OutboundQueue {
+	v.imtx.Lock()
+	defer v.imtx.Unlock()
+	q := v.outboundQueue
+	q.Size = q.size()
+	return q
+}
+
+// SetEphemeralTimeout changes the time after which the ephemeral channels
+// opened by the backend or admin are closed when nobody subscribes them.
+// Threadsafe, the channels opened already are not affected.
+//
+// d - The timeout, zero restores the default one minute.
+//
+func (v *Vhost) SetEphemeralTimeout(d time.Duration) {
+	v.imtx.Lock()
+	defer v.imtx.Unlock()
+	v.ephemeralTimeout = d
+}
+
+// EphemeralTimeout returns the time after which the empty ephemeral
+// channels are closed. Threadsafe.
+func (v *Vhost) EphemeralTimeout() time.Duration {
+	v.imtx.Lock()
+	defer v.imtx.Unlock()
+	if v.ephemeralTimeout <= 0 {
+		return defaultEmptyChannelTimeout
+	}
+	return v.ephemeralTimeout
+}
+
+// SetPresenceByUid changes whether the presence channels aggregate their
+// subscribers by the user ID, so the user connected many times (eg. from
+// many browser tabs) joins the channel with the first connection and leaves
+// it when the last one is gone. Threadsafe, affects the channels opened
+// already as well.
+//
+// enabled - Whether the presence is aggregated by the user ID.
+//
+func (v *Vhost) SetPresenceByUid(enabled bool) {
+	v.imtx.Lock()
+	defer v.imtx.Unlock()
+	v.presenceByUid = enabled
+}
+
+// PresenceByUid returns whether the presence channels aggregate their
+// subscribers by the user ID. Threadsafe.
+func (v *Vhost) PresenceByUid() bool {
+	v.imtx.Lock()
+	defer v.imtx.Unlock()
+	return v.presenceByUid
+}
+
+// SetPublicChannelMetadata changes whether the channels' metadata is sent
+// to the clients in the subscription confirmations. Threadsafe, affects
+// the channels opened already as well.
+//
+// enabled - Whether the metadata is public.
+//
+func (v *Vhost) SetPublicChannelMetadata(enabled bool) {
+	v.imtx.Lock()
+	defer v.imtx.Unlock()
+	v.publicChannelMetadata = enabled
+}
+
+// PublicChannelMetadata returns whether the channels' metadata is sent to
+// the clients. Threadsafe.
+func (v *Vhost) PublicChannelMetadata() bool {
+	v.imtx.Lock()
+	defer v.imtx.Unlock()
+	return v.publicChannelMetadata
+}
+
+// SetAutoChannels configures which channels are created when the client
+// subscribes them for the first time. Such channels are ephemeral, kept
+// in memory only and closed when nobody subscribes them for the specified
+// time. Threadsafe, the channels created already are not affected.
+//
+// auto - The auto-created channels policy, nil disables creating channels.
+//
+// Returns an error if any of the patterns is invalid.
+func (v *Vhost) SetAutoChannels(auto *AutoChannels) error {
+	if auto == nil {
+		auto = &AutoChannels{}
+	}
+	patterns, err := auto.compile()
+	if err != nil {
+		return err
+	}
+	v.imtx.Lock()
+	defer v.imtx.Unlock()
+	v.autoChannels = *auto
+	v.autoChannels.Patterns = append([]string{}, auto.Patterns...)
+	v.autoPatterns = patterns
+	return nil
+}
+
+// AutoChannels returns the policy of the channels created on the first
+// subscribe. Threadsafe.
+func (v *Vhost) AutoChannels() AutoChannels {
+	v.imtx.Lock()
+	defer v.imtx.Unlock()
+	auto := v.autoChannels
+	auto.Patterns = append([]string{}, auto.Patterns...)
+	auto.EmptyTimeout = auto.emptyTimeout()
+	return auto
+}
+
+// SetBroadcastPolicies replaces the policies specifying who can broadcast
+// events to the channels from the frontend. Policies are declared per
+// channel name or wildcard pattern, eg. 'chat.*', and the most specific
+// one applies: the channel's name, then the longest matching pattern.
+// Anyone can broadcast to the channels not matching any policy. Threadsafe,
+// affects all the channels.
+//
+// policies - The policies map (channel name or pattern => policy).
+//
+// Returns an error if any of the policies is invalid.
+func (v *Vhost) SetBroadcastPolicies(policies map[string]*BroadcastPolicy) error {
+	rules := make([]*broadcastRule, 0, len(policies))
+	for channel, p := range policies {
+		if p == nil {
+			continue
+		}
+		r, err := newBroadcastRule(channel, *p)
+		if err != nil {
+			return fmt.Errorf("'%s': %v", channel, err)
+		}
+		r.policy.EventPrefixes = append([]string{}, p.EventPrefixes...)
+		rules = append(rules, r)
+	}
+	sortBroadcastRules(rules)
+	v.imtx.Lock()
+	defer v.imtx.Unlock()
+	v.broadcastRules = rules
+	return nil
+}
+
+// BroadcastPolicies returns the broadcast policies of the channels.
+// Threadsafe.
+func (v *Vhost) BroadcastPolicies() map[string]BroadcastPolicy {
+	v.imtx.Lock()
+	defer v.imtx.Unlock()
+	policies := make(map[string]BroadcastPolicy)
+	for _, r := range v.broadcastRules {
+		p := r.policy
+		p.EventPrefixes = append([]string{}, p.EventPrefixes...)
+		policies[r.channels.pattern] = p
+	}
+	return policies
+}
+
+// ConnectionStats returns current numbers of the frontend connections
+// established within the vhost, and numbers of the clients and messages
+// lost because of the full outbound queues. Suspended sessions are not
+// counted. Threadsafe.
+func (v *Vhost) ConnectionStats() *ConnectionStats {
+	if v.ctx != nil && v.ctx.websocket != nil {
+		if h := v.ctx.websocket.handlers.Match(v.path); h != nil {
+			stats := h.tracker.stats()
+			stats.SlowConsumers, stats.DroppedMessages = h.outbound.load()
+			return stats
+		}
+	}
+	return newConnectionTracker().stats()
 }
 
 // Kill stops execution of this vhost.
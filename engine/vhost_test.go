@@ -15,7 +15,10 @@
 
 package engine
 
-import "testing"
+import (
+	"testing"
+	"time"
+)
 
 func newTestVhost() (v *Vhost, err error) {
 	ctx := NewContext()
@@ -121,3 +124,242 @@ func TestVhostChannelsList(t *testing.T) {
 		t.Errorf("Expected the vhost's channels list to contain registered channel")
 	}
 }
+
+func TestVhostSubscribePattern(t *testing.T) {
+	v, _ := newTestVhost()
+	existing, _ := v.OpenChannel("orders.1", ChannelNormal)
+	other, _ := v.OpenChannel("invoices.1", ChannelNormal)
+	c := newFallbackConnection(&recordingTransport{})
+	p, _ := newChannelPattern("orders.*")
+	v.subscribePattern(c, p)
+	if !existing.HasSubscriber(c) {
+		t.Errorf("Expected to subscribe the matching channel opened already")
+	}
+	if other.HasSubscriber(c) {
+		t.Errorf("Expected to not subscribe the channel not matching the pattern")
+	}
+	later, _ := v.OpenChannel("orders.2", ChannelNormal)
+	if !later.HasSubscriber(c) {
+		t.Errorf("Expected to subscribe the matching channel opened later")
+	}
+	if s := later.Subscribers()[c.Id()]; s == nil || s.Pattern() != "orders.*" {
+		t.Errorf("Expected the subscription to be created via the pattern")
+	}
+}
+
+func TestVhostSubscribePatternToPrivateChannels(t *testing.T) {
+	v, _ := newTestVhost()
+	allowed, _ := v.OpenChannel("private-orders.1", ChannelPrivate)
+	forbidden, _ := v.OpenChannel("private-orders.2", ChannelPrivate)
+	c := newFallbackConnection(&recordingTransport{})
+	perm, _ := NewPermission("joe", "private-orders.1")
+	c.authenticate(perm)
+	p, _ := newChannelPattern("private-orders.*")
+	v.subscribePattern(c, p)
+	if !allowed.HasSubscriber(c) {
+		t.Errorf("Expected to subscribe the allowed private channel")
+	}
+	if forbidden.HasSubscriber(c) {
+		t.Errorf("Expected to not subscribe the forbidden private channel")
+	}
+	guest := newFallbackConnection(&recordingTransport{})
+	v.subscribePattern(guest, p)
+	if allowed.HasSubscriber(guest) {
+		t.Errorf("Expected to not subscribe the private channel without authentication")
+	}
+}
+
+func TestVhostUnsubscribePattern(t *testing.T) {
+	v, _ := newTestVhost()
+	matched, _ := v.OpenChannel("orders.1", ChannelNormal)
+	explicit, _ := v.OpenChannel("orders.2", ChannelNormal)
+	overlapping, _ := v.OpenChannel("orders.eu", ChannelNormal)
+	c := newFallbackConnection(&recordingTransport{})
+	explicit.subscribe(c, false, map[string]interface{}{}, "", nil)
+	p, _ := newChannelPattern("orders.*")
+	v.subscribePattern(c, p)
+	eu, _ := newChannelPattern("*.eu")
+	v.subscribePattern(c, eu)
+	if !v.unsubscribePattern(c, "orders.*") {
+		t.Errorf("Expected to unsubscribe the pattern")
+	}
+	if matched.HasSubscriber(c) {
+		t.Errorf("Expected to unsubscribe the channel subscribed via the pattern")
+	}
+	if !explicit.HasSubscriber(c) {
+		t.Errorf("Expected to keep the channel subscribed explicitly")
+	}
+	if !overlapping.HasSubscriber(c) {
+		t.Errorf("Expected to keep the channel matched by the other pattern")
+	}
+	if v.unsubscribePattern(c, "orders.*") {
+		t.Errorf("Expected to not unsubscribe the pattern twice")
+	}
+	v.OpenChannel("orders.3", ChannelNormal)
+	if ch, _ := v.Channel("orders.3"); ch.HasSubscriber(c) {
+		t.Errorf("Expected to not subscribe the channels matching the unsubscribed pattern")
+	}
+}
+
+func TestVhostForgetsKilledPatternSubscribers(t *testing.T) {
+	v, _ := newTestVhost()
+	c := newFallbackConnection(&recordingTransport{})
+	p, _ := newChannelPattern("orders.*")
+	v.subscribePattern(c, p)
+	c.Kill()
+	ch, _ := v.OpenChannel("orders.1", ChannelNormal)
+	if ch.HasSubscriber(c) {
+		t.Errorf("Expected to not subscribe the killed connection")
+	}
+	if len(v.patternClients) != 0 {
+		t.Errorf("Expected to forget the killed connection")
+	}
+}
+
+func TestVhostSetAutoChannels(t *testing.T) {
+	v, _ := newTestVhost()
+	if err := v.SetAutoChannels(&AutoChannels{Patterns: []string{"chat/*"}}); err == nil {
+		t.Errorf("Expected to throw an error while setting invalid pattern")
+	}
+	if err := v.SetAutoChannels(&AutoChannels{Patterns: []string{"chat.*"}}); err != nil {
+		t.Errorf("Expected to set the auto-created channels without errors")
+	}
+	if auto := v.AutoChannels(); len(auto.Patterns) != 1 || auto.EmptyTimeout != defaultEmptyChannelTimeout {
+		t.Errorf("Expected to get the auto-created channels with the default timeout, given %v", auto)
+	}
+	v.SetAutoChannels(nil)
+	if auto := v.AutoChannels(); len(auto.Patterns) != 0 {
+		t.Errorf("Expected to disable the auto-created channels")
+	}
+}
+
+func TestVhostChannelMetadata(t *testing.T) {
+	v, _ := newTestVhost()
+	ch, _ := v.OpenChannel("hello", ChannelNormal)
+	if err := v.SetChannelMetadata("world", "title", "World"); err == nil {
+		t.Errorf("Expected to throw an error while setting metadata of not existing channel")
+	}
+	if err := v.SetChannelMetadata("hello", "", "Hello"); err == nil {
+		t.Errorf("Expected to throw an error while setting metadata with empty key")
+	}
+	if err := v.SetChannelMetadata("hello", "title", "Hello"); err != nil {
+		t.Errorf("Expected to set the channel's metadata without errors")
+	}
+	metadata := ch.Metadata()
+	if len(metadata) != 1 || metadata["title"] != "Hello" {
+		t.Errorf("Expected to get the channel's metadata, given %v", metadata)
+	}
+	metadata["title"] = "Changed"
+	if ch.Metadata()["title"] != "Hello" {
+		t.Errorf("Expected to get a copy of the channel's metadata")
+	}
+	if err := v.DeleteChannelMetadata("hello", "owner"); err == nil {
+		t.Errorf("Expected to throw an error while deleting not existing key")
+	}
+	if err := v.DeleteChannelMetadata("hello", "title"); err != nil || len(ch.Metadata()) != 0 {
+		t.Errorf("Expected to delete the channel's metadata")
+	}
+}
+
+func TestVhostSetBroadcastPolicies(t *testing.T) {
+	v, _ := newTestVhost()
+	err := v.SetBroadcastPolicies(map[string]*BroadcastPolicy{"chat/*": &BroadcastPolicy{}})
+	if err == nil {
+		t.Errorf("Expected to throw an error while setting invalid policy")
+	}
+	err = v.SetBroadcastPolicies(map[string]*BroadcastPolicy{
+		"chat.*":        &BroadcastPolicy{Allow: BroadcastAuthenticated},
+		"chat.lobby":    &BroadcastPolicy{Allow: BroadcastNobody},
+		"announcements": nil,
+	})
+	if err != nil {
+		t.Errorf("Expected to set the broadcast policies without errors")
+	}
+	if policies := v.BroadcastPolicies(); len(policies) != 2 || policies["chat.lobby"].Allow != BroadcastNobody {
+		t.Errorf("Expected to get the broadcast policies, given %v", policies)
+	}
+	p, _ := NewPermission("joe", ".*")
+	c := newFallbackConnection(&recordingTransport{})
+	c.authenticate(p)
+	if !v.isBroadcastAllowed(c, "chat.1", "hello") {
+		t.Errorf("Expected to allow broadcasting according to the pattern's policy")
+	}
+	if v.isBroadcastAllowed(c, "chat.lobby", "hello") {
+		t.Errorf("Expected the channel's policy to take precedence")
+	}
+	if !v.isBroadcastAllowed(newFallbackConnection(&recordingTransport{}), "other", "hello") {
+		t.Errorf("Expected to allow broadcasting to the channel without policy")
+	}
+}
+
+func TestVhostOpenAutoChannel(t *testing.T) {
+	v, _ := newTestVhost()
+	v.SetAutoChannels(&AutoChannels{Patterns: []string{"presence-chat.*"}, EmptyTimeout: 50 * time.Millisecond})
+	if _, err := v.openAutoChannel("other"); err == nil {
+		t.Errorf("Expected to not create the channel not matching the policy")
+	}
+	ch, err := v.openAutoChannel("presence-chat.1")
+	if err != nil || ch == nil {
+		t.Errorf("Expected to create the channel without errors")
+		return
+	}
+	if !ch.IsAutoCreated() || !ch.IsPresence() || ch.isPersisted() {
+		t.Errorf("Expected to create not persisted presence channel")
+	}
+	if same, _ := v.openAutoChannel("presence-chat.1"); same != ch {
+		t.Errorf("Expected to get the channel created already")
+	}
+	for i := 0; ch.IsAlive(); i += 1 {
+		if i >= 100 {
+			t.Fatalf("Expected to close the empty channel")
+		}
+		<-time.After(10 * time.Millisecond)
+	}
+	if _, err := v.Channel("presence-chat.1"); err == nil {
+		t.Errorf("Expected to remove the closed channel")
+	}
+}
+
+func TestVhostCloseEmptyChannelWithSubscribers(t *testing.T) {
+	v, _ := newTestVhost()
+	v.SetAutoChannels(&AutoChannels{Patterns: []string{"chat.*"}})
+	ch, _ := v.openAutoChannel("chat.1")
+	ch.subscribe(newFallbackConnection(&recordingTransport{}), false, map[string]interface{}{}, "", nil)
+	v.closeEmptyChannel(ch)
+	if !ch.IsAlive() {
+		t.Errorf("Expected to keep the channel subscribed in the meantime")
+	}
+}
+
+func TestVhostOpenEphemeralChannel(t *testing.T) {
+	v, _ := newTestVhost()
+	v.SetEphemeralTimeout(50 * time.Millisecond)
+	ch, err := v.OpenEphemeralChannel("hello", ChannelNormal)
+	if err != nil || ch == nil {
+		t.Errorf("Expected to create channel without errors")
+		return
+	}
+	if !ch.IsEphemeral() || ch.IsAutoCreated() || ch.isPersisted() {
+		t.Errorf("Expected to create not persisted channel")
+	}
+	for i := 0; ch.IsAlive(); i += 1 {
+		if i >= 100 {
+			t.Fatalf("Expected to close the empty channel")
+		}
+		<-time.After(10 * time.Millisecond)
+	}
+	if _, err := v.Channel("hello"); err == nil {
+		t.Errorf("Expected to remove the closed channel")
+	}
+}
+
+func TestVhostEphemeralTimeout(t *testing.T) {
+	v, _ := newTestVhost()
+	if v.EphemeralTimeout() != defaultEmptyChannelTimeout {
+		t.Errorf("Expected the default ephemeral timeout")
+	}
+	v.SetEphemeralTimeout(time.Second)
+	if v.EphemeralTimeout() != time.Second {
+		t.Errorf("Expected to change the ephemeral timeout")
+	}
+}
@@ -18,11 +18,13 @@ package engine
 import (
 	"bufio"
 	"bytes"
-	"code.google.com/p/go.net/websocket"
+	"encoding/json"
 	"fmt"
 	"github.com/nu7hatch/gouuid"
+	"golang.org/x/net/websocket"
 	"log"
 	"net"
+	"net/http"
 	"os"
 	"regexp"
 	"strings"
@@ -47,10 +49,66 @@ func init() {
 	v.OpenChannel("test", ChannelNormal)
 	v.OpenChannel("private-test", ChannelPrivate)
 	v.OpenChannel("presence-test", ChannelPresence)
+	rv, _ := ctx.AddVhost("/resume")
+	rv.SetResumeGracePeriod(time.Minute)
+	rv.OpenChannel("test", ChannelNormal)
+	kv, _ := ctx.AddVhost("/keepalive")
+	kv.SetKeepaliveInterval(50 * time.Millisecond)
+	iv, _ := ctx.AddVhost("/idle")
+	iv.SetIdleTimeout(100 * time.Millisecond)
+	lv, _ := ctx.AddVhost("/limited")
+	lv.SetRateLimits(map[string]*EventRateLimits{
+		"subscribe": &EventRateLimits{Connection: &RateLimit{Rate: 0, Burst: 2}},
+	})
+	lv.SetRateLimitViolations(&RateLimit{Rate: 0, Burst: 3})
+	cv, _ := ctx.AddVhost("/capped")
+	cv.SetConnectionLimits(&ConnectionLimits{PerIp: 1})
+	uv, _ := ctx.AddVhost("/capped-users")
+	uv.SetConnectionLimits(&ConnectionLimits{PerUid: 1})
+	ov, _ := ctx.AddVhost("/origins")
+	ov.AddAllowedOrigin("http://*.example.com")
+	bv, _ := ctx.AddVhost("/bounded")
+	bv.SetMessageLimits(&MessageLimits{MaxSize: 256, MaxDepth: 4, MaxKeys: 8})
+	mv, _ := ctx.AddVhost("/msgpack")
+	mv.OpenChannel("test", ChannelNormal)
+	sv, _ := ctx.AddVhost("/slow")
+	sv.SetOutboundQueue(&OutboundQueue{Size: 8})
+	sv.OpenChannel("test", ChannelNormal)
+	dv, _ := ctx.AddVhost("/slow-drop")
+	dv.SetOutboundQueue(&OutboundQueue{Size: 8, Policy: SlowConsumerDrop})
+	dv.OpenChannel("test", ChannelNormal)
+	cqv, _ := ctx.AddVhost("/slow-coalesce")
+	cqv.SetOutboundQueue(&OutboundQueue{Size: 8, Policy: SlowConsumerCoalesce})
+	cqv.OpenChannel("test", ChannelNormal)
+	bv.OpenChannel("test", ChannelNormal)
+	pv, _ := ctx.AddVhost("/patterns")
+	pv.OpenChannel("orders.1", ChannelNormal)
+	pv.OpenChannel("private-orders.1", ChannelPrivate)
+	pv.OpenChannel("private-orders.2", ChannelPrivate)
+	mdv, _ := ctx.AddVhost("/metadata")
+	mdv.SetPublicChannelMetadata(true)
+	mdv.OpenChannel("test", ChannelNormal)
+	mdv.SetChannelMetadata("test", "title", "Test room")
+	brv, _ := ctx.AddVhost("/broadcasts")
+	brv.OpenChannel("readonly", ChannelNormal)
+	brv.OpenChannel("chat", ChannelNormal)
+	brv.SetBroadcastPolicies(map[string]*BroadcastPolicy{
+		"readonly": &BroadcastPolicy{Allow: BroadcastNobody},
+		"chat":     &BroadcastPolicy{Allow: BroadcastAuthenticated, EventPrefixes: []string{"client-"}},
+	})
+	av, _ := ctx.AddVhost("/auto")
+	av.SetAutoChannels(&AutoChannels{
+		Patterns:     []string{"chat.*", "private-chat.*"},
+		EmptyTimeout: 100 * time.Millisecond,
+	})
 }
 
 func websocketDial(t *testing.T) *websocket.Conn {
-	ws, err := websocket.Dial("ws://127.0.0.1:9080/test", "ws", "http://127.0.0.1/")
+	return websocketDialPath(t, "/test")
+}
+
+func websocketDialPath(t *testing.T, path string) *websocket.Conn {
+	ws, err := websocket.Dial("ws://127.0.0.1:9080"+path, "ws", "http://127.0.0.1/")
 	if err != nil {
 		fmt.Printf("%v\n", err)
 		os.Exit(1)
@@ -93,6 +151,81 @@ func websocketExpectError(t *testing.T, ws *websocket.Conn, status string) {
 	})
 }
 
+func eventStreamDial(t *testing.T) (*http.Response, *bufio.Reader) {
+	req, _ := http.NewRequest("GET", "http://127.0.0.1:9080/test", nil)
+	req.Header.Set("Accept", "text/event-stream")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		fmt.Printf("%v\n", err)
+		os.Exit(1)
+	}
+	return resp, bufio.NewReader(resp.Body)
+}
+
+func fallbackSend(t *testing.T, session string, data interface{}) int {
+	body, _ := json.Marshal(data)
+	return fallbackSendRaw(t, session, body)
+}
+
+func fallbackSendRaw(t *testing.T, session string, body []byte) int {
+	resp, err := http.Post("http://127.0.0.1:9080/test?sid="+session, "application/json",
+		bytes.NewReader(body))
+	if err != nil {
+		t.Error(err)
+		return 0
+	}
+	resp.Body.Close()
+	return resp.StatusCode
+}
+
+func eventStreamExpectResponse(t *testing.T, r *bufio.Reader, event string,
+	data map[string]*regexp.Regexp) (msg *WebsocketMessage) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	r.ReadString('\n') // empty line ending the event
+	if !strings.HasPrefix(line, "data: ") {
+		t.Errorf("Expected an event data, given '%s'", line)
+		return
+	}
+	if msg, err = newWebsocketMessageFromJSON([]byte(line[6:])); err != nil {
+		t.Error(err)
+		return
+	}
+	if event != msg.Event() {
+		t.Errorf("Expected event to be '%s', got '%s'", event, msg.Event())
+	}
+	for key, re := range data {
+		if value, ok := msg.Get(key).(string); !ok || !re.MatchString(value) {
+			t.Errorf("Expected data to contain the proper '%s' value, given '%s'", key, value)
+		}
+	}
+	return
+}
+
+func longPollingGet(t *testing.T, query string) (int, []*WebsocketMessage) {
+	var frames []map[string]interface{}
+	resp, err := http.Get("http://127.0.0.1:9080/test?transport=polling" + query)
+	if err != nil {
+		t.Error(err)
+		return 0, nil
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		return resp.StatusCode, nil
+	}
+	if err = json.NewDecoder(resp.Body).Decode(&frames); err != nil {
+		t.Error(err)
+	}
+	msgs := make([]*WebsocketMessage, len(frames))
+	for i, frame := range frames {
+		msgs[i], _ = newWebsocketMessage(frame)
+	}
+	return resp.StatusCode, msgs
+}
+
 func backendDial(t *testing.T) net.Conn {
 	c, err := net.Dial("tcp", "127.0.0.1:9081")
 	if err != nil {
@@ -461,6 +594,32 @@ func testWebsocketPresenceChannelSubscribeBehaviour(t *testing.T,
 	}
 }
 
+func testWebsocketPresenceChannelUpdateBehaviour(t *testing.T,
+	wss []*websocket.Conn) {
+	websocketSend(t, wss[0], map[string]interface{}{
+		"updateMember": map[string]interface{}{
+			"channel": "presence-test",
+			"data":    map[string]interface{}{"status": "away"},
+		},
+	})
+	for _, ws := range wss {
+		websocketExpectResponse(t, ws, ":memberUpdated",
+			map[string]*regexp.Regexp{
+				"uid":     regexp.MustCompile("^joe\\d+"),
+				"channel": regexp.MustCompile("^presence-test$"),
+				"foo":     regexp.MustCompile("^bar$"),
+				"status":  regexp.MustCompile("^away$"),
+			})
+	}
+	websocketSend(t, wss[0], map[string]interface{}{
+		"updateMember": map[string]interface{}{
+			"channel": "test",
+			"data":    map[string]interface{}{"status": "away"},
+		},
+	})
+	websocketExpectError(t, wss[0], "Bad request")
+}
+
 func testWebsocketPresenceChannelUnsubscribeBehaviour(t *testing.T,
 	wss []*websocket.Conn) {
 	for i := range wss {
@@ -485,6 +644,817 @@ func testWebsocketPresenceChannelUnsubscribeBehaviour(t *testing.T,
 	}
 }
 
+func testWebsocketOptionsWithInvalidReplies(t *testing.T,
+	ws *websocket.Conn) {
+	websocketSend(t, ws, map[string]interface{}{
+		"options": map[string]interface{}{
+			"replies": "everything",
+		},
+	})
+	websocketExpectError(t, ws, "Bad request")
+}
+
+func testWebsocketAcknowledgements(t *testing.T, ws *websocket.Conn) {
+	websocketSend(t, ws, map[string]interface{}{
+		"subscribe": map[string]interface{}{
+			"channel": "test",
+			"id":      "s1",
+		},
+	})
+	websocketExpectResponse(t, ws, ":subscribed", nil)
+	websocketExpectResponse(t, ws, ":ack", map[string]*regexp.Regexp{
+		"id":     regexp.MustCompile("^s1$"),
+		"status": regexp.MustCompile("^Subscribed$"),
+	})
+	websocketSend(t, ws, map[string]interface{}{
+		"unsubscribe": map[string]interface{}{
+			"channel": "presence-test",
+			"id":      "u1",
+		},
+	})
+	websocketExpectResponse(t, ws, ":error", map[string]*regexp.Regexp{
+		"id":     regexp.MustCompile("^u1$"),
+		"status": regexp.MustCompile("^Not subscribed$"),
+	})
+}
+
+func testWebsocketNoReplies(t *testing.T, ws *websocket.Conn) {
+	websocketSend(t, ws, map[string]interface{}{
+		"options": map[string]interface{}{
+			"replies": "none",
+		},
+	})
+	websocketSend(t, ws, map[string]interface{}{
+		"unsubscribe": map[string]interface{}{
+			"channel": "presence-test",
+		},
+	})
+	// Neither the options nor the error are answered, so the next
+	// received event is the subscription confirmation.
+	testWebsocketSubscribeToPublicChannel(t, ws)
+}
+
+func testEventStream(t *testing.T) {
+	resp, r := eventStreamDial(t)
+	defer resp.Body.Close()
+	if ct := resp.Header.Get("Content-Type"); ct != "text/event-stream" {
+		t.Errorf("Expected event stream content type, given '%s'", ct)
+	}
+	msg := eventStreamExpectResponse(t, r, ":connected", nil)
+	if msg == nil {
+		return
+	}
+	sid, _ := msg.Get("sid").(string)
+	token, _ := msg.Get("token").(string)
+	session := sid + "&token=" + token
+	if code := fallbackSend(t, "invalid", map[string]interface{}{}); code != 404 {
+		t.Errorf("Expected to not find invalid session, given %d", code)
+	}
+	for _, hijack := range []string{sid, sid + "&token=", sid + "&token=" + sid} {
+		if code := fallbackSend(t, hijack, map[string]interface{}{}); code != 404 {
+			t.Errorf("Expected to reject session without valid token, given %d", code)
+		}
+	}
+	fallbackSend(t, session, map[string]interface{}{"hello": map[string]interface{}{}})
+	eventStreamExpectResponse(t, r, ":error", map[string]*regexp.Regexp{
+		"status": regexp.MustCompile("^Bad request$"),
+	})
+	code := fallbackSend(t, session, map[string]interface{}{
+		"subscribe": map[string]interface{}{
+			"channel": "test",
+		},
+	})
+	if code != 202 {
+		t.Errorf("Expected message to be accepted, given %d", code)
+	}
+	eventStreamExpectResponse(t, r, ":subscribed", map[string]*regexp.Regexp{
+		"channel": regexp.MustCompile("^test$"),
+	})
+	fallbackSend(t, session, map[string]interface{}{
+		"broadcast": map[string]interface{}{
+			"channel": "test",
+			"event":   "hello",
+			"data":    map[string]interface{}{"foo": "bar"},
+		},
+	})
+	eventStreamExpectResponse(t, r, "hello", map[string]*regexp.Regexp{
+		"channel": regexp.MustCompile("^test$"),
+		"foo":     regexp.MustCompile("^bar$"),
+		"sid":     regexp.MustCompile("^" + sid + "$"),
+	})
+	fallbackSend(t, session, map[string]interface{}{"close": map[string]interface{}{}})
+	if _, err := r.ReadString('\n'); err == nil {
+		t.Errorf("Expected the stream to be closed")
+	}
+}
+
+func testLongPolling(t *testing.T) {
+	_, msgs := longPollingGet(t, "")
+	if len(msgs) != 1 || msgs[0] == nil || msgs[0].Event() != ":connected" {
+		t.Errorf("Expected to get connected, given %v", msgs)
+		return
+	}
+	sid, _ := msgs[0].Get("sid").(string)
+	token, _ := msgs[0].Get("token").(string)
+	session := sid + "&token=" + token
+	if code, _ := longPollingGet(t, "&sid=invalid"); code != 404 {
+		t.Errorf("Expected to not find invalid session, given %d", code)
+	}
+	if code, _ := longPollingGet(t, "&sid="+sid+"&token=invalid"); code != 404 {
+		t.Errorf("Expected to not poll session without valid token, given %d", code)
+	}
+	fallbackSend(t, session, map[string]interface{}{
+		"subscribe": map[string]interface{}{
+			"channel": "test",
+		},
+	})
+	fallbackSend(t, session, map[string]interface{}{"hello": map[string]interface{}{}})
+	if code := fallbackSendRaw(t, session, []byte("{invalid")); code != 400 {
+		t.Errorf("Expected malformed message to be rejected, given %d", code)
+	}
+	_, msgs = longPollingGet(t, "&sid="+session)
+	if len(msgs) != 3 || msgs[0].Event() != ":subscribed" || msgs[1].Event() != ":error" {
+		t.Errorf("Expected to poll queued messages, given %v", msgs)
+	}
+	fallbackSend(t, session, map[string]interface{}{"close": map[string]interface{}{}})
+	if code, _ := longPollingGet(t, "&sid="+session); code != 404 {
+		t.Errorf("Expected session to be closed, given %d", code)
+	}
+}
+
+func testWebsocketResume(t *testing.T) {
+	ws := websocketDialPath(t, "/resume")
+	msg := websocketExpectResponse(t, ws, ":connected", nil)
+	if msg == nil {
+		return
+	}
+	sid, _ := msg.Get("sid").(string)
+	token, _ := msg.Get("resumeToken").(string)
+	if token == "" {
+		t.Errorf("Expected to get a resume token")
+	}
+	rv, _ := ctx.Vhost("/resume")
+	websocketSend(t, ws, map[string]interface{}{
+		"auth": map[string]interface{}{
+			"token": rv.GenerateSingleAccessToken("joe", ".*"),
+		},
+	})
+	websocketExpectResponse(t, ws, ":authenticated", nil)
+	testWebsocketSubscribeToPublicChannel(t, ws)
+	ws.Close()
+	<-time.After(50 * time.Millisecond)
+	ch, _ := rv.Channel("test")
+	ch.Broadcast(map[string]interface{}{"missed": map[string]interface{}{}}, false)
+	<-time.After(50 * time.Millisecond)
+
+	ws = websocketDialPath(t, "/resume?resume="+token)
+	msg = websocketExpectResponse(t, ws, ":connected", map[string]*regexp.Regexp{
+		"sid": regexp.MustCompile("^" + sid + "$"),
+	})
+	if resumed, _ := msg.Get("resumed").(bool); !resumed {
+		t.Errorf("Expected the session to be resumed")
+	}
+	newToken, _ := msg.Get("resumeToken").(string)
+	if newToken == "" || newToken == token {
+		t.Errorf("Expected to get a new resume token")
+	}
+	websocketExpectResponse(t, ws, "missed", nil)
+	ch.Broadcast(map[string]interface{}{"live": map[string]interface{}{}}, false)
+	websocketExpectResponse(t, ws, "live", nil)
+	ws.Close()
+
+	ws = websocketDialPath(t, "/resume?resume="+token)
+	msg = websocketExpectResponse(t, ws, ":connected", nil)
+	if msg.Get("sid") == sid || msg.Get("resumed") != nil {
+		t.Errorf("Expected to not resume the session with used token")
+	}
+	ws.Close()
+}
+
+func testWebsocketKeepalive(t *testing.T) {
+	ws := websocketDialPath(t, "/keepalive?keepalive=events")
+	testWebsocketConnect(t, ws)
+	for i := 0; i < 3; i += 1 {
+		websocketExpectResponse(t, ws, ":ping", nil)
+		websocketSend(t, ws, map[string]interface{}{"pong": map[string]interface{}{}})
+	}
+	websocketExpectResponse(t, ws, ":ping", nil)
+	websocketExpectResponse(t, ws, ":disconnect", map[string]*regexp.Regexp{
+		"status": regexp.MustCompile("^Keepalive timeout$"),
+	})
+	var resp interface{}
+	if err := websocket.JSON.Receive(ws, &resp); err == nil {
+		t.Errorf("Expected the connection to be closed, given %v", resp)
+	}
+	ws.Close()
+}
+
+func testWebsocketKeepaliveFrames(t *testing.T) {
+	ws := websocketDialPath(t, "/keepalive")
+	testWebsocketConnect(t, ws)
+	// Ping frames are answered by the websocket library on its own and
+	// never reach the client as events.
+	var resp interface{}
+	ws.SetReadDeadline(time.Now().Add(300 * time.Millisecond))
+	if err := websocket.JSON.Receive(ws, &resp); err == nil {
+		t.Errorf("Expected no events, given %v", resp)
+	}
+	ws.SetReadDeadline(time.Time{})
+	websocketSend(t, ws, map[string]interface{}{
+		"options": map[string]interface{}{"replies": "acks"},
+	})
+	websocketExpectResponse(t, ws, ":ack", nil)
+	// Switching to the ping events.
+	websocketSend(t, ws, map[string]interface{}{
+		"options": map[string]interface{}{"keepalive": "events"},
+	})
+	websocketExpectResponse(t, ws, ":ack", nil)
+	websocketExpectResponse(t, ws, ":ping", nil)
+	websocketSend(t, ws, map[string]interface{}{
+		"options": map[string]interface{}{"keepalive": "sometimes"},
+	})
+	websocketExpectError(t, ws, "Bad request")
+	ws.Close()
+}
+
+func testWebsocketIdleTimeout(t *testing.T) {
+	ws := websocketDialPath(t, "/idle")
+	testWebsocketConnect(t, ws)
+	<-time.After(50 * time.Millisecond)
+	websocketSend(t, ws, map[string]interface{}{"hello": map[string]interface{}{}})
+	websocketExpectError(t, ws, "Bad request")
+	websocketExpectResponse(t, ws, ":disconnect", map[string]*regexp.Regexp{
+		"status": regexp.MustCompile("^Idle timeout$"),
+	})
+	ws.Close()
+}
+
+func testWebsocketRateLimits(t *testing.T) {
+	ws := websocketDialPath(t, "/limited")
+	testWebsocketConnect(t, ws)
+	subscribe := map[string]interface{}{
+		"subscribe": map[string]interface{}{"channel": "test"},
+	}
+	for i := 0; i < 2; i += 1 {
+		websocketSend(t, ws, subscribe)
+		websocketExpectError(t, ws, "Channel not found")
+	}
+	for i := 0; i < 3; i += 1 {
+		websocketSend(t, ws, subscribe)
+		websocketExpectError(t, ws, "Rate limit exceeded")
+	}
+	websocketSend(t, ws, map[string]interface{}{
+		"unsubscribe": map[string]interface{}{"channel": "test"},
+	})
+	websocketExpectError(t, ws, "Channel not found")
+	websocketSend(t, ws, subscribe)
+	websocketExpectError(t, ws, "Rate limit exceeded")
+	websocketExpectResponse(t, ws, ":disconnect", map[string]*regexp.Regexp{
+		"status": regexp.MustCompile("^Too many rate limit violations$"),
+	})
+	ws.Close()
+}
+
+func testWebsocketConnectionLimits(t *testing.T) {
+	ws := websocketDialPath(t, "/capped")
+	testWebsocketConnect(t, ws)
+	if _, err := websocket.Dial("ws://127.0.0.1:9080/capped", "ws", "http://127.0.0.1/"); err == nil {
+		t.Errorf("Expected to reject connection exceeding the limit")
+	}
+	resp, err := http.Get("http://127.0.0.1:9080/capped?transport=polling")
+	if err != nil {
+		t.Error(err)
+	} else {
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusTooManyRequests {
+			t.Errorf("Expected status 429, got %d", resp.StatusCode)
+		}
+	}
+	cv, _ := ctx.Vhost("/capped")
+	stats := cv.ConnectionStats()
+	if stats.Total != 1 || stats.PerIp["127.0.0.1"] != 1 {
+		t.Errorf("Expected to count single connection, got %v", stats)
+	}
+	ws.Close()
+	<-time.After(50 * time.Millisecond)
+	if stats = cv.ConnectionStats(); stats.Total != 0 || len(stats.PerIp) != 0 {
+		t.Errorf("Expected to release the connection, got %v", stats)
+	}
+	ws = websocketDialPath(t, "/capped")
+	testWebsocketConnect(t, ws)
+	ws.Close()
+}
+
+func testWebsocketUidConnectionLimits(t *testing.T) {
+	uv, _ := ctx.Vhost("/capped-users")
+	auth := func(ws *websocket.Conn, uid string) {
+		websocketSend(t, ws, map[string]interface{}{
+			"auth": map[string]interface{}{
+				"token": uv.GenerateSingleAccessToken(uid, ".*"),
+			},
+		})
+	}
+	ws1 := websocketDialPath(t, "/capped-users")
+	testWebsocketConnect(t, ws1)
+	auth(ws1, "joe")
+	websocketExpectResponse(t, ws1, ":authenticated", nil)
+	ws2 := websocketDialPath(t, "/capped-users")
+	testWebsocketConnect(t, ws2)
+	auth(ws2, "joe")
+	websocketExpectError(t, ws2, "Too many connections")
+	auth(ws2, "bob")
+	websocketExpectResponse(t, ws2, ":authenticated", nil)
+	stats := uv.ConnectionStats()
+	if stats.PerUid["joe"] != 1 || stats.PerUid["bob"] != 1 {
+		t.Errorf("Expected to count connections per user, got %v", stats)
+	}
+	auth(ws2, "joe")
+	websocketExpectError(t, ws2, "Too many connections")
+	if stats = uv.ConnectionStats(); stats.PerUid["joe"] != 1 || stats.PerUid["bob"] != 1 {
+		t.Errorf("Expected rejected re-authentication to keep the session, got %v", stats)
+	}
+	ws1.Close()
+	<-time.After(50 * time.Millisecond)
+	auth(ws2, "joe")
+	websocketExpectResponse(t, ws2, ":authenticated", nil)
+	if stats = uv.ConnectionStats(); len(stats.PerUid) != 1 || stats.PerUid["joe"] != 1 {
+		t.Errorf("Expected to move the connection to another user, got %v", stats)
+	}
+	ws2.Close()
+}
+
+func testWebsocketAllowedOrigins(t *testing.T) {
+	url := "ws://127.0.0.1:9080/origins"
+	if _, err := websocket.Dial(url, "ws", "http://evil.com"); err == nil {
+		t.Errorf("Expected to reject connection from not allowed origin")
+	}
+	ws, err := websocket.Dial(url, "ws", "http://chat.example.com")
+	if err != nil {
+		t.Errorf("Expected to accept connection from allowed origin, error: %v", err)
+		return
+	}
+	testWebsocketConnect(t, ws)
+	ws.Close()
+}
+
+func testFallbackCrossOrigin(t *testing.T) {
+	url := "http://127.0.0.1:9080/origins?transport=polling"
+	req, _ := http.NewRequest("OPTIONS", url, nil)
+	req.Header.Set("Origin", "http://chat.example.com")
+	req.Header.Set("Access-Control-Request-Method", "POST")
+	req.Header.Set("Access-Control-Request-Headers", "Content-Type")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	resp.Body.Close()
+	if resp.StatusCode != 204 {
+		t.Errorf("Expected preflight to be answered, given %d", resp.StatusCode)
+	}
+	if resp.Header.Get("Access-Control-Allow-Origin") != "http://chat.example.com" ||
+		!strings.Contains(resp.Header.Get("Access-Control-Allow-Methods"), "POST") ||
+		resp.Header.Get("Access-Control-Allow-Headers") != "Content-Type" {
+		t.Errorf("Expected preflight to allow the request, given %v", resp.Header)
+	}
+	req.Header.Set("Origin", "http://evil.com")
+	if resp, err = http.DefaultClient.Do(req); err == nil {
+		resp.Body.Close()
+		if resp.StatusCode != 403 || resp.Header.Get("Access-Control-Allow-Origin") != "" {
+			t.Errorf("Expected preflight from not allowed origin to be rejected, given %d", resp.StatusCode)
+		}
+	}
+	req, _ = http.NewRequest("GET", url, nil)
+	req.Header.Set("Origin", "http://chat.example.com")
+	if resp, err = http.DefaultClient.Do(req); err != nil {
+		t.Error(err)
+		return
+	}
+	resp.Body.Close()
+	if resp.Header.Get("Access-Control-Allow-Origin") != "http://chat.example.com" {
+		t.Errorf("Expected long-polling response to carry CORS headers, given %v", resp.Header)
+	}
+}
+
+func testWebsocketMessageLimits(t *testing.T) {
+	ws := websocketDialPath(t, "/bounded")
+	testWebsocketConnect(t, ws)
+	websocketSend(t, ws, map[string]interface{}{
+		"subscribe": map[string]interface{}{"channel": strings.Repeat("x", 256)},
+	})
+	websocketExpectError(t, ws, "Message too large")
+	websocketSend(t, ws, map[string]interface{}{
+		"broadcast": map[string]interface{}{
+			"channel": "test",
+			"event":   "foo",
+			"data":    map[string]interface{}{"a": map[string]interface{}{"b": []int{}}},
+		},
+	})
+	websocketExpectError(t, ws, "Message too deep")
+	keys := make(map[string]interface{})
+	for i := 0; i < 8; i += 1 {
+		keys[fmt.Sprintf("k%d", i)] = i
+	}
+	websocketSend(t, ws, map[string]interface{}{"subscribe": keys})
+	websocketExpectError(t, ws, "Too many keys")
+	// Connection still works after rejected messages.
+	websocketSend(t, ws, map[string]interface{}{
+		"subscribe": map[string]interface{}{"channel": "test"},
+	})
+	websocketExpectResponse(t, ws, ":subscribed", nil)
+	ws.Close()
+}
+
+func msgpackExpectResponse(t *testing.T, ws *websocket.Conn, event string) *WebsocketMessage {
+	var data []byte
+	if err := websocket.Message.Receive(ws, &data); err != nil {
+		t.Error(err)
+		return nil
+	}
+	msg, err := websocketMsgpackCodec{}.decode(data, nil)
+	if err != nil {
+		t.Errorf("Expected binary MessagePack frame, got %v: %q", err, data)
+		return nil
+	}
+	if msg.Event() != event {
+		t.Errorf("Expected to receive %s, got %s", event, msg.Event())
+	}
+	return msg
+}
+
+func testWebsocketMsgpackCodec(t *testing.T) {
+	config, _ := websocket.NewConfig("ws://127.0.0.1:9080/msgpack", "http://127.0.0.1/")
+	config.Protocol = []string{"msgpack"}
+	mp, err := websocket.DialConfig(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if proto := mp.Config().Protocol; len(proto) != 1 || proto[0] != "msgpack" {
+		t.Errorf("Expected msgpack subprotocol to be negotiated, got %v", proto)
+	}
+	msg := msgpackExpectResponse(t, mp, ":connected")
+	if msg != nil && msg.Get("sid") == nil {
+		t.Errorf("Expected to get the session id")
+	}
+	data, _ := msgpackMarshal(map[string]interface{}{
+		"subscribe": map[string]interface{}{"channel": "test"},
+	})
+	websocket.Message.Send(mp, data)
+	msgpackExpectResponse(t, mp, ":subscribed")
+	ws := websocketDialPath(t, "/msgpack")
+	testWebsocketConnect(t, ws)
+	websocketSend(t, ws, map[string]interface{}{
+		"subscribe": map[string]interface{}{"channel": "test"},
+	})
+	websocketExpectResponse(t, ws, ":subscribed", nil)
+	// The same broadcast delivered to the clients using different codecs.
+	mv, _ := ctx.Vhost("/msgpack")
+	ch, _ := mv.Channel("test")
+	ch.Broadcast(map[string]interface{}{"hello": map[string]interface{}{"foo": "bar"}}, false)
+	if msg = msgpackExpectResponse(t, mp, "hello"); msg != nil && msg.Get("foo") != "bar" {
+		t.Errorf("Expected to receive broadcasted data, got %v", msg.Get("foo"))
+	}
+	websocketExpectResponse(t, ws, "hello", map[string]*regexp.Regexp{
+		"foo": regexp.MustCompile("^bar$"),
+	})
+	mp.Close()
+	ws.Close()
+}
+
+// floodWebsocketChannel broadcasts enough data to the specified channel
+// to fill the socket buffers and outbound queue of a client not reading
+// anything.
+func floodWebsocketChannel(ch *Channel) {
+	data := strings.Repeat("x", 64*1024)
+	for i := 0; i < 256; i += 1 {
+		ch.Broadcast(map[string]interface{}{
+			"big": map[string]interface{}{"channel": ch.Name(), "data": data},
+		}, false)
+	}
+}
+
+func testWebsocketSlowConsumer(t *testing.T) {
+	ws := websocketDialPath(t, "/slow")
+	testWebsocketConnect(t, ws)
+	websocketSend(t, ws, map[string]interface{}{
+		"subscribe": map[string]interface{}{"channel": "test"},
+	})
+	websocketExpectResponse(t, ws, ":subscribed", nil)
+	// Client doesn't read anything, so its outbound queue gets full.
+	sv, _ := ctx.Vhost("/slow")
+	ch, _ := sv.Channel("test")
+	floodWebsocketChannel(ch)
+	for i := 0; len(ch.Subscribers()) > 0; i += 1 {
+		if i >= 100 {
+			t.Fatalf("Expected slow consumer to be disconnected")
+		}
+		<-time.After(50 * time.Millisecond)
+	}
+	if stats := sv.ConnectionStats(); stats.SlowConsumers != 1 || stats.DroppedMessages != 0 {
+		t.Errorf("Expected to count the slow consumer, got %v", stats)
+	}
+	for {
+		var resp interface{}
+		if err := websocket.JSON.Receive(ws, &resp); err != nil {
+			break
+		}
+	}
+	ws.Close()
+}
+
+func testWebsocketSlowConsumerDrop(t *testing.T) {
+	ws := websocketDialPath(t, "/slow-drop")
+	testWebsocketConnect(t, ws)
+	websocketSend(t, ws, map[string]interface{}{
+		"subscribe": map[string]interface{}{"channel": "test"},
+	})
+	websocketExpectResponse(t, ws, ":subscribed", nil)
+	dv, _ := ctx.Vhost("/slow-drop")
+	ch, _ := dv.Channel("test")
+	floodWebsocketChannel(ch)
+	for i := 0; dv.ConnectionStats().DroppedMessages == 0; i += 1 {
+		if i >= 100 {
+			t.Fatalf("Expected messages to be dropped")
+		}
+		<-time.After(50 * time.Millisecond)
+	}
+	// Client catches up and keeps receiving new messages.
+	for {
+		var resp interface{}
+		ws.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+		if err := websocket.JSON.Receive(ws, &resp); err != nil {
+			break
+		}
+	}
+	ws.SetReadDeadline(time.Time{})
+	ch.Broadcast(map[string]interface{}{"last": map[string]interface{}{}}, false)
+	websocketExpectResponse(t, ws, "last", nil)
+	if stats := dv.ConnectionStats(); stats.SlowConsumers != 0 || stats.Total != 1 {
+		t.Errorf("Expected not to disconnect the client, got %v", stats)
+	}
+	ws.Close()
+}
+
+func testWebsocketSlowConsumerCoalesce(t *testing.T) {
+	ws := websocketDialPath(t, "/slow-coalesce")
+	testWebsocketConnect(t, ws)
+	websocketSend(t, ws, map[string]interface{}{
+		"subscribe": map[string]interface{}{"channel": "test"},
+	})
+	websocketExpectResponse(t, ws, ":subscribed", nil)
+	cqv, _ := ctx.Vhost("/slow-coalesce")
+	ch, _ := cqv.Channel("test")
+	floodWebsocketChannel(ch)
+	for i := 0; cqv.ConnectionStats().DroppedMessages == 0; i += 1 {
+		if i >= 100 {
+			t.Fatalf("Expected messages to be coalesced")
+		}
+		<-time.After(50 * time.Millisecond)
+	}
+	// The latest message replaces the queued one, so it's always delivered.
+	ch.Broadcast(map[string]interface{}{
+		"big": map[string]interface{}{"channel": ch.Name(), "data": "last"},
+	}, false)
+	for {
+		var resp map[string]map[string]interface{}
+		ws.SetReadDeadline(time.Now().Add(5 * time.Second))
+		if err := websocket.JSON.Receive(ws, &resp); err != nil {
+			t.Fatalf("Expected to receive the latest message, error encountered: %v", err)
+		}
+		if resp["big"]["data"] == "last" {
+			break
+		}
+	}
+	if stats := cqv.ConnectionStats(); stats.SlowConsumers != 0 || stats.Total != 1 {
+		t.Errorf("Expected not to disconnect the client, got %v", stats)
+	}
+	ws.Close()
+}
+
+func testWebsocketPatternSubscriptions(t *testing.T) {
+	pv, _ := ctx.Vhost("/patterns")
+	ws := websocketDialPath(t, "/patterns")
+	testWebsocketConnect(t, ws)
+	websocketSend(t, ws, map[string]interface{}{
+		"auth": map[string]interface{}{
+			"token": pv.GenerateSingleAccessToken("joe", "private-orders.1"),
+		},
+	})
+	websocketExpectResponse(t, ws, ":authenticated", nil)
+	websocketSend(t, ws, map[string]interface{}{
+		"subscribe": map[string]interface{}{"channel": "orders.*"},
+	})
+	websocketExpectResponse(t, ws, ":subscribed", map[string]*regexp.Regexp{
+		"channel": regexp.MustCompile("^orders.1$"),
+		"pattern": regexp.MustCompile("^orders\\.\\*$"),
+	})
+	// Only the private channel the client is allowed to operate on
+	// is subscribed.
+	websocketSend(t, ws, map[string]interface{}{
+		"subscribe": map[string]interface{}{"channel": "private-orders.*"},
+	})
+	websocketExpectResponse(t, ws, ":subscribed", map[string]*regexp.Regexp{
+		"channel": regexp.MustCompile("^private-orders.1$"),
+		"uid":     regexp.MustCompile("^joe$"),
+	})
+	// Channels opened later on are subscribed as well.
+	pv.OpenChannel("orders.2", ChannelNormal)
+	websocketExpectResponse(t, ws, ":subscribed", map[string]*regexp.Regexp{
+		"channel": regexp.MustCompile("^orders.2$"),
+		"pattern": regexp.MustCompile("^orders\\.\\*$"),
+	})
+	ch, _ := pv.Channel("orders.2")
+	ch.Broadcast(map[string]interface{}{
+		"created": map[string]interface{}{"channel": "orders.2"},
+	}, false)
+	websocketExpectResponse(t, ws, "created", map[string]*regexp.Regexp{
+		"channel": regexp.MustCompile("^orders.2$"),
+	})
+	websocketSend(t, ws, map[string]interface{}{
+		"unsubscribe": map[string]interface{}{"channel": "private-orders.*"},
+	})
+	websocketExpectResponse(t, ws, ":unsubscribed", map[string]*regexp.Regexp{
+		"channel": regexp.MustCompile("^private-orders.1$"),
+	})
+	websocketSend(t, ws, map[string]interface{}{
+		"unsubscribe": map[string]interface{}{"channel": "private-orders.*"},
+	})
+	websocketExpectError(t, ws, "Not subscribed")
+	ws.Close()
+}
+
+func testWebsocketBroadcastPolicies(t *testing.T) {
+	brv, _ := ctx.Vhost("/broadcasts")
+	ws := websocketDialPath(t, "/broadcasts")
+	testWebsocketConnect(t, ws)
+	for _, channel := range []string{"readonly", "chat"} {
+		websocketSend(t, ws, map[string]interface{}{
+			"subscribe": map[string]interface{}{"channel": channel},
+		})
+		websocketExpectResponse(t, ws, ":subscribed", nil)
+	}
+	for _, tt := range []struct {
+		channel, event string
+	}{
+		{"readonly", "client-hello"},
+		{"chat", "client-hello"},
+	} {
+		websocketSend(t, ws, map[string]interface{}{
+			"broadcast": map[string]interface{}{"channel": tt.channel, "event": tt.event},
+		})
+		websocketExpectError(t, ws, "Forbidden")
+	}
+	websocketSend(t, ws, map[string]interface{}{
+		"auth": map[string]interface{}{"token": brv.GenerateSingleAccessToken("joe", ".*")},
+	})
+	websocketExpectResponse(t, ws, ":authenticated", nil)
+	websocketSend(t, ws, map[string]interface{}{
+		"broadcast": map[string]interface{}{"channel": "chat", "event": "hello"},
+	})
+	websocketExpectError(t, ws, "Forbidden")
+	websocketSend(t, ws, map[string]interface{}{
+		"broadcast": map[string]interface{}{"channel": "chat", "event": "client-hello"},
+	})
+	websocketExpectResponse(t, ws, "client-hello", map[string]*regexp.Regexp{
+		"channel": regexp.MustCompile("^chat$"),
+	})
+	ws.Close()
+}
+
+func testWebsocketChannelMetadata(t *testing.T) {
+	ws := websocketDialPath(t, "/metadata")
+	testWebsocketConnect(t, ws)
+	websocketSend(t, ws, map[string]interface{}{
+		"subscribe": map[string]interface{}{"channel": "test"},
+	})
+	msg := websocketExpectResponse(t, ws, ":subscribed", nil)
+	metadata, ok := msg.Get("metadata").(map[string]interface{})
+	if !ok || metadata["title"] != "Test room" {
+		t.Errorf("Expected to get the channel's metadata, got %v", msg.Get("metadata"))
+	}
+	ws.Close()
+	ws = websocketDial(t)
+	testWebsocketConnect(t, ws)
+	websocketSend(t, ws, map[string]interface{}{
+		"subscribe": map[string]interface{}{"channel": "test"},
+	})
+	msg = websocketExpectResponse(t, ws, ":subscribed", nil)
+	if msg.Get("metadata") != nil {
+		t.Errorf("Expected to not send the metadata unless it's public")
+	}
+	ws.Close()
+}
+
+func testWebsocketSubscribeFilters(t *testing.T) {
+	ws := websocketDial(t)
+	testWebsocketConnect(t, ws)
+	websocketSend(t, ws, map[string]interface{}{
+		"subscribe": map[string]interface{}{
+			"channel": "test",
+			"filter":  map[string]interface{}{"events": "wanted"},
+		},
+	})
+	websocketExpectError(t, ws, "Bad request")
+	websocketSend(t, ws, map[string]interface{}{
+		"subscribe": map[string]interface{}{
+			"channel": "test",
+			"filter": map[string]interface{}{
+				"events": []interface{}{"wanted"},
+				"where":  map[string]interface{}{"kind": "a"},
+			},
+		},
+	})
+	websocketExpectResponse(t, ws, ":subscribed", nil)
+	for _, tt := range []struct {
+		event, kind string
+	}{
+		{"unwanted", "a"},
+		{"wanted", "b"},
+		{"wanted", "a"},
+	} {
+		websocketSend(t, ws, map[string]interface{}{
+			"broadcast": map[string]interface{}{
+				"channel": "test",
+				"event":   tt.event,
+				"data":    map[string]interface{}{"kind": tt.kind},
+			},
+		})
+	}
+	websocketExpectResponse(t, ws, "wanted", map[string]*regexp.Regexp{
+		"kind": regexp.MustCompile("^a$"),
+	})
+	ws.Close()
+}
+
+func testWebsocketAutoChannels(t *testing.T) {
+	av, _ := ctx.Vhost("/auto")
+	ws := websocketDialPath(t, "/auto")
+	testWebsocketConnect(t, ws)
+	websocketSend(t, ws, map[string]interface{}{
+		"subscribe": map[string]interface{}{"channel": "lobby"},
+	})
+	websocketExpectError(t, ws, "Channel not found")
+	websocketSend(t, ws, map[string]interface{}{
+		"subscribe": map[string]interface{}{"channel": "private-chat.1"},
+	})
+	websocketExpectError(t, ws, "Forbidden")
+	if _, err := av.Channel("private-chat.1"); err == nil {
+		t.Errorf("Expected to not create the channel the client can't subscribe")
+	}
+	websocketSend(t, ws, map[string]interface{}{
+		"subscribe": map[string]interface{}{"channel": "chat.1"},
+	})
+	websocketExpectResponse(t, ws, ":subscribed", map[string]*regexp.Regexp{
+		"channel": regexp.MustCompile("^chat.1$"),
+	})
+	ch, err := av.Channel("chat.1")
+	if err != nil || !ch.IsAutoCreated() {
+		t.Fatalf("Expected to create the channel on the first subscribe")
+	}
+	// Subscribed channel is kept open.
+	<-time.After(200 * time.Millisecond)
+	if !ch.IsAlive() {
+		t.Errorf("Expected to keep the subscribed channel open")
+	}
+	websocketSend(t, ws, map[string]interface{}{
+		"unsubscribe": map[string]interface{}{"channel": "chat.1"},
+	})
+	websocketExpectResponse(t, ws, ":unsubscribed", nil)
+	for i := 0; ch.IsAlive(); i += 1 {
+		if i >= 100 {
+			t.Fatalf("Expected to close the empty channel")
+		}
+		<-time.After(20 * time.Millisecond)
+	}
+	if _, err := av.Channel("chat.1"); err == nil {
+		t.Errorf("Expected to remove the closed channel")
+	}
+	ws.Close()
+}
+
+func testBackendMessageLimits(t *testing.T) {
+	bv, _ := ctx.Vhost("/bounded")
+	sid, _ := uuid.NewV4()
+	idty := fmt.Sprintf("req:/bounded:%s:%s", bv.AccessToken(), sid.String())
+	c := backendDial(t)
+	backendSend(t, c, idty, "", "BC", "test", "foo", `{"a": {"b": {"c": {"d": {}}}}}`)
+	backendExpectError(t, c, 461)
+	c = backendDial(t)
+	backendSend(t, c, idty, "", "BC", "test", "foo", `{"data": "`+strings.Repeat("x", 256)+`"}`)
+	backendExpectError(t, c, 460)
+	c = backendDial(t)
+	backendSend(t, c, strings.Repeat("x", 5000), "", "BC")
+	backendExpectError(t, c, 460)
+	// Bogus identity doesn't lift the limit of not identified senders.
+	c = backendDial(t)
+	backendSend(t, c, "req:/not-found:token:"+sid.String(), "", "BC", "test", "foo",
+		`{"data": "`+strings.Repeat("x", 5000)+`"}`)
+	backendExpectError(t, c, 460)
+	c = backendDial(t)
+	backendSend(t, c, idty, "", "BC", "test", "foo", `{"a": 1}`)
+	backendExpectResponse(t, c, "OK")
+}
+
 func testBackendBadIdentity(t *testing.T, c net.Conn) {
 	c = backendDial(t)
 	backendSend(t, c, "bad identity", "", "OC", "test")
@@ -519,6 +1489,41 @@ func testBackendOpenNewChannel(t *testing.T, c net.Conn) {
 	}
 }
 
+func testBackendOpenEphemeralChannel(t *testing.T, c net.Conn) {
+	c = backendDial(t)
+	backendSend(t, c, backendIdty(), "", "OC", "ephemeral-test", "ephemeral")
+	backendExpectResponse(t, c, "OK")
+	ch, err := v.Channel("ephemeral-test")
+	if err != nil || ch == nil || !ch.IsEphemeral() {
+		t.Errorf("Expected to open new ephemeral channel")
+	}
+	c = backendDial(t)
+	backendSend(t, c, backendIdty(), "", "OC", "other-test", "durable")
+	backendExpectError(t, c, 400)
+}
+
+func testBackendChannelMetadata(t *testing.T, c net.Conn) {
+	c = backendDial(t)
+	backendSend(t, c, backendIdty(), "", "CM", "not-exists", "title")
+	backendExpectError(t, c, 454)
+	c = backendDial(t)
+	backendSend(t, c, backendIdty(), "", "CM", "test", "title", "Test")
+	backendExpectResponse(t, c, "OK")
+	ch, _ := v.Channel("test")
+	if ch.Metadata()["title"] != "Test" {
+		t.Errorf("Expected to set the channel's metadata")
+	}
+	c = backendDial(t)
+	backendSend(t, c, backendIdty(), "", "CM", "test", "title")
+	backendExpectResponse(t, c, "OK")
+	if _, ok := ch.Metadata()["title"]; ok {
+		t.Errorf("Expected to remove the channel's metadata")
+	}
+	c = backendDial(t)
+	backendSend(t, c, backendIdty(), "", "CM", "test", "title")
+	backendExpectError(t, c, 400)
+}
+
 func testBackendCloseNotExistingChannel(t *testing.T, c net.Conn) {
 	c = backendDial(t)
 	backendSend(t, c, backendIdty(), "", "CC", "not-exists")
@@ -623,8 +1628,37 @@ func TestAllTheThings(t *testing.T) {
 	testWebsocketUnsubscribeWithEmptyChannelName(t, ws)
 	testWebsocketUnsubscribeWithInvalidChannelName(t, ws)
 	testWebsocketUnsubscribeNotSubscribedChannel(t, ws)
+	testWebsocketOptionsWithInvalidReplies(t, ws)
+	testWebsocketNoReplies(t, ws)
+	ws.Close()
+
+	ws = websocketDialPath(t, "/test?replies=acks")
+	testWebsocketConnect(t, ws)
+	testWebsocketAcknowledgements(t, ws)
 	ws.Close()
 
+	testEventStream(t)
+	testLongPolling(t)
+	testWebsocketResume(t)
+	testWebsocketKeepalive(t)
+	testWebsocketKeepaliveFrames(t)
+	testWebsocketIdleTimeout(t)
+	testWebsocketRateLimits(t)
+	testWebsocketConnectionLimits(t)
+	testWebsocketUidConnectionLimits(t)
+	testWebsocketAllowedOrigins(t)
+	testFallbackCrossOrigin(t)
+	testWebsocketMessageLimits(t)
+	testWebsocketMsgpackCodec(t)
+	testWebsocketSlowConsumer(t)
+	testWebsocketSlowConsumerDrop(t)
+	testWebsocketSlowConsumerCoalesce(t)
+	testWebsocketPatternSubscriptions(t)
+	testWebsocketAutoChannels(t)
+	testWebsocketBroadcastPolicies(t)
+	testWebsocketSubscribeFilters(t)
+	testWebsocketChannelMetadata(t)
+
 	ws = websocketDial(t)
 	testWebsocketConnect(t, ws)
 	testWebsocketSubscribeToPublicChannel(t, ws)
@@ -642,6 +1676,7 @@ func TestAllTheThings(t *testing.T) {
 		testWebsocketAuthenticationWithValidToken(t, wss[i], fmt.Sprintf("joe%d", i))
 	}
 	testWebsocketPresenceChannelSubscribeBehaviour(t, wss[:])
+	testWebsocketPresenceChannelUpdateBehaviour(t, wss[:])
 	testWebsocketPresenceChannelUnsubscribeBehaviour(t, wss[:])
 	for i := range wss {
 		wss[i].Close()
@@ -670,10 +1705,13 @@ func TestAllTheThings(t *testing.T) {
 	}
 
 	testBackendBadIdentity(t, req)
+	testBackendMessageLimits(t)
 	testBackendOpenChannelWithoutName(t, req)
 	testBackendOpenChannelWithInvalidName(t, req)
 	testBackendOpenExistingChannel(t, req)
 	testBackendOpenNewChannel(t, req)
+	testBackendOpenEphemeralChannel(t, req)
+	testBackendChannelMetadata(t, req)
 	testBackendCloseChannelWithoutName(t, req)
 	testBackendCloseChannelWithInvalidName(t, req)
 	testBackendCloseNotExistingChannel(t, req)
@@ -0,0 +1,176 @@
+// Copyright (C) 2011 by Krzysztof Kowalik <chris@nu7hat.ch>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package engine
+
+import (
+	"encoding/json"
+	"errors"
+	"sync"
+)
+
+// websocketCodec is an interface implemented by the encodings of the
+// websocket frontend protocol. Codecs are negotiated with the clients
+// via the websocket subprotocol.
+type websocketCodec interface {
+	// encode serializes given payload into a frame, string frames
+	// are sent as text, byte slices as binary frames.
+	encode(payload interface{}) (interface{}, error)
+	// decode parses received frame into the message, checking given
+	// limits on the way.
+	decode(data []byte, limits *MessageLimits) (*WebsocketMessage, error)
+}
+
+// websocketJSONCodec encodes messages with JSON and sends them as text
+// frames. It's the default codec.
+type websocketJSONCodec struct{}
+
+// websocketMsgpackCodec encodes messages with MessagePack and sends them
+// as binary frames.
+type websocketMsgpackCodec struct{}
+
+// Available codecs, by the subprotocol names.
+var websocketCodecs = map[string]websocketCodec{
+	"json":    websocketJSONCodec{},
+	"msgpack": websocketMsgpackCodec{},
+}
+
+// websocketFrame wraps the payload sent to many clients (eg. broadcasted
+// message), so it's encoded only once per codec, not once per client.
+type websocketFrame struct {
+	// The data to be sent.
+	payload interface{}
+	// Encoded payload (by codec).
+	encoded map[websocketCodec]interface{}
+	// Internal semaphore.
+	mtx sync.Mutex
+}
+
+// Internal constructor
+// -----------------------------------------------------------------------------
+
+// newWebsocketFrame creates new shared frame for the specified payload.
+// Payload mustn't be modified once the frame is created.
+//
+// payload - The data to be sent.
+//
+// Returns new frame.
+func newWebsocketFrame(payload interface{}) *websocketFrame {
+	return &websocketFrame{
+		payload: payload,
+		encoded: make(map[websocketCodec]interface{}),
+	}
+}
+
+// Internal
+// -----------------------------------------------------------------------------
+
+// negotiateWebsocketCodec picks the first supported codec from the
+// subprotocols requested by the client.
+//
+// protocols - The subprotocols requested by the client.
+//
+// Returns name of the chosen subprotocol and its codec, or an empty name
+// and the default codec if none is supported.
+func negotiateWebsocketCodec(protocols []string) (string, websocketCodec) {
+	for _, name := range protocols {
+		if codec, ok := websocketCodecs[name]; ok {
+			return name, codec
+		}
+	}
+	return "", websocketJSONCodec{}
+}
+
+// encodeWebsocketFrame serializes given payload with the specified codec.
+// Shared frames are reusing their cached encoding.
+//
+// codec   - The codec to be used.
+// payload - The data to be serialized.
+//
+// Returns encoded frame or an error if something went wrong.
+func encodeWebsocketFrame(codec websocketCodec, payload interface{}) (interface{}, error) {
+	if frame, ok := payload.(*websocketFrame); ok {
+		return frame.encode(codec)
+	}
+	return codec.encode(payload)
+}
+
+// encode returns the frame's payload encoded with given codec, serializing
+// it on the first use. Threadsafe, called by all the receivers of the frame.
+//
+// codec - The codec to be used.
+//
+// Returns encoded payload or an error if something went wrong.
+func (f *websocketFrame) encode(codec websocketCodec) (interface{}, error) {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	if data, ok := f.encoded[codec]; ok {
+		return data, nil
+	}
+	data, err := codec.encode(f.payload)
+	if err != nil {
+		return nil, err
+	}
+	f.encoded[codec] = data
+	return data, nil
+}
+
+// MarshalJSON implements the json.Marshaler interface, so the fallback
+// transports are reusing the cached JSON encoding as well.
+func (f *websocketFrame) MarshalJSON() ([]byte, error) {
+	data, err := f.encode(websocketJSONCodec{})
+	if err != nil {
+		return nil, err
+	}
+	return []byte(data.(string)), nil
+}
+
+// encode implements the websocketCodec interface.
+func (websocketJSONCodec) encode(payload interface{}) (interface{}, error) {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return nil, err
+	}
+	return string(data), nil
+}
+
+// decode implements the websocketCodec interface.
+func (websocketJSONCodec) decode(data []byte, limits *MessageLimits) (*WebsocketMessage, error) {
+	if err := limits.check(data); err != nil {
+		return nil, err
+	}
+	return newWebsocketMessageFromJSON(data)
+}
+
+// encode implements the websocketCodec interface.
+func (websocketMsgpackCodec) encode(payload interface{}) (interface{}, error) {
+	return msgpackMarshal(payload)
+}
+
+// decode implements the websocketCodec interface.
+func (websocketMsgpackCodec) decode(data []byte, limits *MessageLimits) (*WebsocketMessage, error) {
+	if max := limits.maxSize(); max > 0 && len(data) > max {
+		return nil, errMessageTooLarge
+	}
+	decoded, err := msgpackUnmarshal(data, limits)
+	if err != nil {
+		return nil, err
+	}
+	payload, ok := decoded.(map[string]interface{})
+	if !ok {
+		return nil, errors.New("invalid message format")
+	}
+	return newWebsocketMessage(payload)
+}
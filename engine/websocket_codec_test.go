@@ -0,0 +1,71 @@
+// Copyright (C) 2011 by Krzysztof Kowalik <chris@nu7hat.ch>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package engine
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestNegotiateWebsocketCodec(t *testing.T) {
+	if name, codec := negotiateWebsocketCodec([]string{"ws", "msgpack", "json"}); name != "msgpack" || codec != (websocketMsgpackCodec{}) {
+		t.Errorf("Expected msgpack codec to be chosen, got %s", name)
+	}
+	if name, codec := negotiateWebsocketCodec([]string{"ws"}); name != "" || codec != (websocketJSONCodec{}) {
+		t.Errorf("Expected JSON codec to be the default, got %s", name)
+	}
+}
+
+func TestWebsocketCodecsDecode(t *testing.T) {
+	payload := map[string]interface{}{"subscribe": map[string]interface{}{"channel": "foo"}}
+	for name, codec := range websocketCodecs {
+		frame, err := codec.encode(payload)
+		if err != nil {
+			t.Fatalf("Expected to encode with %s codec, got %v", name, err)
+		}
+		var data []byte
+		switch x := frame.(type) {
+		case string:
+			data = []byte(x)
+		case []byte:
+			data = x
+		}
+		msg, err := codec.decode(data, nil)
+		if err != nil || msg.Event() != "subscribe" || msg.Get("channel") != "foo" {
+			t.Errorf("Expected to decode the message with %s codec, got %v", name, err)
+		}
+		limits := &MessageLimits{MaxDepth: 1}
+		if _, err = codec.decode(data, limits); err != errMessageTooDeep {
+			t.Errorf("Expected %s codec to check the limits, got %v", name, err)
+		}
+	}
+}
+
+func TestWebsocketFrameEncodedOncePerCodec(t *testing.T) {
+	frame := newWebsocketFrame(map[string]interface{}{"foo": map[string]interface{}{}})
+	a, _ := encodeWebsocketFrame(websocketMsgpackCodec{}, frame)
+	b, _ := encodeWebsocketFrame(websocketMsgpackCodec{}, frame)
+	if &a.([]byte)[0] != &b.([]byte)[0] {
+		t.Errorf("Expected the frame to be encoded only once")
+	}
+	data, err := json.Marshal([]interface{}{frame})
+	if err != nil || string(data) != `[{"foo":{}}]` {
+		t.Errorf("Expected the frame to be marshaled as JSON, got %s", data)
+	}
+	if len(frame.encoded) != 2 {
+		t.Errorf("Expected the frame to be cached for both codecs")
+	}
+}
@@ -16,14 +16,81 @@
 package engine
 
 import (
-	"code.google.com/p/go.net/websocket"
+	"crypto/subtle"
+	"errors"
 	"github.com/nu7hatch/gouuid"
+	"golang.org/x/net/websocket"
 	"io"
 	"sync"
+	"time"
 )
 
+// Maximum number of messages buffered for the suspended session.
+const websocketResumeBufferSize = 256
+
+// Maximum time of writing a single frame to the websocket.
+const websocketWriteTimeout = 10 * time.Second
+
+// Error returned when the outbound queue of the client is full.
+var errSlowConsumer = errors.New("slow consumer")
+
+// websocketReplyMode specifies which replies for the handled requests
+// shall be sent back to the client.
+type websocketReplyMode int
+
+// Possible reply modes.
+const (
+	// Only errors are sent to the client (default).
+	websocketReplyErrors websocketReplyMode = iota
+	// Every request is acknowledged, errors are sent as well.
+	websocketReplyAcks
+	// No replies are sent at all.
+	websocketReplyNone
+)
+
+// Names of the reply modes, used to negotiate them with the client.
+var websocketReplyModeNames = map[string]websocketReplyMode{
+	"errors": websocketReplyErrors,
+	"acks":   websocketReplyAcks,
+	"none":   websocketReplyNone,
+}
+
+// websocketKeepaliveMode specifies how the client is pinged when keepalive
+// is enabled for the vhost.
+type websocketKeepaliveMode int
+
+// Possible keepalive modes.
+const (
+	// Websocket ping control frames, answered by the clients automatically
+	// (default).
+	websocketKeepaliveFrames websocketKeepaliveMode = iota
+	// The ':ping' events, which have to be answered with the 'pong' events.
+	websocketKeepaliveEvents
+)
+
+// Names of the keepalive modes, used to negotiate them with the client.
+var websocketKeepaliveModeNames = map[string]websocketKeepaliveMode{
+	"frames": websocketKeepaliveFrames,
+	"events": websocketKeepaliveEvents,
+}
+
+// websocketPingFrame is queued in the outbound queue to make the writer
+// send the websocket ping control frame.
+type websocketPingFrame struct{}
+
+// fallbackTransport is an interface implemented by the transports used
+// by the clients which can't connect via websockets (eg. server-sent events).
+type fallbackTransport interface {
+	// send delivers given payload to the client.
+	send(payload interface{}) error
+	// close terminates the transport.
+	close()
+}
+
 // WebsocketConnection represents a single WebSockets connection and
 // implements an API for managing its subscriptions and authentication.
+// It's also used to represent the clients connected via one of the
+// fallback transports.
 type WebsocketConnection struct {
 	*websocket.Conn
 
@@ -33,6 +100,58 @@ type WebsocketConnection struct {
 	permission *Permission
 	// List of client's subscriptions
 	subscriptions map[string]*Channel
+	// Pattern subscriptions of the client, by pattern.
+	patterns map[string]*channelPattern
+	// Semaphore of the permission, subscriptions and patterns, which
+	// are used by the channels opened from other goroutines.
+	smtx sync.Mutex
+	// Replies negotiated with the client, guarded by the semaphore since
+	// used by the watchdog and fallback timers.
+	replyMode websocketReplyMode
+	// How the client is pinged, guarded by the semaphore since used by
+	// the watchdog.
+	keepaliveMode websocketKeepaliveMode
+	// Transport used instead of the websocket, nil for websocket clients.
+	fallback fallbackTransport
+	// Secret token which authorizes the requests of the fallback client,
+	// sent only to the client itself.
+	fallbackToken string
+	// Serializes messages dispatched by the fallback transports.
+	dmtx sync.Mutex
+	// Token which allows to resume the session after reconnect.
+	resumeToken string
+	// Whether the connection is suspended and waits for resumption.
+	suspended bool
+	// Messages sent while the connection was suspended.
+	missed []interface{}
+	// Whether some messages has been lost while suspended.
+	overflow bool
+	// Kills the suspended connection when not resumed in time, managed
+	// by the handler.
+	expire *time.Timer
+	// Time of the last message received from the client.
+	lastSeen time.Time
+	// Time of the last message other than pong received from the client.
+	lastActive time.Time
+	// Buckets of the per connection rate limits.
+	limiter *rateLimiter
+	// Remote IP of the client, used to enforce the connection limits.
+	remoteIp string
+	// Encoding negotiated with the websocket client.
+	codec websocketCodec
+	// Outbound queue of the websocket, flushed by the writer goroutine.
+	outbox *websocketOutbox
+	// Size and slow consumer policy of the outbound queue.
+	queue OutboundQueue
+	// Counters of the messages and clients lost by the outbound queue.
+	outboundStats *outboundStats
+	// Closed when the writer of the last attached websocket finishes.
+	flushed chan bool
+	// Whether the client has been disconnected for not keeping up
+	// with the messages sent to it.
+	slow bool
+	// Whether the connection has been killed.
+	killed bool
 	// Internal semaphore
 	mtx sync.Mutex
 }
@@ -41,39 +160,273 @@ type WebsocketConnection struct {
 // -----------------------------------------------------------------------------
 
 // newWebsocketConnection wraps given WebSocket connection within the newly
-// created WebsocketConnection structure.
+// created WebsocketConnection structure. Resumable connections get a token
+// which allows the client to resume the session after reconnect. Messages
+// are encoded with the codec chosen by the subprotocol negotiated during
+// the handshake.
 //
-// ws - The raw websocket connection to be wrapped.
+// ws        - The raw websocket connection to be wrapped.
+// resumable - Whether the session can be resumed or not.
+// queue     - The outbound queue's settings.
+// stats     - Counters of the lost messages and clients, may be nil.
 //
 // Returns wrapped websocket connection.
-func newWebsocketConnection(ws *websocket.Conn) (c *WebsocketConnection) {
-	uuid, _ := uuid.NewV4()
-	c = &WebsocketConnection{
-		Conn:          ws,
-		id:            uuid.String(),
-		subscriptions: make(map[string]*Channel),
+func newWebsocketConnection(ws *websocket.Conn, resumable bool, queue OutboundQueue,
+	stats *outboundStats) (c *WebsocketConnection) {
+	c = &WebsocketConnection{queue: queue, outboundStats: stats}
+	c.attach(ws)
+	if resumable {
+		c.resumeToken = newResumeToken()
 	}
-	// Send info that connection has been approved. Yeah,
-	// Bruce Lee approves!
-	c.Send(map[string]interface{}{
-		":connected": map[string]interface{}{
-			"sid": c.Id(),
-		},
-	})
+	c.init()
+	return
+}
+
+// newFallbackConnection creates a connection for the client which can't
+// use websockets and talks to the server over one of the fallback transports
+// instead. Such connection works exactly the same way as the websocket one,
+// except that messages are not received from it but dispatched directly
+// by the transport's handler. Client gets a secret token with the
+// ':connected' event, which has to accompany all its further requests,
+// since the session id alone is not a secret.
+//
+// t - The fallback transport used to deliver messages to the client.
+//
+// Returns new connection.
+func newFallbackConnection(t fallbackTransport) (c *WebsocketConnection) {
+	c = &WebsocketConnection{fallback: t, codec: websocketJSONCodec{}}
+	c.fallbackToken = newResumeToken()
+	c.init()
 	return
 }
 
 // Internal
 // -----------------------------------------------------------------------------
 
+// init assigns an unique identifier to the connection and confirms that
+// it has been established.
+func (c *WebsocketConnection) init() {
+	uuid, _ := uuid.NewV4()
+	c.id = uuid.String()
+	c.subscriptions = make(map[string]*Channel)
+	c.patterns = make(map[string]*channelPattern)
+	c.limiter = newRateLimiter()
+	// Send info that connection has been approved. Yeah,
+	// Bruce Lee approves!
+	c.Send(map[string]interface{}{":connected": c.connectedData()})
+}
+
+// websocketCodecOf returns the codec of the subprotocol negotiated with
+// the client, JSON by default.
+//
+// ws - The websocket connection to be checked.
+//
+func websocketCodecOf(ws *websocket.Conn) websocketCodec {
+	if ws == nil {
+		return websocketJSONCodec{}
+	}
+	_, codec := negotiateWebsocketCodec(ws.Config().Protocol)
+	return codec
+}
+
+// attach starts writing the messages sent to the client to given websocket.
+// Messages are queued in the outbound queue and written by the separate
+// writer goroutine, so sending never blocks on the slow network. Not
+// threadsafe, the connection's semaphore has to be locked by the caller.
+//
+// ws - The websocket connection of the client.
+//
+func (c *WebsocketConnection) attach(ws *websocket.Conn) {
+	c.Conn, c.codec = ws, websocketCodecOf(ws)
+	if ws != nil {
+		c.outbox = newWebsocketOutbox(c.queue.size())
+		c.flushed = make(chan bool)
+		go c.writer(ws, c.codec, c.outbox, c.flushed)
+	}
+}
+
+// detach stops writing messages to the current websocket. Messages already
+// queued are still written unless the websocket is closed, and then the
+// writer closes the websocket. Not threadsafe, the connection's semaphore
+// has to be locked by the caller.
+func (c *WebsocketConnection) detach() {
+	if c.outbox != nil {
+		c.outbox.close()
+		c.outbox = nil
+	}
+	c.Conn = nil
+}
+
+// writer encodes the queued messages with given codec and writes them
+// to the websocket until the queue is closed. Shared frames are encoded
+// only once per codec, queued pings are written as the control frames.
+// When writing fails or takes too long, then the
+// websocket is closed and the rest of the queue is discarded. Each
+// websocket has it running in its own goroutine.
+//
+// ws      - The websocket to write to.
+// codec   - The codec negotiated with the client.
+// outbox  - The outbound queue.
+// flushed - Closed when the writer finishes.
+//
+func (c *WebsocketConnection) writer(ws *websocket.Conn, codec websocketCodec,
+	outbox *websocketOutbox, flushed chan bool) {
+	defer close(flushed)
+	broken := false
+	for {
+		payload, ok := outbox.pop()
+		if !ok {
+			break
+		}
+		if broken = broken || c.isSlow(); broken {
+			continue
+		}
+		var err error
+		ws.SetWriteDeadline(time.Now().Add(websocketWriteTimeout))
+		if _, ok := payload.(websocketPingFrame); ok {
+			ws.PayloadType = websocket.PingFrame
+			_, err = ws.Write(nil)
+			ws.PayloadType = websocket.TextFrame
+		} else {
+			var frame interface{}
+			if frame, err = encodeWebsocketFrame(codec, payload); err != nil {
+				continue
+			}
+			err = websocket.Message.Send(ws, frame)
+		}
+		if err != nil {
+			broken = true
+			ws.Close()
+		}
+	}
+	ws.Close()
+}
+
+// newResumeToken generates new random session resumption token. Also
+// used to generate the fallback tokens.
+func newResumeToken() string {
+	token, _ := uuid.NewV4()
+	return token.String()
+}
+
+// connectedData returns payload of the ':connected' event. Resumable
+// connections get also the token which allows them to resume the session
+// after reconnect, fallback ones the token authorizing their requests.
+func (c *WebsocketConnection) connectedData() map[string]interface{} {
+	data := map[string]interface{}{"sid": c.id}
+	if c.resumeToken != "" {
+		data["resumeToken"] = c.resumeToken
+	}
+	if c.fallbackToken != "" {
+		data["token"] = c.fallbackToken
+	}
+	return data
+}
+
+// send queues given payload to be written to the client. When the
+// connection is suspended, then the payload is buffered until the session
+// is resumed. When the outbound queue is full, then the client is
+// considered too slow and, depending on the queue's policy, the payload
+// is dropped, replaces the queued message of the same event and channel,
+// or the client gets disconnected immediately. Not threadsafe,
+// the connection's semaphore has to be locked by the caller.
+//
+// payload - A data to be send to the client.
+//
+// Returns an error if something went wrong.
+func (c *WebsocketConnection) send(payload interface{}) error {
+	switch {
+	case c.suspended:
+		if len(c.missed) < websocketResumeBufferSize {
+			c.missed = append(c.missed, payload)
+		} else {
+			// Can't guarantee delivery, the session won't be resumed.
+			c.overflow = true
+		}
+	case c.fallback != nil:
+		return c.fallback.send(payload)
+	case c.Conn != nil:
+		if c.outbox.push(payload) {
+			return nil
+		}
+		switch c.queue.Policy {
+		case SlowConsumerCoalesce:
+			// Older message gets lost when coalesced.
+			c.outbox.coalesce(payload)
+			c.outboundStats.countDropped()
+		case SlowConsumerDrop:
+			c.outboundStats.countDropped()
+		default:
+			// Not waiting for the client, expired deadline interrupts
+			// the pending write and makes the writer to close the
+			// websocket and discard all the queued messages.
+			c.slow = true
+			c.Conn.SetWriteDeadline(time.Now())
+			c.detach()
+			return errSlowConsumer
+		}
+	}
+	return nil
+}
+
+// suspend closes the underlying websocket but keeps authentication and
+// subscriptions of the session, so it can be resumed later by the client
+// reconnected with the resume token. Messages sent in the meantime are
+// buffered. Threadsafe, called from the handler's event loop.
+//
+// Returns whether the connection has been suspended or not.
+func (c *WebsocketConnection) suspend() bool {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	if c.Conn == nil || c.resumeToken == "" {
+		// Killed already or not resumable.
+		return false
+	}
+	c.Conn.Close()
+	c.detach()
+	c.suspended = true
+	c.missed = make([]interface{}, 0)
+	return true
+}
+
+// resume attaches given websocket to the suspended connection, confirms
+// the resumption with a new resume token and delivers all the messages
+// missed in the meantime. The client may negotiate different encoding
+// than before. Threadsafe, called from the handler when client reconnects.
+//
+// ws - The new websocket connection of the client.
+//
+// Returns whether the session has been resumed or not.
+func (c *WebsocketConnection) resume(ws *websocket.Conn) bool {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	if !c.suspended || c.overflow {
+		return false
+	}
+	c.attach(ws)
+	c.suspended = false
+	c.resumeToken = newResumeToken()
+	data := c.connectedData()
+	data["resumed"] = true
+	c.send(map[string]interface{}{":connected": data})
+	for _, payload := range c.missed {
+		c.send(payload)
+	}
+	c.missed = nil
+	return true
+}
+
 // authenticate marks the connection as authenticated by assigning given
-// permissions information to it. Not threadsafe, used only from within
-// websocket protocol's handlers which is blocking for specified connection.
+// permissions information to it. Used only from within websocket protocol's
+// handlers which is blocking for specified connection, but the permission
+// is guarded since it's checked by the channels opened in the meantime.
 //
 // p - The permission information to be assigned to this connection.
 //
 func (c *WebsocketConnection) authenticate(p *Permission) {
+	c.smtx.Lock()
 	c.permission = p
+	c.smtx.Unlock()
 	if p != nil {
 		c.Send(map[string]interface{}{
 			":authenticated": map[string]interface{}{},
@@ -88,20 +441,271 @@ func (c *WebsocketConnection) authenticate(p *Permission) {
 // p - The permission information to be assigned to this connection.
 //
 func (c *WebsocketConnection) reauthenticate(p *Permission) {
+	c.clearPatterns()
 	c.clearSubscriptions()
 	c.authenticate(p)
 }
 
-// Removes all subscriptions created by this client.
+// Removes all subscriptions created by this client. Threadsafe.
 func (c *WebsocketConnection) clearSubscriptions() {
-	for _, ch := range c.subscriptions {
+	for _, ch := range c.channels() {
 		ch.unsubscribe(c, map[string]interface{}{}, false)
 	}
 }
 
+// channels returns the channels subscribed by this client. Threadsafe.
+func (c *WebsocketConnection) channels() []*Channel {
+	c.smtx.Lock()
+	defer c.smtx.Unlock()
+	channels := make([]*Channel, 0, len(c.subscriptions))
+	for _, ch := range c.subscriptions {
+		channels = append(channels, ch)
+	}
+	return channels
+}
+
+// setSubscription registers or removes given channel within the client's
+// subscriptions. Threadsafe, called by the channel.
+//
+// ch         - The channel.
+// subscribed - Whether the channel is subscribed or not.
+//
+func (c *WebsocketConnection) setSubscription(ch *Channel, subscribed bool) {
+	c.smtx.Lock()
+	defer c.smtx.Unlock()
+	if subscribed {
+		c.subscriptions[ch.Name()] = ch
+	} else {
+		delete(c.subscriptions, ch.Name())
+	}
+}
+
+// addPattern registers given pattern subscription. Threadsafe.
+//
+// p - The pattern to be added.
+//
+// Returns whether the pattern has been added or not.
+func (c *WebsocketConnection) addPattern(p *channelPattern) bool {
+	c.smtx.Lock()
+	defer c.smtx.Unlock()
+	if _, ok := c.patterns[p.pattern]; ok {
+		return false
+	}
+	c.patterns[p.pattern] = p
+	return true
+}
+
+// deletePattern removes the specified pattern subscription. Threadsafe.
+//
+// pattern - The pattern to be removed.
+//
+// Returns whether the pattern has been removed or not.
+func (c *WebsocketConnection) deletePattern(pattern string) bool {
+	c.smtx.Lock()
+	defer c.smtx.Unlock()
+	if _, ok := c.patterns[pattern]; !ok {
+		return false
+	}
+	delete(c.patterns, pattern)
+	return true
+}
+
+// clearPatterns removes all the pattern subscriptions, the channels
+// subscribed already are not affected. Threadsafe.
+func (c *WebsocketConnection) clearPatterns() {
+	c.smtx.Lock()
+	defer c.smtx.Unlock()
+	c.patterns = make(map[string]*channelPattern)
+}
+
+// hasPatterns returns whether the client has any pattern subscriptions.
+// Threadsafe.
+func (c *WebsocketConnection) hasPatterns() bool {
+	c.smtx.Lock()
+	defer c.smtx.Unlock()
+	return len(c.patterns) > 0
+}
+
+// matchingPattern finds the client's pattern subscription which matches
+// given channel. Private channels are matched only when the client is
+// allowed to operate on them. Threadsafe.
+//
+// ch - The channel to be matched.
+//
+// Returns the matching pattern, or an empty string if none matches.
+func (c *WebsocketConnection) matchingPattern(ch *Channel) string {
+	if ch.IsPrivate() && !c.IsAllowed(ch.Name()) {
+		return ""
+	}
+	c.smtx.Lock()
+	defer c.smtx.Unlock()
+	for pattern, p := range c.patterns {
+		if p.matches(ch) {
+			return pattern
+		}
+	}
+	return ""
+}
+
+// isKilled returns whether the connection has been killed. Threadsafe.
+func (c *WebsocketConnection) isKilled() bool {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	return c.killed
+}
+
+// setReplyMode changes replies sent to the client to the specified mode.
+// Threadsafe.
+//
+// name - Name of the mode, one of: errors, acks or none.
+//
+// Returns whether the mode has been changed or not.
+func (c *WebsocketConnection) setReplyMode(name string) bool {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	mode, ok := websocketReplyModeNames[name]
+	if ok {
+		c.replyMode = mode
+	}
+	return ok
+}
+
+// setKeepaliveMode changes the way how the client is pinged. Threadsafe.
+//
+// name - Name of the mode, one of: frames or events.
+//
+// Returns whether the mode has been changed or not.
+func (c *WebsocketConnection) setKeepaliveMode(name string) bool {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	mode, ok := websocketKeepaliveModeNames[name]
+	if ok {
+		c.keepaliveMode = mode
+	}
+	return ok
+}
+
+// ping sends the keepalive ping to the client, according to the negotiated
+// keepalive mode. Ping frames are skipped when the outbound queue is full,
+// the connection is not idle then anyway. Threadsafe, called from the
+// handler's watchdog.
+//
+// Returns whether the client is expected to answer with the 'pong' event.
+func (c *WebsocketConnection) ping() bool {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	if c.keepaliveMode == websocketKeepaliveEvents {
+		c.send(map[string]interface{}{":ping": map[string]interface{}{}})
+		return true
+	}
+	if c.outbox != nil {
+		c.outbox.push(websocketPingFrame{})
+	}
+	return false
+}
+
+// reply sends an answer for the handled request according to the negotiated
+// reply mode. Errors (4xx and 5xx statuses) are sent as ':error' events,
+// successes (2xx statuses) as ':ack' events, but only in the acks mode.
+// If the request contains an 'id' field then it's included in the answer,
+// so the client can correlate it with the request. Threadsafe, called from
+// the handler's event loop, the keepalive watchdog and the fallback timers.
+//
+// s   - The status of the handled request.
+// msg - The handled message, may be nil.
+//
+func (c *WebsocketConnection) reply(s *Status, msg *WebsocketMessage) {
+	c.mtx.Lock()
+	mode := c.replyMode
+	c.mtx.Unlock()
+	var event string
+	switch {
+	case mode == websocketReplyNone:
+		return
+	case s.Code >= 400:
+		event = ":error"
+	case s.Code < 300 && msg != nil && mode == websocketReplyAcks:
+		event = ":ack"
+	default:
+		return
+	}
+	data := s.Map()
+	if msg != nil {
+		if id := msg.Get("id"); id != nil {
+			data["id"] = id
+		}
+	}
+	c.Send(map[string]interface{}{event: data})
+}
+
+// touch records that a message has been received from the client.
+// Threadsafe, called from the handler's event loop and used by the
+// keepalive watchdog.
+//
+// active - Whether the message is other than pong or not.
+//
+func (c *WebsocketConnection) touch(active bool) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	c.lastSeen = time.Now()
+	if active {
+		c.lastActive = c.lastSeen
+	}
+}
+
+// flush waits until the writer of the detached websocket finishes, so all
+// the queued messages are delivered before the handler returns and the
+// websocket server closes the underlying connection. Waits no longer than
+// the single write timeout. Threadsafe.
+func (c *WebsocketConnection) flush() {
+	c.mtx.Lock()
+	flushed := c.flushed
+	c.mtx.Unlock()
+	if flushed == nil {
+		return
+	}
+	select {
+	case <-flushed:
+	case <-time.After(websocketWriteTimeout):
+	}
+}
+
+// isSlow returns whether the client has been disconnected for not keeping
+// up with the messages sent to it. Threadsafe.
+func (c *WebsocketConnection) isSlow() bool {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	return c.slow
+}
+
+// activity returns time of the last message received from the client
+// and time of the last message other than pong. Threadsafe.
+func (c *WebsocketConnection) activity() (seen, active time.Time) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	return c.lastSeen, c.lastActive
+}
+
 // Exported
 // -----------------------------------------------------------------------------
 
+// ResumeToken returns the current session resumption token. Threadsafe.
+func (c *WebsocketConnection) ResumeToken() string {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	return c.resumeToken
+}
+
+// isFallbackToken returns whether given token authorizes the requests
+// of the fallback client. Compared in constant time.
+//
+// token - The token sent by the client.
+//
+func (c *WebsocketConnection) isFallbackToken(token string) bool {
+	return c.fallbackToken != "" &&
+		subtle.ConstantTimeCompare([]byte(token), []byte(c.fallbackToken)) == 1
+}
+
 // Id returns an unique session identifier attached to this connection.
 func (c *WebsocketConnection) Id() string {
 	return c.id
@@ -109,64 +713,87 @@ func (c *WebsocketConnection) Id() string {
 
 // Uid returns user-defined identifier of this connection.
 func (c *WebsocketConnection) Uid() string {
-	if c.IsAuthenticated() {
-		return c.permission.Uid()
+	if p := c.currentPermission(); p != nil {
+		return p.Uid()
 	}
 	return ""
 }
 
+// currentPermission returns the permission assigned to this connection,
+// nil if not authenticated. Threadsafe.
+func (c *WebsocketConnection) currentPermission() *Permission {
+	c.smtx.Lock()
+	defer c.smtx.Unlock()
+	return c.permission
+}
+
 // IsAuthenticated returns whether this connection is authenticated or not.
-// Not threadsafe, Used only from within websocket protocol's handlers which
-// is blocking for specified connection.
+// Threadsafe, used from within websocket protocol's handlers and the
+// channels matched by the client's pattern subscriptions.
 func (c *WebsocketConnection) IsAuthenticated() bool {
-	return c.permission != nil
+	return c.currentPermission() != nil
 }
 
 // IsAllowed returns whether this connections is authenticated and has
-// sufficient permissions to operate on a given channel. Not threadsafe,
-// used only from within websocket protocol's handlers which is blocking
-// for specified connection.
+// sufficient permissions to operate on a given channel. Threadsafe, used
+// from within websocket protocol's handlers and the channels matched by
+// the client's pattern subscriptions.
 //
 // channel - The channel to check permissions for.
 //
 func (c *WebsocketConnection) IsAllowed(channel string) bool {
-	return c.IsAuthenticated() && c.permission.IsMatching(channel)
+	p := c.currentPermission()
+	return p != nil && p.IsMatching(channel)
 }
 
-// Send serializes given payload with JSON and sends it to the client.
-// Threadsafe, may be used from the websocket protocol's handlers and
-// the channel's broadcaster.
+// Send queues given payload to be serialized with the negotiated codec
+// and written to the client. Shared frames are serialized only once per
+// codec. Never blocks on the network. Threadsafe, may be used from the
+// websocket protocol's handlers and the channel's broadcaster.
 //
 // payload - A data to be send to the client.
 //
 func (c *WebsocketConnection) Send(payload interface{}) {
 	c.mtx.Lock()
 	defer c.mtx.Unlock()
-	if c.Conn == nil {
-		return
-	}
-	if err := websocket.JSON.Send(c.Conn, payload); err != nil {
+	if err := c.send(payload); err != nil {
 		// TODO: error log!
 		//websocketStatusLog(c, "Not sent", 597, err.Error())
 	}
 }
 
 // Receive reads a message from the client and parses it into the internal
-// message object. If there is no data to read from the connection then it
-// shall block until new data arrive. Not threadsafe, used only from within
-// websocket handler's event loop.
+// message object using the negotiated codec. If there is no data to read
+// from the connection then it shall block until new data arrive. Frames
+// exceeding the size limit are discarded without being buffered. Other
+// read errors are reported as the end of file, since the websocket can't
+// be used anymore. Not threadsafe, used only from within websocket
+// handler's event loop.
+//
+// limits - The message limits to be checked, may be nil.
 //
 // Returns message received from the connection.
-func (c *WebsocketConnection) Receive() (*WebsocketMessage, error) {
-	var recv map[string]interface{}
-	if !c.IsAlive() {
+func (c *WebsocketConnection) Receive(limits *MessageLimits) (*WebsocketMessage, error) {
+	var data []byte
+	c.mtx.Lock()
+	ws := c.Conn
+	c.mtx.Unlock()
+	if ws == nil {
+		// Connection is dead or it's a fallback one, fallback transports
+		// are dispatching messages on their own.
 		return nil, io.EOF
 	}
-	recv = make(map[string]interface{})
-	if err := websocket.JSON.Receive(c.Conn, &recv); err != nil {
-		return nil, err
+	ws.MaxPayloadBytes = limits.maxSize()
+	if err := websocket.Message.Receive(ws, &data); err != nil {
+		if err == websocket.ErrFrameTooLarge {
+			return nil, errMessageTooLarge
+		}
+		return nil, io.EOF
 	}
-	return newWebsocketMessage(recv)
+	c.mtx.Lock()
+	codec := c.codec
+	c.mtx.Unlock()
+	return codec.decode(data, limits)
 }
 
 // IsAlive returns whether the connection is alive or not. Threadsafe, so far
@@ -175,18 +802,26 @@ func (c *WebsocketConnection) Receive() (*WebsocketMessage, error) {
 func (c *WebsocketConnection) IsAlive() bool {
 	c.mtx.Lock()
 	defer c.mtx.Unlock()
-	return c.Conn != nil
+	return c.Conn != nil || c.fallback != nil
 }
 
-// Kill cleans up all subscriptions and closes the connection. This operation
-// will mark connection as dead. Threadsafe, Used in the websocket endpoint
-// and handlers. 
+// Kill cleans up all subscriptions and closes the connection. Messages
+// already queued are still delivered before the websocket is closed.
+// This operation will mark connection as dead. Threadsafe, Used in the
+// websocket endpoint and handlers.
 func (c *WebsocketConnection) Kill() {
 	c.mtx.Lock()
-	defer c.mtx.Unlock()
-	c.clearSubscriptions()
-	if c.Conn != nil {
-		c.Conn.Close()
-		c.Conn = nil
+	c.killed = true
+	c.suspended, c.missed = false, nil
+	c.detach()
+	if c.fallback != nil {
+		c.fallback.close()
+		c.fallback = nil
 	}
+	c.mtx.Unlock()
+	// Killed connections can't subscribe anymore, so the subscriptions
+	// are cleared without holding the semaphore, which is used by
+	// the channels as well.
+	c.clearPatterns()
+	c.clearSubscriptions()
 }
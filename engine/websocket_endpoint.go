@@ -16,12 +16,11 @@
 package engine
 
 import (
-	"crypto/rand"
 	"crypto/tls"
-	"log"
 	"net"
 	"net/http"
 	"sync"
+	"time"
 )
 
 // WebsocketEndpoint implements a wrapper for the websockets server
@@ -34,12 +33,14 @@ type WebsocketEndpoint struct {
 	ctx *Context
 	// Information whether the endpoint is alive or not.
 	alive bool
+	// Information whether the endpoint is draining or not.
+	draining bool
 	// List of registered handlers (handler per vhost).
 	handlers *WebsocketServeMux
+	// The TLS certificate used by the endpoint.
+	certs *certificateStore
 	// Internal semaphore.
 	mtx sync.Mutex
-	// Internal Logger.
-	log *log.Logger
 }
 
 // Internal constructors
@@ -57,9 +58,9 @@ func newWebsocketEndpoint(ctx *Context, addr string) *WebsocketEndpoint {
 	mux := NewWebsocketServeMux()
 	return &WebsocketEndpoint{
 		handlers: mux,
+		certs:    &certificateStore{},
 		Server:   &http.Server{Addr: addr, Handler: mux},
 		ctx:      ctx,
-		log:      ctx.log,
 	}
 }
 
@@ -103,7 +104,9 @@ func (w *WebsocketEndpoint) ListenAndServe() error {
 	if err != nil {
 		return err
 	}
+	w.mtx.Lock()
 	w.alive = true
+	w.mtx.Unlock()
 	return w.Server.Serve(l)
 }
 
@@ -121,21 +124,32 @@ func (w *WebsocketEndpoint) ListenAndServe() error {
 // Returns an error if something went wrong.
 func (w *WebsocketEndpoint) ListenAndServeTLS(certFile, certKey string) (err error) {
 	addr := w.Server.Addr
-	config := &tls.Config{Rand: rand.Reader, NextProtos: []string{"http/1.1"}}
-	config.Certificates = make([]tls.Certificate, 1)
-	config.Certificates[0], err = tls.LoadX509KeyPair(certFile, certKey)
-	if err != nil {
+	if err = w.certs.load(certFile, certKey); err != nil {
 		return
 	}
 	l, err := net.Listen("tcp", addr)
 	if err != nil {
 		return
 	}
-	tlsListener := tls.NewListener(l, config)
+	tlsListener := tls.NewListener(l, w.certs.config())
+	w.mtx.Lock()
 	w.alive = true
+	w.mtx.Unlock()
 	return w.Server.Serve(tlsListener)
 }
 
+// ReloadCertificate loads new TLS certificate and its private key. The new
+// certificate is used for all new handshakes, already connected clients
+// are not affected.
+//
+// certFile - Path to the TLS certificate file.
+// certKey  - Path to the certificate's private key.
+//
+// Returns an error if something went wrong or endpoint doesn't serve TLS.
+func (w *WebsocketEndpoint) ReloadCertificate(certFile, certKey string) error {
+	return w.certs.reload(certFile, certKey)
+}
+
 // IsAlive returns whether the endpoint is alive or not.
 func (w *WebsocketEndpoint) IsAlive() bool {
 	w.mtx.Lock()
@@ -143,6 +157,27 @@ func (w *WebsocketEndpoint) IsAlive() bool {
 	return w.alive
 }
 
+// Drain stops accepting new connections and asks all connected clients
+// to reconnect after the specified delay. Endpoint is still alive until
+// the Kill function is called.
+//
+// delay - The reconnect delay to be suggested to the clients.
+//
+func (w *WebsocketEndpoint) Drain(delay time.Duration) {
+	w.mtx.Lock()
+	defer w.mtx.Unlock()
+	if w.alive && !w.draining {
+		w.draining = true
+		w.handlers.DrainAll(delay)
+	}
+}
+
+// IsDrained returns whether all the clients have already disconnected
+// from the draining endpoint.
+func (w *WebsocketEndpoint) IsDrained() bool {
+	return w.handlers.ConnsCount() == 0
+}
+
 // Kill stops all registered vhost handlers and marks this endpoint as dead.
 func (w *WebsocketEndpoint) Kill() {
 	w.mtx.Lock()
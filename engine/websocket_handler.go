@@ -16,23 +16,38 @@
 package engine
 
 import (
-	"code.google.com/p/go.net/websocket"
+	"encoding/json"
+	"errors"
+	"golang.org/x/net/websocket"
 	"io"
+	"io/ioutil"
 	"net/http"
+	"strconv"
 	"sync"
+	"time"
 )
 
-// websocketHandler is a wrapper for the standard `websocket.Handler`
+// websocketHandler is a wrapper for the standard `websocket.Server`
 // providing some thread safety tricks and access to related vhost.
 type websocketHandler struct {
-	// Wrapped websocket handler.
-	handler websocket.Handler
+	// Wrapped websocket server.
+	handler websocket.Server
 	// Endpoint to which the handler belogns.
 	endpoint *WebsocketEndpoint
 	// List of active connections.
 	conns map[string]*WebsocketConnection
+	// Suspended connections waiting for resumption (by resume tokens).
+	suspended map[string]*WebsocketConnection
+	// Counts active connections to enforce the vhost's limits.
+	tracker *connectionTracker
+	// Counts messages and clients lost by the outbound queues.
+	outbound *outboundStats
 	// Whether the handler is alive or not.
 	alive bool
+	// Whether the handler is draining or not.
+	draining bool
+	// Reconnect delay suggested to the clients while draining.
+	reconnectDelay time.Duration
 	// Related vhost.
 	vhost *Vhost
 	// Internal semaphore.
@@ -50,30 +65,43 @@ type websocketHandler struct {
 // Returns new handler.
 func newWebsocketHandler(vhost *Vhost, endpoint *WebsocketEndpoint) (h *websocketHandler) {
 	h = &websocketHandler{
-		vhost:    vhost,
-		alive:    true,
-		endpoint: endpoint,
-		conns:    make(map[string]*WebsocketConnection),
+		vhost:     vhost,
+		alive:     true,
+		endpoint:  endpoint,
+		conns:     make(map[string]*WebsocketConnection),
+		suspended: make(map[string]*WebsocketConnection),
+		tracker:   newConnectionTracker(),
+		outbound:  &outboundStats{},
+	}
+	h.handler = websocket.Server{
+		Handshake: h.handshake,
+		Handler: func(ws *websocket.Conn) {
+			h.handle(ws)
+		},
 	}
-	h.handler = websocket.Handler(func(ws *websocket.Conn) {
-		h.handle(ws)
-	})
 	return h
 }
 
 // Internal
 // -----------------------------------------------------------------------------
 
-// addConn appends given connection to the active connections stack.
-// Threadsafe, called from the internal handle function which is spawned
-// into goroutine per each connected client.
+// addConn appends given connection to the active connections stack if it
+// fits within the vhost's connection limits. Threadsafe, called from the
+// internal handle function which is spawned into goroutine per each
+// connected client.
 //
 // c - The websocket connection to be added to the stack.
 //
-func (h *websocketHandler) addConn(c *WebsocketConnection) {
+// Returns zero if added, otherwise a HTTP status code explaining why
+// the connection has been rejected.
+func (h *websocketHandler) addConn(c *WebsocketConnection) int {
 	h.mtx.Lock()
 	defer h.mtx.Unlock()
-	h.conns[c.Id()] = c
+	code := h.tracker.track(c.Id(), c.remoteIp, c.Uid(), h.connectionLimits())
+	if code == 0 {
+		h.conns[c.Id()] = c
+	}
+	return code
 }
 
 // deleteConn rrmoves given connection from the active connections stack.
@@ -86,14 +114,233 @@ func (h *websocketHandler) deleteConn(c *WebsocketConnection) {
 	h.mtx.Lock()
 	defer h.mtx.Unlock()
 	delete(h.conns, c.Id())
+	h.tracker.untrack(c.Id())
 }
 
-// disconnectAll closes all active connections. Not threadsafe, called only
-// from the internal Kill function.
+// disconnectAll closes all active and suspended connections. Not threadsafe,
+// called only from the internal Kill function.
 func (h *websocketHandler) disconnectAll() {
 	for _, c := range h.conns {
 		c.Kill()
 	}
+	for token, c := range h.suspended {
+		c.expire.Stop()
+		c.Kill()
+		delete(h.suspended, token)
+	}
+}
+
+// connectionLimits returns the connection limits configured for the
+// handler's vhost, nil if not limited.
+func (h *websocketHandler) connectionLimits() *ConnectionLimits {
+	if h.vhost == nil {
+		return nil
+	}
+	return h.vhost.frontendConnectionLimits()
+}
+
+// remoteIp returns the IP address of the client sending given request,
+// see the remoteIp function for details.
+//
+// req - The client's request.
+//
+// Returns the IP address, empty if unknown.
+func (h *websocketHandler) remoteIp(req *http.Request) string {
+	if h.vhost == nil || h.vhost.ctx == nil {
+		return remoteIp(req, nil)
+	}
+	return remoteIp(req, h.vhost.ctx.TrustedProxies())
+}
+
+// outboundQueue returns the outbound queue settings configured for the
+// handler's vhost.
+func (h *websocketHandler) outboundQueue() OutboundQueue {
+	if h.vhost == nil {
+		return OutboundQueue{}
+	}
+	return h.vhost.OutboundQueue()
+}
+
+// messageLimits returns the message limits configured for the handler's
+// vhost, nil if not limited.
+func (h *websocketHandler) messageLimits() *MessageLimits {
+	if h.vhost == nil {
+		return nil
+	}
+	return h.vhost.receivedMessageLimits()
+}
+
+// isOriginAllowed checks whether the clients can connect from the specified
+// origin according to the handler's vhost settings.
+//
+// origin - The origin sent by the client.
+//
+func (h *websocketHandler) isOriginAllowed(origin string) bool {
+	if h.vhost == nil {
+		return true
+	}
+	return h.vhost.isOriginAllowed(origin)
+}
+
+// reject closes the connection which doesn't fit within the vhost's
+// connection limits.
+//
+// c - The rejected connection.
+//
+func (h *websocketHandler) reject(c *WebsocketConnection) {
+	h.disconnect(c, &Status{"Too many connections", 459})
+}
+
+// resumeGracePeriod returns the session resumption grace period configured
+// for the handler's vhost.
+func (h *websocketHandler) resumeGracePeriod() time.Duration {
+	if h.vhost == nil {
+		return 0
+	}
+	return h.vhost.ResumeGracePeriod()
+}
+
+// suspend removes given connection from the active connections and keeps
+// it for the vhost's grace period, so the client can resume the session
+// after reconnect. Connections are not suspended while draining, clients are
+// expected to reconnect to the other node then. Threadsafe, called from
+// the connection's event loop when the client disconnects.
+//
+// c - The connection to be suspended.
+//
+// Returns whether the connection has been suspended or not.
+func (h *websocketHandler) suspend(c *WebsocketConnection) bool {
+	grace := h.resumeGracePeriod()
+	h.mtx.Lock()
+	defer h.mtx.Unlock()
+	if !h.alive || h.draining || grace <= 0 || !c.suspend() {
+		return false
+	}
+	token := c.ResumeToken()
+	delete(h.conns, c.Id())
+	h.tracker.untrack(c.Id())
+	h.suspended[token] = c
+	c.expire = time.AfterFunc(grace, func() {
+		h.expire(token)
+	})
+	return true
+}
+
+// resume finds a suspended connection with the specified resume token
+// and resumes it over given websocket. Threadsafe, called from the
+// internal handle function when the client reconnects.
+//
+// token - The resume token passed by the client.
+// ws    - The new websocket connection.
+//
+// Returns resumed connection or nil if there is nothing to resume.
+func (h *websocketHandler) resume(token string, ws *websocket.Conn) *WebsocketConnection {
+	h.mtx.Lock()
+	c, ok := h.suspended[token]
+	if ok {
+		c.expire.Stop()
+		delete(h.suspended, token)
+	}
+	h.mtx.Unlock()
+	if !ok {
+		return nil
+	}
+	if !c.resume(ws) {
+		// Too many missed messages, session is lost.
+		c.Kill()
+		return nil
+	}
+	return c
+}
+
+// expire kills the suspended connection which has not been resumed
+// within the grace period. Threadsafe, called from the expiration timer.
+//
+// token - The resume token of the suspended connection.
+//
+func (h *websocketHandler) expire(token string) {
+	h.mtx.Lock()
+	c, ok := h.suspended[token]
+	delete(h.suspended, token)
+	h.mtx.Unlock()
+	if ok {
+		c.Kill()
+		h.logStatus(c, &Status{"Expired", 408}, nil)
+	}
+}
+
+// drain stops accepting new connections and asks all the connected
+// clients to reconnect after the specified delay. Connections are not
+// closed here, clients are expected to disconnect on their own. Threadsafe,
+// called only from the websocket endpoint's Drain function.
+//
+// delay - The reconnect delay to be suggested to the clients.
+//
+func (h *websocketHandler) drain(delay time.Duration) {
+	h.mtx.Lock()
+	if !h.alive || h.draining {
+		h.mtx.Unlock()
+		return
+	}
+	h.draining = true
+	h.reconnectDelay = delay
+	conns := make([]*WebsocketConnection, 0, len(h.conns))
+	for _, c := range h.conns {
+		conns = append(conns, c)
+	}
+	h.mtx.Unlock()
+	// Not sending while locked, the connections may need the handler.
+	for _, c := range conns {
+		c.Send(map[string]interface{}{
+			":reconnect": map[string]interface{}{
+				"delay": int(delay / time.Millisecond),
+			},
+		})
+	}
+}
+
+// retryAfter returns the number of seconds after which the client
+// rejected while draining shall try again, the reconnect delay rounded
+// up. Threadsafe.
+func (h *websocketHandler) retryAfter() int {
+	h.mtx.Lock()
+	defer h.mtx.Unlock()
+	return int((h.reconnectDelay + time.Second - 1) / time.Second)
+}
+
+// connsCount returns number of the active connections. Threadsafe, used
+// by the endpoint to check whether the handler has been drained.
+func (h *websocketHandler) connsCount() int {
+	h.mtx.Lock()
+	defer h.mtx.Unlock()
+	return len(h.conns)
+}
+
+// handshake checks the origin of the websocket client and negotiates
+// the subprotocol, which specifies the encoding of the messages: 'json'
+// (default) or 'msgpack'. When none of the requested subprotocols is
+// supported, then the first one is accepted for compatibility and the
+// messages are encoded with JSON.
+//
+// config - The websocket configuration of the connection.
+// req    - The handshake request.
+//
+// Returns an error if the handshake shall be rejected.
+func (h *websocketHandler) handshake(config *websocket.Config, req *http.Request) (err error) {
+	if config.Origin, err = websocket.Origin(config, req); err != nil {
+		return
+	}
+	if config.Origin == nil {
+		return errors.New("null origin")
+	}
+	if len(config.Protocol) > 0 {
+		name, _ := negotiateWebsocketCodec(config.Protocol)
+		if name == "" {
+			name = config.Protocol[0]
+		}
+		config.Protocol = []string{name}
+	}
+	return
 }
 
 // handle implements an event loop for handling single websocket connection.
@@ -102,24 +349,369 @@ func (h *websocketHandler) disconnectAll() {
 // ws - The raw websocket connection to be handled.
 //
 func (h *websocketHandler) handle(ws *websocket.Conn) {
-	c := newWebsocketConnection(ws)
-	h.addConn(c)
-	defer h.deleteConn(c)
-	h.logStatus(c, &Status{"Connected", 305}, "")
+	var c *WebsocketConnection
+	req := ws.Request()
+	if req != nil {
+		if token := req.URL.Query().Get("resume"); token != "" {
+			c = h.resume(token, ws)
+		}
+	}
+	if c != nil {
+		c.remoteIp = h.remoteIp(req)
+		if h.addConn(c) != 0 {
+			h.reject(c)
+			c.flush()
+			return
+		}
+		h.logStatus(c, &Status{"Resumed", 306}, nil)
+	} else {
+		c = newWebsocketConnection(ws, h.resumeGracePeriod() > 0, h.outboundQueue(), h.outbound)
+		c.remoteIp = h.remoteIp(req)
+		if h.addConn(c) != 0 {
+			h.reject(c)
+			c.flush()
+			return
+		}
+		h.logStatus(c, &Status{"Connected", 305}, nil)
+	}
+	if req != nil {
+		h.negotiate(c, req)
+	}
+	c.touch(true)
+	done := make(chan bool)
+	defer close(done)
+	go h.watch(c, done)
 	for {
 		if !h.IsAlive() {
 			break
 		}
-		if msg, err := c.Receive(); err == nil && msg != nil {
+		if msg, err := c.Receive(h.messageLimits()); err == nil && msg != nil {
+			c.touch(msg.Event() != "pong")
 			h.dispatch(c, msg)
-		} else if err == io.EOF {
-			// End of file reached, terminating this connection...
+		} else if s := messageLimitStatus(err); s != nil {
+			h.logStatus(c, s, nil)
+		} else if c.isSlow() {
+			// Client couldn't keep up with the messages sent to it,
+			// its websocket has been closed already.
+			h.logStatus(c, &Status{"Slow consumer", 463}, nil)
+			h.outbound.countDisconnected()
+			c.Kill()
+			break
+		} else if err == io.EOF || !c.IsAlive() {
+			// End of file reached, keeping the session for a while
+			// so the client can resume it, or terminating it...
+			if h.suspend(c) {
+				h.logStatus(c, &Status{"Suspended", 307}, nil)
+				return
+			}
 			c.Kill()
 			break
 		} else {
-			h.logStatus(c, &Status{"Bad request", 400}, "")
+			h.logStatus(c, &Status{"Bad request", 400}, nil)
 		}
 	}
+	h.deleteConn(c)
+	c.flush()
+}
+
+// watch implements a watchdog of the websocket connection. When keepalive
+// is enabled for the handler's vhost, then it periodically pings the client.
+// By default the websocket ping frames are sent, which clients answer on
+// their own, but the answers can't be observed with the websocket library,
+// so such pings only keep the connection open through the proxies. Clients
+// which negotiated the 'events' keepalive mode get the ':ping' events
+// instead, and are disconnected if they don't respond with the 'pong'
+// events. When idle timeout is enabled, it disconnects the client which
+// doesn't send any messages, except pongs, for too long. Each connection
+// has it running in its own goroutine.
+//
+// c    - The connection to be watched.
+// done - Closed when the connection's event loop finishes.
+//
+func (h *websocketHandler) watch(c *WebsocketConnection, done chan bool) {
+	var keepalive, idle time.Duration
+	if h.vhost != nil {
+		keepalive, idle = h.vhost.KeepaliveInterval(), h.vhost.IdleTimeout()
+	}
+	if keepalive <= 0 && idle <= 0 {
+		return
+	}
+	lastPing, expectPong := time.Now(), false
+	for {
+		wait := time.Duration(1<<63 - 1)
+		now := time.Now()
+		seen, active := c.activity()
+		if idle > 0 {
+			if now.Sub(active) >= idle {
+				h.disconnect(c, &Status{"Idle timeout", 455})
+				return
+			}
+			wait = idle - now.Sub(active)
+		}
+		if keepalive > 0 {
+			if expectPong && now.Sub(seen) >= 2*keepalive {
+				// Client didn't respond to the last ping.
+				h.disconnect(c, &Status{"Keepalive timeout", 456})
+				return
+			}
+			if now.Sub(lastPing) >= keepalive {
+				expectPong = c.ping()
+				lastPing = now
+			}
+			if next := keepalive - now.Sub(lastPing); next < wait {
+				wait = next
+			}
+		}
+		select {
+		case <-time.After(wait):
+		case <-done:
+			return
+		}
+	}
+}
+
+// disconnect tells the client why it's being disconnected and closes
+// the connection.
+//
+// c - The connection to be closed.
+// s - The reason of disconnection.
+//
+func (h *websocketHandler) disconnect(c *WebsocketConnection, s *Status) {
+	c.Send(map[string]interface{}{":disconnect": s.Map()})
+	c.Kill()
+	h.logStatus(c, s, nil)
+}
+
+// negotiate applies the options which client specified in the query
+// string of the handshake request.
+//
+// c   - The connection to be configured.
+// req - The handshake request.
+//
+func (h *websocketHandler) negotiate(c *WebsocketConnection, req *http.Request) {
+	if name := req.URL.Query().Get("replies"); name != "" {
+		if !c.setReplyMode(name) {
+			h.logStatus(c, &Status{"Bad request", 400}, nil)
+		}
+	}
+	if name := req.URL.Query().Get("keepalive"); name != "" {
+		if !c.setKeepaliveMode(name) {
+			h.logStatus(c, &Status{"Bad request", 400}, nil)
+		}
+	}
+}
+
+// conn returns an active connection with the specified session id.
+// Threadsafe, used to find the connection to which the fallback
+// transport's requests belong.
+//
+// sid - The session id to look up.
+//
+// Returns the connection or nil if not found.
+func (h *websocketHandler) conn(sid string) *WebsocketConnection {
+	h.mtx.Lock()
+	defer h.mtx.Unlock()
+	return h.conns[sid]
+}
+
+// serveEventStream handles the server-sent events fallback transport's
+// stream. The connection exists as long as the stream is open. Client
+// receives the same messages as via websocket, each one as a separate
+// event.
+//
+// w   - The HTTP response writer.
+// req - The stream request.
+//
+func (h *websocketHandler) serveEventStream(w http.ResponseWriter, req *http.Request) {
+	t := newEventStreamTransport()
+	c := newFallbackConnection(t)
+	c.remoteIp = h.remoteIp(req)
+	if code := h.addConn(c); code != 0 {
+		h.reject(c)
+		w.WriteHeader(code)
+		return
+	}
+	defer h.deleteConn(c)
+	h.logStatus(c, &Status{"Connected", 305}, nil)
+	h.negotiate(c, req)
+	if err := t.stream(w); err != nil {
+		h.logStatus(c, &Status{"Internal error", 597}, nil)
+	}
+	c.Kill()
+}
+
+// serveLongPollingConnect creates a session for the client using the
+// long-polling fallback transport. The response contains the ':connected'
+// message with the session id and the secret token which have to be
+// passed in the 'sid' and 'token' query parameters of all the further
+// requests. Session expires when the client stops polling.
+//
+// w   - The HTTP response writer.
+// req - The connect request.
+//
+func (h *websocketHandler) serveLongPollingConnect(w http.ResponseWriter, req *http.Request) {
+	t := newLongPollingTransport()
+	c := newFallbackConnection(t)
+	c.remoteIp = h.remoteIp(req)
+	if code := h.addConn(c); code != 0 {
+		h.reject(c)
+		w.WriteHeader(code)
+		return
+	}
+	// Only admitted sessions can expire.
+	t.expireAfter(longPollingSessionTimeout, func() {
+		c.Kill()
+		h.deleteConn(c)
+		h.logStatus(c, &Status{"Expired", 408}, nil)
+	})
+	h.logStatus(c, &Status{"Connected", 305}, nil)
+	h.negotiate(c, req)
+	h.serveLongPolling(w, req, c, t)
+}
+
+// serveLongPolling handles a poll request of the long-polling fallback
+// transport. Responds with a JSON encoded list of the messages queued
+// for the client, waits for them if the queue is empty. Messages have
+// the same format as the websocket ones.
+//
+// w   - The HTTP response writer.
+// req - The poll request.
+// c   - The polling client's connection.
+// t   - The client's transport.
+//
+func (h *websocketHandler) serveLongPolling(w http.ResponseWriter, req *http.Request,
+	c *WebsocketConnection, t *longPollingTransport) {
+	var gone <-chan bool
+	if cn, ok := w.(http.CloseNotifier); ok {
+		gone = cn.CloseNotify()
+	}
+	msgs := t.poll(longPollingTimeout, gone)
+	if t.isClosed() {
+		h.deleteConn(c)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-cache")
+	json.NewEncoder(w).Encode(msgs)
+}
+
+// serveFallbackRequest handles requests of the clients already connected
+// via one of the fallback transports. POST requests carry the messages,
+// GET requests are polls of the long-polling transport. Each request has
+// to pass the secret token received with the ':connected' event in the
+// 'token' query parameter, otherwise the session is reported as not found.
+//
+// w   - The HTTP response writer.
+// req - The request to be handled.
+// sid - The client's session id.
+//
+func (h *websocketHandler) serveFallbackRequest(w http.ResponseWriter, req *http.Request, sid string) {
+	c := h.conn(sid)
+	if c == nil || !c.isFallbackToken(req.URL.Query().Get("token")) {
+		http.NotFound(w, req)
+		return
+	}
+	c.mtx.Lock()
+	fallback := c.fallback
+	c.mtx.Unlock()
+	if t, ok := fallback.(*longPollingTransport); ok && isLongPollingRequest(req) {
+		h.serveLongPolling(w, req, c, t)
+	} else if fallback != nil && req.Method == "POST" {
+		h.serveFallbackMessage(w, req, c)
+	} else {
+		http.NotFound(w, req)
+	}
+}
+
+// serveFallbackMessage handles a message sent by the client connected
+// via one of the fallback transports. The message is the request's body
+// and has the same format as the websocket one. Message is accepted with
+// 202 status once decoded, messages exceeding the size limit are rejected
+// with 413, other invalid ones with 400. Status of the message is also
+// delivered to the client the same way as other messages, according to
+// the negotiated reply mode.
+//
+// w   - The HTTP response writer.
+// req - The message request.
+// c   - The sender's connection.
+//
+func (h *websocketHandler) serveFallbackMessage(w http.ResponseWriter, req *http.Request,
+	c *WebsocketConnection) {
+	c.dmtx.Lock()
+	defer c.dmtx.Unlock()
+	limits := h.messageLimits()
+	body := io.Reader(req.Body)
+	if max := limits.maxSize(); max > 0 {
+		// Reading one byte more to find out if the limit is exceeded.
+		body = io.LimitReader(body, int64(max)+1)
+	}
+	data, err := ioutil.ReadAll(body)
+	if err == nil {
+		err = limits.check(data)
+	}
+	if s := messageLimitStatus(err); s != nil {
+		if err == errMessageTooLarge {
+			w.WriteHeader(http.StatusRequestEntityTooLarge)
+		} else {
+			w.WriteHeader(http.StatusBadRequest)
+		}
+		h.logStatus(c, s, nil)
+		return
+	}
+	var msg *WebsocketMessage
+	if err == nil {
+		msg, err = newWebsocketMessageFromJSON(data)
+	}
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		h.logStatus(c, &Status{"Bad request", 400}, nil)
+		return
+	}
+	w.WriteHeader(http.StatusAccepted)
+	h.dispatch(c, msg)
+	if !c.IsAlive() {
+		// Client has closed the session.
+		h.deleteConn(c)
+	}
+}
+
+// servePreflight answers the CORS preflight request of the fallback
+// transports. Credentials are not allowed, clients are identified by
+// the session tokens passed in the query string.
+//
+// w   - The HTTP response writer.
+// req - The preflight request.
+//
+func (h *websocketHandler) servePreflight(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Access-Control-Allow-Methods", "GET, POST, OPTIONS")
+	if headers := req.Header.Get("Access-Control-Request-Headers"); headers != "" {
+		w.Header().Set("Access-Control-Allow-Headers", headers)
+	}
+	w.Header().Set("Access-Control-Max-Age", "86400")
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// allow checks the rate limits of the given event configured for the
+// handler's vhost, per connection, per user and per vhost.
+//
+// c     - The sender's connection.
+// event - The event name.
+//
+// Returns whether the event can be dispatched or not.
+func (h *websocketHandler) allow(c *WebsocketConnection, event string) bool {
+	if h.vhost == nil {
+		return true
+	}
+	limits := h.vhost.eventRateLimits(event)
+	if limits == nil {
+		return true
+	}
+	if !c.limiter.allow(event, limits.Connection) {
+		return false
+	}
+	if uid := c.Uid(); uid != "" && !h.vhost.uidLimiter.allow(uid+":"+event, limits.Uid) {
+		return false
+	}
+	return h.vhost.vhostLimiter.allow(event, limits.Vhost)
 }
 
 // dispatch takes given message and handles it in appropriate way according
@@ -130,6 +722,14 @@ func (h *websocketHandler) handle(ws *websocket.Conn) {
 //
 func (h *websocketHandler) dispatch(c *WebsocketConnection, msg *WebsocketMessage) {
 	var s *Status
+	if !h.allow(c, msg.Event()) {
+		h.logStatus(c, &Status{"Rate limit exceeded", 457}, msg)
+		if !c.limiter.allow(":violations", h.vhost.rateLimitViolations()) {
+			// Client doesn't care about the limits at all.
+			h.disconnect(c, &Status{"Too many rate limit violations", 458})
+		}
+		return
+	}
 	// Route to the appropriate handler.
 	switch msg.Event() {
 	case "broadcast":
@@ -140,49 +740,53 @@ func (h *websocketHandler) dispatch(c *WebsocketConnection, msg *WebsocketMessag
 		s = h.handleSubscribe(c, msg)
 	case "unsubscribe":
 		s = h.handleUnsubscribe(c, msg)
+	case "updateMember":
+		s = h.handleUpdateMember(c, msg)
 	case "auth":
 		s = h.handleAuth(c, msg)
 	case "close":
 		s = h.handleClose(c, msg)
+	case "options":
+		s = h.handleOptions(c, msg)
+	case "pong":
+		s = &Status{"Pong", 302}
 	default:
 		s = &Status{"Bad request", 400}
 	}
 	// Log status code.
-	h.logStatus(c, s, msg.JSON())
+	h.logStatus(c, s, msg)
 }
 
 // logStatus writes specified status information to the logs. The 3xx
-// statuses shall be logged only when debug mode is enabled. If clients
-// specifies that wants to get error messages, then it should send such
-// one in case of handling a 4xx or 5xx status.
+// statuses are logged only when debug mode is enabled, globally or for
+// the handler's vhost. Depending on the reply mode negotiated by the
+// client it also sends an error or acknowledgement back to the client.
 //
-// c      - Related websocket connection.
-// status - A textual status message.
-// code   - Status code.
-// msg    - Related message.
+// c   - Related websocket connection.
+// s   - The status to be logged.
+// msg - Related message, may be nil.
 //
 // Example:
 //
-//     h.logStatus(c, "Bad request", 400, handledMessage)
+//     h.logStatus(c, &Status{"Bad request", 400}, handledMessage)
 //
-func (h *websocketHandler) logStatus(c *WebsocketConnection, s *Status, msg string) {
-	switch {
-	case s.Code >= 400:
-		// TODO: make the answers only when the client's debug mode is
-		// enabled or some 'optional errors' flag enabled or smth...
-		c.Send(map[string]interface{}{":error": s.Map()})
-	case s.Code >= 300 && s.Code < 400:
-		// Log information statuses only when debug mode is enabled.
-		// TODO: log after adding a debug mode...
-		return
-	case s.Code < 300:
-		// Nothing to do, just go to logging...
-	}
-	if h.vhost == nil {
+func (h *websocketHandler) logStatus(c *WebsocketConnection, s *Status, msg *WebsocketMessage) {
+	c.reply(s, msg)
+	if h.vhost == nil || h.vhost.ctx == nil {
 		// Should never happen, but better safe than sorry!
 		return
 	}
-	h.endpoint.log.Printf("websocket[%s]: %s; %s", h.vhost.Path(), s.String(), msg)
+	e := &logEntry{
+		level:     logLevelForStatus(s),
+		component: "websocket",
+		sid:       c.Id(),
+		uid:       c.Uid(),
+		status:    s,
+	}
+	if msg != nil {
+		e.event, e.msg = msg.Event(), msg.JSON()
+	}
+	h.vhost.ctx.writeLog(h.vhost, e)
 }
 
 // Websocket Frontent Protocol handlers
@@ -203,20 +807,32 @@ func (h *websocketHandler) handleAuth(c *WebsocketConnection,
 		// No token specified, invalid payload!
 		return &Status{"Bad request", 400}
 	}
-	if c.IsAuthenticated() {
-		// Close current session if authenticated.
-		c.reauthenticate(nil)
-	}
 	if perm, ok = h.vhost.ValidateSingleAccessToken(token); !ok || perm == nil {
 		// No such sigle access token, access denied!
 		return &Status{"Unauthorized", 402}
 	}
-	c.authenticate(perm)
+	if !h.tracker.authenticate(c.Id(), perm.Uid(), h.connectionLimits()) {
+		// Too many sessions of this user, current session is kept.
+		return &Status{"Too many connections", 459}
+	}
+	if c.IsAuthenticated() {
+		// Close current session if authenticated.
+		c.reauthenticate(perm)
+	} else {
+		c.authenticate(perm)
+	}
 	return &Status{"Authenticated", 201}
 }
 
 // handleSubscribe is a handler for the 'subscribe' Websocket Frontend
-// Protocol event.
+// Protocol event. Not existing channels matching the vhost's auto-created
+// channels policy are created. Channel name containing wildcards, eg.
+// 'orders.*', subscribes all the matching channels, including the ones
+// opened later on. Private channels are matched only if the client is
+// allowed to operate on them, presence channels are never matched. The
+// optional filter limits the events sent to the client to the listed ones,
+// with the top-level data fields equal to the given values. Patterns can't
+// be filtered.
 //
 // c   - Related websocket connection.
 // msg - The message to be handled.
@@ -227,12 +843,14 @@ func (h *websocketHandler) handleSubscribe(c *WebsocketConnection,
 	// {
 	//     "channel": "channel name...",
 	//     "hidden":  true, // or false
-	//     "data": {...}
+	//     "data": {...},
+	//     "filter": {"events": [...], "where": {...}}
 	// }
 	var err error
 	var chanName string
 	var hidden, ok bool
 	var data map[string]interface{}
+	var filter *subscriptionFilter
 	var channel *Channel
 
 	if chanName, ok = msg.Get("channel").(string); chanName == "" {
@@ -247,20 +865,55 @@ func (h *websocketHandler) handleSubscribe(c *WebsocketConnection,
 		// No user data specified, making empty one by default.
 		data = make(map[string]interface{})
 	}
+	if x := msg.Get("filter"); x != nil {
+		if filter, err = newSubscriptionFilter(x); err != nil {
+			// Filter is malformed, invalid payload!
+			return &Status{"Bad request", 400}
+		}
+	}
+	if isChannelPattern(chanName) {
+		var pattern *channelPattern
+		if filter != nil {
+			// Patterns can't be filtered, invalid payload!
+			return &Status{"Bad request", 400}
+		}
+		if pattern, err = newChannelPattern(chanName); err != nil {
+			// Pattern can't match any channel!
+			return &Status{"Channel not found", 454}
+		}
+		h.vhost.subscribePattern(c, pattern)
+		return &Status{"Subscribed", 202}
+	}
 	if channel, err = h.vhost.Channel(chanName); err != nil {
-		// Nope, channel not found!
-		return &Status{"Channel not found", 454}
+		if _, ok = h.vhost.autoChannelTimeout(chanName); !ok {
+			// Nope, channel not found!
+			return &Status{"Channel not found", 454}
+		}
+		kind := ChannelTypeFromName(chanName)
+		if kind&ChannelPrivate == ChannelPrivate && !c.IsAllowed(chanName) {
+			// Not creating the channel this guy can't operate on!
+			return &Status{"Forbidden", 403}
+		}
+		if channel, err = h.vhost.openAutoChannel(chanName); err != nil {
+			// Channel name is invalid...
+			return &Status{"Channel not found", 454}
+		}
 	}
 	if channel.IsPrivate() && !c.IsAllowed(chanName) {
 		// Can't operate on this channel, access denied!
 		return &Status{"Forbidden", 403}
 	}
-	channel.subscribe(c, hidden, data)
+	channel.subscribe(c, hidden, data, "", filter)
+	if !channel.IsAlive() {
+		// Channel has been closed in the meantime!
+		return &Status{"Channel not found", 454}
+	}
 	return &Status{"Subscribed", 202}
 }
 
 // handleUnsubscribe is a handler for the 'unsubscribe' Websocket Frontend
-// Protocol event.
+// Protocol event. Unsubscribing a pattern unsubscribes the channels
+// subscribed via that pattern.
 //
 // c   - Related websocket connection.
 // msg - The message to be handled.
@@ -286,6 +939,17 @@ func (h *websocketHandler) handleUnsubscribe(c *WebsocketConnection,
 		// No user data specified, making empty one by default.
 		data = make(map[string]interface{})
 	}
+	if isChannelPattern(chanName) {
+		if _, err = newChannelPattern(chanName); err != nil {
+			// Pattern can't match any channel!
+			return &Status{"Channel not found", 454}
+		}
+		if !h.vhost.unsubscribePattern(c, chanName) {
+			// This guy is not subscribing this pattern!
+			return &Status{"Not subscribed", 453}
+		}
+		return &Status{"Unsubscribed", 203}
+	}
 	if channel, err = h.vhost.Channel(chanName); err != nil {
 		// Nope, channel not found!
 		return &Status{"Channel not found", 454}
@@ -298,8 +962,52 @@ func (h *websocketHandler) handleUnsubscribe(c *WebsocketConnection,
 	return &Status{"Unsubscribed", 203}
 }
 
+// handleUpdateMember is a handler for the 'updateMember' Websocket Frontend
+// Protocol event. Allows the presence channel's subscriber to change its
+// data (eg. status) without unsubscribing and subscribing the channel again.
+//
+// c   - Related websocket connection.
+// msg - The message to be handled.
+//
+// Returns status message and code.
+func (h *websocketHandler) handleUpdateMember(c *WebsocketConnection,
+	msg *WebsocketMessage) *Status {
+	// {
+	//     "channel": "channel name...",
+	//     "data": {...}
+	// }
+	var ok bool
+	var err error
+	var chanName string
+	var data map[string]interface{}
+	var channel *Channel
+
+	if chanName, ok = msg.Get("channel").(string); chanName == "" {
+		// Channel name not found, invalid payload!
+		return &Status{"Bad request", 400}
+	}
+	if data, ok = msg.Get("data").(map[string]interface{}); !ok {
+		// Nothing to update, invalid payload!
+		return &Status{"Bad request", 400}
+	}
+	if channel, err = h.vhost.Channel(chanName); err != nil {
+		// Nope, channel not found!
+		return &Status{"Channel not found", 454}
+	}
+	if !channel.IsPresence() {
+		// Only presence channels have the member data!
+		return &Status{"Bad request", 400}
+	}
+	if !channel.updateMember(c, data) {
+		// This guy is not subscribing this channel!
+		return &Status{"Not subscribed", 453}
+	}
+	return &Status{"Member updated", 209}
+}
+
 // handleBroadcast is a handler for the 'broadcast' Websocket Frontend
-// Protocol event.
+// Protocol event. The client can broadcast only the events allowed by the
+// channel's broadcast policy.
 //
 // c   - Related websocket connection.
 // msg - The message to be handled.
@@ -343,6 +1051,10 @@ func (h *websocketHandler) handleBroadcast(c *WebsocketConnection,
 		// Can't broadcast on the channel without subscribing it!
 		return &Status{"Not subscribed", 453}
 	}
+	if !h.vhost.isBroadcastAllowed(c, chanName, eventName) {
+		// Channel's policy doesn't let this guy broadcast this event!
+		return &Status{"Forbidden", 403}
+	}
 	if triggerName != "" && !c.IsAuthenticated() { // FIXME: Backend should have permissions too!
 		// Can't trigger, access denied!
 		return &Status{"Forbidden", 403}
@@ -425,6 +1137,39 @@ func (h *websocketHandler) handleClose(c *WebsocketConnection,
 	return &Status{"Disconnected", 207}
 }
 
+// handleOptions is a handler for the 'options' Websocket Frontend Protocol
+// event. Allows the client to negotiate which replies it wants to get
+// and how it wants to be pinged, usually sent right after connecting.
+//
+// c   - Related websocket connection.
+// msg - The message to be handled.
+//
+// Returns status message and code.
+func (h *websocketHandler) handleOptions(c *WebsocketConnection,
+	msg *WebsocketMessage) *Status {
+	// {
+	//     "replies": "errors", // or "acks", or "none"
+	//     "keepalive": "frames", // or "events"
+	// }
+	var replies, keepalive string
+
+	replies, _ = msg.Get("replies").(string)
+	keepalive, _ = msg.Get("keepalive").(string)
+	if replies == "" && keepalive == "" {
+		// No options specified, invalid payload!
+		return &Status{"Bad request", 400}
+	}
+	if replies != "" && !c.setReplyMode(replies) {
+		// Unknown reply mode, invalid payload!
+		return &Status{"Bad request", 400}
+	}
+	if keepalive != "" && !c.setKeepaliveMode(keepalive) {
+		// Unknown keepalive mode, invalid payload!
+		return &Status{"Bad request", 400}
+	}
+	return &Status{"Options set", 208}
+}
+
 // Exported
 // -----------------------------------------------------------------------------
 
@@ -437,6 +1182,14 @@ func (h *websocketHandler) IsAlive() bool {
 	return h.alive
 }
 
+// IsDraining returns whether the handler is draining or not. Threadsafe,
+// depends on the drain function calls.
+func (h *websocketHandler) IsDraining() bool {
+	h.mtx.Lock()
+	defer h.mtx.Unlock()
+	return h.draining
+}
+
 // Kill stops execution of this handler and disconnects all connected clients.
 // Threadsafe, can be called only from the websocket endpoint, but the IsAlive
 // function's result depends on it.
@@ -450,13 +1203,64 @@ func (h *websocketHandler) Kill() {
 }
 
 // ServeHTTP extends standard websocket.Handler implementation of http.Handler
-// interface.
+// interface. Additionally it serves the fallback transports for the clients
+// which can't use websockets: GET requests accepting 'text/event-stream'
+// open the server-sent events stream, GET requests with 'transport=polling'
+// query parameter create and poll the long-polling sessions. POST requests
+// carry the messages of both.
+//
+// Requests sent from the origins not allowed by the vhost are rejected.
+// Requests without the origin, usually sent by non-browser clients, are
+// always accepted. Responses to the allowed cross-origin requests carry
+// the CORS headers, and OPTIONS preflight requests are answered, so the
+// browsers can use the fallback transports from other origins.
 //
 // w - The HTTP response writer.
 // r - The request to be handled.
 //
 func (h *websocketHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
-	if h.IsAlive() {
+	if origin := req.Header.Get("Origin"); origin != "" {
+		if !h.isOriginAllowed(origin) {
+			// Website not allowed to talk to this vhost.
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		w.Header().Set("Access-Control-Allow-Origin", origin)
+		w.Header().Add("Vary", "Origin")
+	}
+	if req.Method == "OPTIONS" {
+		h.servePreflight(w, req)
+		return
+	}
+	if sid := req.URL.Query().Get("sid"); sid != "" {
+		// Requests of the already connected fallback clients are
+		// served even while draining.
+		if h.IsAlive() {
+			h.serveFallbackRequest(w, req, sid)
+		}
+		return
+	}
+	if h.IsDraining() {
+		// Not accepting new connections anymore, client has to try
+		// again later, possibly on another node.
+		w.Header().Set("Retry-After", strconv.Itoa(h.retryAfter()))
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+	if !h.IsAlive() {
+		return
+	}
+	if code := h.tracker.admit(h.remoteIp(req), h.connectionLimits()); code != 0 {
+		// Vhost is full or client has too many connections already.
+		w.WriteHeader(code)
+		return
+	}
+	switch {
+	case isEventStreamRequest(req):
+		h.serveEventStream(w, req)
+	case isLongPollingRequest(req):
+		h.serveLongPollingConnect(w, req)
+	default:
 		h.handler.ServeHTTP(w, req)
 	}
 }
@@ -19,6 +19,7 @@ import (
 	"net/http"
 	"path"
 	"sync"
+	"time"
 )
 
 // WebsocketServeMux is an HTTP request multiplexer. Basically works the same
@@ -151,3 +152,26 @@ func (mux *WebsocketServeMux) KillAll() {
 		h.Kill()
 	}
 }
+
+// DrainAll puts all registered handlers into the draining mode.
+//
+// delay - The reconnect delay to be suggested to the clients.
+//
+func (mux *WebsocketServeMux) DrainAll(delay time.Duration) {
+	mux.mtx.Lock()
+	defer mux.mtx.Unlock()
+	for _, h := range mux.m {
+		h.drain(delay)
+	}
+}
+
+// ConnsCount returns total number of the connections active within
+// all registered handlers.
+func (mux *WebsocketServeMux) ConnsCount() (n int) {
+	mux.mtx.Lock()
+	defer mux.mtx.Unlock()
+	for _, h := range mux.m {
+		n += h.connsCount()
+	}
+	return
+}
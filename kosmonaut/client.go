@@ -93,6 +93,20 @@ func (c *Client) OpenChannel(name string) (err error) {
 	return
 }
 
+// OpenEphemeralChannel opens specified channel which is kept in the server's
+// memory only. It disappears when the server restarts or when nobody
+// subscribes it for a while. If channel already exists, then ok response
+// will be received anyway.
+// 
+// name - A name of the channel to be created.
+// 
+// Returns an error if something went wrong.
+func (c *Client) OpenEphemeralChannel(name string) (err error) {
+	payload := []string{"OC", name, "ephemeral"}
+	_, err = c.performRequest(payload)
+	return
+}
+
 // Close closes specified channel. If channel doesn't exist then an error will
 // be thrown.
 //
@@ -105,6 +119,34 @@ func (c *Client) CloseChannel(name string) (err error) {
 	return
 }
 
+// SetChannelMetadata sets the metadata entry of the specified channel,
+// eg. its title or owner. If channel doesn't exist then an error will
+// be thrown.
+//
+// name  - A name of the channel.
+// key   - The metadata key.
+// value - The value to be set.
+//
+// Returns an error if something went wrong.
+func (c *Client) SetChannelMetadata(name, key, value string) (err error) {
+	payload := []string{"CM", name, key, value}
+	_, err = c.performRequest(payload)
+	return
+}
+
+// DeleteChannelMetadata removes the metadata entry of the specified
+// channel.
+//
+// name - A name of the channel.
+// key  - The metadata key to be removed.
+//
+// Returns an error if something went wrong.
+func (c *Client) DeleteChannelMetadata(name, key string) (err error) {
+	payload := []string{"CM", name, key}
+	_, err = c.performRequest(payload)
+	return
+}
+
 // Broadcast sends an event with attached data on the specified channel.
 // 
 // channel - A name of the channel to broadcast to.
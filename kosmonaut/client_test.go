@@ -42,6 +42,33 @@ var expectations = []expectation{
 		func() bool {
 			return true
 		},
+	}, {
+		"OpenEphemeralChannel",
+		func() bool {
+			return c.OpenEphemeralChannel("bar") == nil
+		},
+		func() bool {
+			ch, err := v.Channel("bar")
+			return err == nil && ch.IsEphemeral()
+		},
+	}, {
+		"SetChannelMetadata",
+		func() bool {
+			return c.SetChannelMetadata("bar", "title", "Bar") == nil
+		},
+		func() bool {
+			ch, err := v.Channel("bar")
+			return err == nil && ch.Metadata()["title"] == "Bar"
+		},
+	}, {
+		"DeleteChannelMetadata",
+		func() bool {
+			return c.DeleteChannelMetadata("bar", "title") == nil
+		},
+		func() bool {
+			ch, err := v.Channel("bar")
+			return err == nil && len(ch.Metadata()) == 0
+		},
 	}, {
 		"Broadcast.1",
 		func() bool {
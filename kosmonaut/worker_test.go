@@ -1,8 +1,8 @@
 package kosmonaut
 
 import (
-	"code.google.com/p/go.net/websocket"
 	"fmt"
+	"golang.org/x/net/websocket"
 	"testing"
 )
 